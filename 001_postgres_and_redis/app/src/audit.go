@@ -0,0 +1,181 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+const (
+    AuditLogin          = "auth.login"
+    AuditLoginFailed    = "auth.login_failed"
+    AuditLogout         = "auth.logout"
+    AuditLogoutAll      = "auth.logout_all"
+    AuditUserUpdate     = "user.update"
+    AuditUserDelete     = "user.delete"
+    AuditPasswordReset  = "user.password_reset"
+    AuditTotpEnable     = "user.totp_enable"
+    AuditTotpDisable    = "user.totp_disable"
+    AuditApiKeyCreate   = "api_key.create"
+    AuditApiKeyDelete   = "api_key.delete"
+    AuditPostDelete     = "post.delete"
+    AuditPostHide       = "post.hide"
+    AuditPostUnhide     = "post.unhide"
+    AuditPostRestore    = "post.restore"
+    AuditPostRevert     = "post.revert"
+    AuditCommentDelete  = "comment.delete"
+    AuditCommentHide    = "comment.hide"
+    AuditCommentUnhide  = "comment.unhide"
+    AuditCommentRestore = "comment.restore"
+    AuditModeration     = "moderation."
+    AuditRoleChange     = "admin.role_change"
+    AuditSuspend        = "admin.suspend"
+    AuditLiftSuspension = "admin.lift_suspension"
+    AuditRevokeSessions = "admin.revoke_sessions"
+    AuditImpersonate    = "admin.impersonate"
+
+    AuditTargetUser    = "user"
+    AuditTargetPost    = "post"
+    AuditTargetComment = "comment"
+    AuditTargetApiKey  = "api_key"
+)
+
+// How many events are returned at most by a single request
+const auditMaxLimit = 1000
+
+type (
+    // AuditEvent records who did what to which object. Events are only ever inserted, and the database is set up to
+    // refuse changing or removing them. Names are copied, so that events stay readable once the objects are gone.
+    AuditEvent struct {
+        ID             uint      `json:"id" gorm:"primarykey"`
+        CreatedAt      time.Time `json:"created_at" gorm:"index"`
+        ActorID        *uint     `json:"actor_id" gorm:"index"`
+        ActorName      string    `json:"actor_name" gorm:"size:255"`
+        // Name of the admin acting on behalf of the actor within an impersonated session
+        ImpersonatedBy string    `json:"impersonated_by,omitempty" gorm:"size:255"`
+        Action         string    `json:"action" gorm:"size:64;index"`
+        TargetType     string    `json:"target_type" gorm:"size:32"`
+        TargetID       *uint     `json:"target_id"`
+        TargetName     string    `json:"target_name" gorm:"size:255"`
+        ClientIP       string    `json:"client_ip" gorm:"size:64"`
+        UserAgent      string    `json:"user_agent" gorm:"size:255"`
+    }
+
+    AuditTarget struct {
+        Type string
+        ID   uint
+        Name string
+    }
+)
+
+func userTarget(user User) AuditTarget {
+    return AuditTarget{Type: AuditTargetUser, ID: user.ID, Name: user.Name}
+}
+
+func postTarget(post *Post) AuditTarget {
+    return AuditTarget{Type: AuditTargetPost, ID: post.ID, Name: post.Title}
+}
+
+func commentTarget(comment *Comment) AuditTarget {
+    return AuditTarget{Type: AuditTargetComment, ID: comment.ID}
+}
+
+// emitAudit records the action of the authenticated user, if there is one.
+func emitAudit(context echo.Context, action string, target AuditTarget) {
+    var actor *User
+
+    if user, ok := context.Get("User").(User); ok {
+        actor = &user
+    }
+
+    emitAuditAs(context, actor, action, target)
+}
+
+// emitAuditAs records the action of the given actor, which may be nil for anonymous requests. Failing to record the
+// event does not fail the request, which has already taken effect.
+func emitAuditAs(context echo.Context, actor *User, action string, target AuditTarget) {
+    event := new(AuditEvent)
+    event.Action = action
+    event.TargetType = target.Type
+    event.TargetName = target.Name
+    event.ClientIP = context.RealIP()
+    event.UserAgent = context.Request().UserAgent()
+
+    if actor != nil {
+        event.ActorID = &actor.ID
+        event.ActorName = actor.Name
+    }
+    if session, ok := context.Get("Session").(Session); ok {
+        event.ImpersonatedBy = session.ImpersonatedBy
+    }
+    if target.ID != 0 {
+        event.TargetID = &target.ID
+    }
+    if len(event.UserAgent) > 255 {
+        event.UserAgent = event.UserAgent[:255]
+    }
+
+    result := sqlClient.Create(&event)
+    if result.Error != nil {
+        context.Logger().Error(result.Error)
+    }
+}
+
+// listAuditEvents godoc
+// @Summary List Audit Events
+// @Description Events are ordered from the newest. Times are given in RFC 3339.
+// @Tags admin
+// @Produce json
+// @Param from query string false "Since"
+// @Param to query string false "Until"
+// @Param actor_id query int false "Actor ID"
+// @Param action query string false "Action"
+// @Param target_type query string false "Target type"
+// @Param target_id query int false "Target ID"
+// @Param limit query int false "Limit"
+// @Security ApiKeyAuth
+// @Success 200 {array} AuditEvent
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /admin/audit [get]
+func listAuditEvents(context echo.Context) error {
+    var events []AuditEvent
+
+    query := sqlClient
+    for param, condition := range map[string]string{"from": "created_at >= ?", "to": "created_at < ?"} {
+        if value := context.QueryParam(param); value != "" {
+            t, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return context.JSON(http.StatusBadRequest, "Provided "+param+" time is invalid.")
+            }
+            query = query.Where(condition, t)
+        }
+    }
+    if actorID := context.QueryParam("actor_id"); actorID != "" {
+        query = query.Where("actor_id = ?", actorID)
+    }
+    if action := context.QueryParam("action"); action != "" {
+        query = query.Where("action = ?", action)
+    }
+    if targetType := context.QueryParam("target_type"); targetType != "" {
+        query = query.Where("target_type = ?", targetType)
+    }
+    if targetID := context.QueryParam("target_id"); targetID != "" {
+        query = query.Where("target_id = ?", targetID)
+    }
+
+    limit := 100
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > auditMaxLimit {
+            return context.JSON(http.StatusBadRequest, "Provided limit is invalid.")
+        }
+        limit = number
+    }
+
+    query.Order("created_at desc, id desc").Limit(limit).Find(&events)
+
+    return context.JSON(http.StatusOK, events)
+}
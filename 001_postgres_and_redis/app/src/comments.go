@@ -1,9 +1,10 @@
 package main
 
 import (
-    "fmt"
+    "errors"
     "github.com/labstack/echo/v4"
     "gorm.io/gorm"
+    "gorm.io/gorm/clause"
     "net/http"
     "strconv"
     "strings"
@@ -12,15 +13,22 @@ import (
 
 type (
     Comment struct {
-        ID           uint           `json:"id" gorm:"primarykey"`
-        CreatedAt    time.Time      `json:"created_at"`
-        UpdatedAt    time.Time      `json:"updated_at"`
-        DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
-        AuthorID     uint           `json:"author_id"`
-        Author       User           `json:"author"`
-        PostID       int            `json:"post_id"`
-        Post         Post           `json:"post"`
-        Content      string         `json:"content"`
+        ID              uint           `json:"id" gorm:"primarykey"`
+        CreatedAt       time.Time      `json:"created_at" gorm:"index"`
+        UpdatedAt       time.Time      `json:"updated_at" gorm:"index"`
+        DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
+        // User who has moved the comment to the trash
+        DeletedByID     *uint          `json:"-"`
+        // Whether the comment has been deleted together with its post, and so is restored with it
+        DeletedWithPost bool           `json:"-"`
+        AuthorID        uint           `json:"author_id"`
+        Author          User           `json:"author"`
+        PostID          int            `json:"post_id"`
+        Post            Post           `json:"post"`
+        Content         string         `json:"content"`
+        HiddenAt        *time.Time     `json:"hidden_at,omitempty" gorm:"index"`
+        // Whether the comment has been hidden by reaching the report threshold rather than by a moderator
+        HiddenByReports bool           `json:"-"`
     }
 
     CommentCreate struct {
@@ -33,6 +41,11 @@ type (
     }
 )
 
+// sortKeys returns the values of the fields the comments can be sorted by.
+func (comment *Comment) sortKeys() sortKeys {
+    return sortKeys{CreatedAt: comment.CreatedAt, UpdatedAt: comment.UpdatedAt}
+}
+
 func getCommentOrError(context echo.Context) (*Comment, int) {
     var comment Comment
 
@@ -41,11 +54,20 @@ func getCommentOrError(context echo.Context) (*Comment, int) {
         return nil, http.StatusBadRequest
     }
 
-    result := sqlClient.Preload("Author").Preload("Post").Preload("Post.Author").First(&comment, id)
+    result := sqlClient.
+        Preload("Author", withDeletedAuthors).
+        Preload("Post").
+        Preload("Post.Author", withDeletedAuthors).
+        First(&comment, id)
     if result.Error != nil {
         return nil, http.StatusNotFound
     }
 
+    // A comment whose post has been deleted is gone along with it
+    if comment.Post.ID == 0 {
+        return nil, http.StatusNotFound
+    }
+
     return &comment, 0
 }
 
@@ -53,24 +75,63 @@ func getCommentOrError(context echo.Context) (*Comment, int) {
 // @Summary List Comments
 // @Tags comments
 // @Produce json
-// @Param author_id query int false "Author ID"
-// @Param post_id query int false "Post ID"
-// @Success 200 {array} Comment
+// @Param author_id query string false "Author IDs, comma-separated"
+// @Param post_id query string false "Post IDs, comma-separated"
+// @Param created_after query string false "Created after, in RFC 3339"
+// @Param created_before query string false "Created before, in RFC 3339"
+// @Param updated_after query string false "Updated after, in RFC 3339"
+// @Param sort query string false "created_at or updated_at, prefixed with a minus for the descending order"
+// @Param limit query int false "Number of comments on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Success 200 {object} Page{items=[]Comment}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
 // @Router /comments [get]
 func listComments(context echo.Context) error {
     var comments []Comment
+    var next *pageCursor
+
+    page, err := getPageQuery(context, "created_at", "updated_at")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    authorIDs, err := getIDsParam(context, "author_id")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    postIDs, err := getIDsParam(context, "post_id")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
 
-    query := sqlClient
-    if authorID := context.QueryParam("author_id"); authorID != "" {
-        query = query.Where("author_id = ?", authorID)
-        fmt.Println(authorID)
+    // The comments of hidden, deleted and unpublished posts are left out together with them. Unlisted posts show
+    // their comments only when asked for by their ID.
+    statuses := []string{PostPublished}
+    query, err := filterByTime(context, sqlClient.Where("hidden_at IS NULL"))
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    if len(authorIDs) > 0 {
+        query = query.Where("author_id IN ?", authorIDs)
     }
-    if postID := context.QueryParam("post_id"); postID != "" {
-        query = query.Where("post_id = ?", postID)
+    if len(postIDs) > 0 {
+        query = query.Where("post_id IN ?", postIDs)
+        statuses = append(statuses, PostUnlisted)
     }
-    query.Preload("Author").Preload("Post").Preload("Post.Author").Find(&comments)
+    visiblePosts := sqlClient.Model(&Post{}).Select("id").Where("hidden_at IS NULL AND status IN ?", statuses)
+    query = query.Where("post_id IN (?)", visiblePosts)
+    page.apply(query).
+        Preload("Author", withDeletedAuthors).
+        Preload("Post").
+        Preload("Post.Author", withDeletedAuthors).
+        Find(&comments)
 
-    return context.JSON(http.StatusOK, comments)
+    if len(comments) > page.Limit {
+        comments = comments[:page.Limit]
+        next = page.cursorAt(comments[page.Limit-1].sortKeys(), comments[page.Limit-1].ID)
+    }
+
+    return sendPage(context, comments, next)
 }
 
 // createComment godoc
@@ -95,16 +156,30 @@ func createComment(context echo.Context) error {
     }
 
     post := new(Post)
-    result := sqlClient.First(&post, commentCreate.PostID)
-    if result.Error != nil {
+    comment := new(Comment)
+    err := sqlClient.Transaction(func(tx *gorm.DB) error {
+        // The post is locked until the comment is in place, so that it can not be deleted in the meantime
+        result := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+            Where("hidden_at IS NULL").
+            First(&post, commentCreate.PostID)
+        if result.Error != nil {
+            return result.Error
+        }
+        if !canViewPost(currentUser(context), post) {
+            return gorm.ErrRecordNotFound
+        }
+
+        comment.Author = context.Get("User").(User)
+        comment.Post = *post
+        comment.Content = commentCreate.Content
+        return tx.Create(&comment).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) {
         return context.JSON(http.StatusBadRequest, "Provided post does not exists.")
     }
-
-    comment := new(Comment)
-    comment.Author = context.Get("User").(User)
-    comment.Post = *post
-    comment.Content = commentCreate.Content
-    sqlClient.Create(&comment)
+    if err != nil {
+        return err
+    }
 
     return context.JSON(http.StatusCreated, comment)
 }
@@ -114,7 +189,11 @@ func createComment(context echo.Context) error {
 // @Tags comments
 // @Produce json
 // @Param id path int true "ID"
+// @Param If-None-Match header string false "ETag of the cached version"
+// @Security ApiKeyAuth
 // @Success 200 {object} Comment
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 304
 // @Failure 400
 // @Failure 404
 // @Router /comments/{id} [get]
@@ -123,6 +202,12 @@ func retrieveComment(context echo.Context) error {
     if err != 0 {
         return context.NoContent(err)
     }
+    if comment.HiddenAt != nil || comment.Post.HiddenAt != nil || !canViewPost(currentUser(context), &comment.Post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+    if notModified(context, etag(comment.UpdatedAt)) {
+        return context.NoContent(http.StatusNotModified)
+    }
 
     return context.JSON(http.StatusOK, comment)
 }
@@ -134,33 +219,81 @@ func retrieveComment(context echo.Context) error {
 // @Produce json
 // @Param id path int true "ID"
 // @Param comment body CommentUpdate true "Comment"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 200 {object} Comment
+// @Header 200 {string} ETag "Version of the resource"
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /comments/{id} [put]
 func updateComment(context echo.Context) error {
+    return editComment(context, false)
+}
+
+// patchComment godoc
+// @Summary Patch Comment
+// @Description Changes only the fields present in the JSON merge patch (RFC 7396).
+// @Tags comments
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param comment body CommentUpdate true "Comment"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Security ApiKeyAuth
+// @Success 200 {object} Comment
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 412
+// @Router /comments/{id} [patch]
+func patchComment(context echo.Context) error {
+    return editComment(context, true)
+}
+
+// editComment replaces the content of the comment with the one in the request, or with the merge patch sent with
+// PATCH applied to it.
+func editComment(context echo.Context, patch bool) error {
     comment, err := getCommentOrError(context)
     if err != 0 {
         return context.NoContent(err)
     }
 
-    if comment.AuthorID != context.Get("User").(User).ID {
+    if !canUpdateComment(context.Get("User").(User), comment) {
         return context.NoContent(http.StatusForbidden)
     }
+    if !ifMatch(context, etag(comment.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
 
     commentUpdate := new(CommentUpdate)
-    if err := context.Bind(commentUpdate); err != nil {
-        return err
-    }
-    if err := context.Validate(commentUpdate); err != nil {
-        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    if patch {
+        commentUpdate.Content = comment.Content
+        if err := bindMergePatch(context, commentUpdate); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
+    } else {
+        if err := context.Bind(commentUpdate); err != nil {
+            return err
+        }
+        if err := context.Validate(commentUpdate); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
     }
 
+    updatedAt := comment.UpdatedAt
     comment.Content = commentUpdate.Content
-    sqlClient.Save(&comment)
+
+    // The comment is written only if nobody has changed it since it has been read
+    result := sqlClient.Select("*").Where("updated_at = ?", updatedAt).Save(&comment)
+    if result.RowsAffected == 0 {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+    setETag(context, etag(comment.UpdatedAt))
 
     return context.JSON(http.StatusOK, comment)
 }
@@ -169,12 +302,14 @@ func updateComment(context echo.Context) error {
 // @Summary Delete Comment
 // @Tags comments
 // @Param id path int true "ID"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 204
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /comments/{id} [delete]
 func deleteComment(context echo.Context) error {
     comment, err := getCommentOrError(context)
@@ -182,11 +317,73 @@ func deleteComment(context echo.Context) error {
         return context.NoContent(err)
     }
 
-    if comment.AuthorID != context.Get("User").(User).ID {
+    if !canDeleteComment(context.Get("User").(User), comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+    if !ifMatch(context, etag(comment.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
+    if err := trashComment(context.Get("User").(User), comment); err != nil {
+        return err
+    }
+    emitAudit(context, AuditCommentDelete, commentTarget(comment))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// hideComment godoc
+// @Summary Hide Comment
+// @Tags comments
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /comments/{id}/hide [post]
+func hideComment(context echo.Context) error {
+    comment, err := getCommentOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canHideComment(context.Get("User").(User), comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    if comment.HiddenAt == nil || comment.HiddenByReports {
+        hideByModerator(comment, comment.HiddenAt)
+        emitAudit(context, AuditCommentHide, commentTarget(comment))
+    }
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// unhideComment godoc
+// @Summary Unhide Comment
+// @Tags comments
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /comments/{id}/unhide [post]
+func unhideComment(context echo.Context) error {
+    comment, err := getCommentOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canHideComment(context.Get("User").(User), comment) {
         return context.NoContent(http.StatusForbidden)
     }
 
-    sqlClient.Delete(&comment)
+    unhide(comment)
+    emitAudit(context, AuditCommentUnhide, commentTarget(comment))
 
     return context.NoContent(http.StatusNoContent)
 }
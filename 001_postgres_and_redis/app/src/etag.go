@@ -0,0 +1,50 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "strings"
+    "time"
+)
+
+// etag derives the strong entity tag of a resource from the time it has been last updated at. The time is taken with
+// millisecond precision, the one it is stored with.
+func etag(updatedAt time.Time) string {
+    return fmt.Sprintf(`"%x"`, updatedAt.UnixNano()/int64(time.Millisecond))
+}
+
+// matchesETag tells whether the list of entity tags sent by the client includes the tag. Weak tags match only when
+// compared weakly, as done for If-None-Match.
+func matchesETag(header string, tag string, weak bool) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if weak {
+            candidate = strings.TrimPrefix(candidate, "W/")
+        }
+        if candidate == "*" || candidate == tag {
+            return true
+        }
+    }
+    return false
+}
+
+// setETag adds the entity tag of the returned resource to the response.
+func setETag(context echo.Context, tag string) {
+    context.Response().Header().Set("ETag", tag)
+}
+
+// notModified adds the entity tag of the returned resource to the response and tells whether the client already has
+// its current version, as told by If-None-Match.
+func notModified(context echo.Context, tag string) bool {
+    setETag(context, tag)
+
+    header := context.Request().Header.Get("If-None-Match")
+    return header != "" && matchesETag(header, tag, true)
+}
+
+// ifMatch tells whether the resource is still in the version the client has read, as told by If-Match. Without the
+// header any version is fine.
+func ifMatch(context echo.Context, tag string) bool {
+    header := context.Request().Header.Get("If-Match")
+    return header == "" || matchesETag(header, tag, false)
+}
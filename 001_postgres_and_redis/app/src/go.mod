@@ -3,16 +3,17 @@ module github.com/akurczyk/golang_echo_blogging_platform/001_postgres_and_redis/
 go 1.14
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-playground/universal-translator v0.17.0 // indirect
-	github.com/go-playground/validator v9.31.0+incompatible // indirect
-	github.com/go-redis/redis/v8 v8.3.3 // indirect
-	github.com/labstack/echo-contrib v0.9.0 // indirect
-	github.com/labstack/echo/v4 v4.1.17 // indirect
-	github.com/labstack/gommon v0.3.0 // indirect
+	github.com/go-playground/validator v9.31.0+incompatible
+	github.com/go-redis/redis/v8 v8.3.3
+	github.com/labstack/echo-contrib v0.9.0
+	github.com/labstack/echo/v4 v4.1.17
+	github.com/labstack/gommon v0.3.0
 	github.com/leodido/go-urn v1.2.0 // indirect
-	github.com/swaggo/echo-swagger v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897 // indirect
-	gorm.io/driver/postgres v1.0.5 // indirect
-	gorm.io/gorm v1.20.6 // indirect
+	github.com/prometheus/client_golang v1.1.0
+	github.com/swaggo/echo-swagger v1.0.0
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	gorm.io/driver/postgres v1.0.5
+	gorm.io/gorm v1.20.6
 )
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "net/http"
+    "os"
+    "strings"
+)
+
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+// setupPolicy gives the admin role to the existing users listed in ADMIN_NAMES. Signing up with one of the names never
+// does, as anybody could take a name that is not registered yet, or that a deleted admin has left behind.
+func setupPolicy() {
+    var users []User
+
+    names := []string{}
+    for _, name := range strings.Split(os.Getenv("ADMIN_NAMES"), ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            names = append(names, name)
+        }
+    }
+    if len(names) == 0 {
+        return
+    }
+
+    sqlClient.Where("name IN ? AND role <> ?", names, RoleAdmin).Find(&users)
+    for _, user := range users {
+        user.Role = RoleAdmin
+        sqlClient.Model(&user).Update("role", RoleAdmin)
+        updateUserSessions(user)
+    }
+}
+
+func isModerator(user User) bool {
+    return user.Role == RoleModerator || user.Role == RoleAdmin
+}
+
+func isAdmin(user User) bool {
+    return user.Role == RoleAdmin
+}
+
+// currentUser returns the authenticated user, or nil on the endpoints open to everybody.
+func currentUser(context echo.Context) *User {
+    if user, ok := context.Get("User").(User); ok {
+        return &user
+    }
+    return nil
+}
+
+// Published and unlisted posts can be read by anybody, while drafts, scheduled and private posts only by their
+// authors. Unlisted posts are left out of the listings.
+func canViewPost(user *User, post *Post) bool {
+    if post.Status == PostPublished || post.Status == PostUnlisted {
+        return true
+    }
+    return user != nil && post.AuthorID == user.ID
+}
+
+// Authors manage their own content. Moderators can edit and hide anybody's, while deleting it is left to admins.
+func canUpdatePost(user User, post *Post) bool {
+    return post.AuthorID == user.ID || isModerator(user)
+}
+
+func canDeletePost(user User, post *Post) bool {
+    return post.AuthorID == user.ID || isAdmin(user)
+}
+
+func canHidePost(user User, post *Post) bool {
+    return isModerator(user)
+}
+
+func canUpdateComment(user User, comment *Comment) bool {
+    return comment.AuthorID == user.ID || isModerator(user)
+}
+
+func canDeleteComment(user User, comment *Comment) bool {
+    return comment.AuthorID == user.ID || isAdmin(user)
+}
+
+func canHideComment(user User, comment *Comment) bool {
+    return isModerator(user)
+}
+
+// Content is restored from the trash by whoever has deleted it, or by admins.
+func canRestorePost(user User, post *Post) bool {
+    return post.DeletedByID != nil && *post.DeletedByID == user.ID || isAdmin(user)
+}
+
+func canRestoreComment(user User, comment *Comment) bool {
+    return comment.DeletedByID != nil && *comment.DeletedByID == user.ID || isAdmin(user)
+}
+
+func canManageUsers(user User) bool {
+    return isAdmin(user)
+}
+
+func canModerate(user User) bool {
+    return isModerator(user)
+}
+
+// requireAdmin is a middleware letting through only the users allowed to manage other users.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if !canManageUsers(context.Get("User").(User)) {
+            return context.NoContent(http.StatusForbidden)
+        }
+
+        return next(context)
+    }
+}
+
+// requireModerator is a middleware letting through only the users allowed to work through the moderation queue.
+func requireModerator(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if !canModerate(context.Get("User").(User)) {
+            return context.NoContent(http.StatusForbidden)
+        }
+
+        return next(context)
+    }
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm/clause"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    ReportItemPost    = "post"
+    ReportItemComment = "comment"
+
+    ReportStatusOpen     = "open"
+    ReportStatusResolved = "resolved"
+
+    ModerationDismiss = "dismiss"
+    ModerationHide    = "hide"
+    ModerationDelete  = "delete"
+    ModerationWarn    = "warn"
+)
+
+var (
+    // Number of open reports after which an item is hidden until a moderator looks at it, 0 disables it
+    reportHideThreshold int
+)
+
+type (
+    // Report is a complaint of a user about a post or a comment. Once a moderator acts on the item, the action is
+    // recorded on all of its open reports.
+    Report struct {
+        ID             uint       `json:"id" gorm:"primarykey"`
+        CreatedAt      time.Time  `json:"created_at"`
+        UpdatedAt      time.Time  `json:"updated_at"`
+        ReporterID     uint       `json:"reporter_id" gorm:"index"`
+        ItemType       string     `json:"item_type" gorm:"size:16;index:idx_reports_item;uniqueIndex:idx_reports_vote"`
+        ItemID         uint       `json:"item_id" gorm:"index:idx_reports_item;uniqueIndex:idx_reports_vote"`
+        Reason         string     `json:"reason" gorm:"size:32"`
+        Details        string     `json:"details"`
+        Status         string     `json:"status" gorm:"size:16;index"`
+        // Reporter of an open report, cleared once resolved, so that a user has a single open report per item
+        OpenReporterID *uint      `json:"-" gorm:"uniqueIndex:idx_reports_vote"`
+        Action         string     `json:"action,omitempty" gorm:"size:16"`
+        Note           string     `json:"note,omitempty"`
+        ModeratorID    *uint      `json:"moderator_id,omitempty"`
+        ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+    }
+
+    ReportIn struct {
+        Reason  string `json:"reason" validate:"required,oneof=spam abuse hate violence sexual misinformation other"`
+        Details string `json:"details" validate:"max=1000"`
+    }
+
+    // ModerationIn is the action taken on a reported item. The note is sent to the author along with a warning.
+    ModerationIn struct {
+        Action string `json:"action" validate:"required,oneof=dismiss hide delete warn"`
+        Note   string `json:"note" validate:"max=1000"`
+    }
+
+    // ModerationQueueItem sums up the open reports of a single item.
+    ModerationQueueItem struct {
+        ItemType        string         `json:"item_type"`
+        ItemID          uint           `json:"item_id"`
+        ReportCount     int            `json:"report_count"`
+        Reasons         map[string]int `json:"reasons"`
+        FirstReportedAt time.Time      `json:"first_reported_at"`
+        LastReportedAt  time.Time      `json:"last_reported_at"`
+        Post            *Post          `json:"post,omitempty"`
+        Comment         *Comment       `json:"comment,omitempty"`
+    }
+)
+
+func setupReports() {
+    reportHideThreshold = getEnvInt("REPORT_HIDE_THRESHOLD", 5)
+}
+
+func countOpenReports(itemType string, itemID uint) int64 {
+    var count int64
+
+    sqlClient.Model(&Report{}).
+        Where("item_type = ? AND item_id = ? AND status = ?", itemType, itemID, ReportStatusOpen).
+        Count(&count)
+
+    return count
+}
+
+// createReport files the report of the current user. It returns nil after having responded with an error.
+func createReport(context echo.Context, itemType string, itemID uint, authorID uint) (*Report, error) {
+    user := context.Get("User").(User)
+
+    reportIn := new(ReportIn)
+    if err := context.Bind(reportIn); err != nil {
+        return nil, err
+    }
+    if err := context.Validate(reportIn); err != nil {
+        return nil, context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    if authorID == user.ID {
+        return nil, context.JSON(http.StatusBadRequest, "Own content can not be reported.")
+    }
+
+    report := new(Report)
+    report.ReporterID = user.ID
+    report.OpenReporterID = &user.ID
+    report.ItemType = itemType
+    report.ItemID = itemID
+    report.Reason = reportIn.Reason
+    report.Details = reportIn.Details
+    report.Status = ReportStatusOpen
+
+    // Every user gets a single vote per item, so that the threshold can not be reached by one person
+    result := sqlClient.Clauses(clause.OnConflict{DoNothing: true}).Create(&report)
+    if result.Error != nil {
+        return nil, result.Error
+    }
+    if result.RowsAffected == 0 {
+        return nil, context.JSON(http.StatusConflict, "This item has already been reported.")
+    }
+
+    return report, nil
+}
+
+// hideByReports hides the item having reached the report threshold, unless it has already been hidden some other way.
+func hideByReports(item interface{}) {
+    sqlClient.Model(item).
+        Where("hidden_at IS NULL").
+        Updates(map[string]interface{}{"hidden_at": time.Now(), "hidden_by_reports": true})
+}
+
+// hideByModerator hides the item on behalf of a moderator. An item already hidden by its reports stays hidden, but
+// is no longer shown again when they are dismissed.
+func hideByModerator(item interface{}, hiddenAt *time.Time) {
+    if hiddenAt == nil {
+        sqlClient.Model(item).Updates(map[string]interface{}{"hidden_at": time.Now(), "hidden_by_reports": false})
+    } else {
+        sqlClient.Model(item).Update("hidden_by_reports", false)
+    }
+}
+
+// unhide shows the item again, whoever has hidden it.
+func unhide(item interface{}) {
+    sqlClient.Model(item).Updates(map[string]interface{}{"hidden_at": nil, "hidden_by_reports": false})
+}
+
+// dismissReportHiding shows the item again if it has been hidden by its reports, but not if a moderator has hidden it.
+func dismissReportHiding(item interface{}) {
+    sqlClient.Model(item).
+        Where("hidden_by_reports = ?", true).
+        Updates(map[string]interface{}{"hidden_at": nil, "hidden_by_reports": false})
+}
+
+// reachedReportHideThreshold tells whether the item has collected enough reports to be hidden.
+func reachedReportHideThreshold(itemType string, itemID uint) bool {
+    return reportHideThreshold > 0 && countOpenReports(itemType, itemID) >= int64(reportHideThreshold)
+}
+
+// bindModerationIn reads the moderation action. It returns nil after having responded with an error.
+func bindModerationIn(context echo.Context) (*ModerationIn, error) {
+    moderationIn := new(ModerationIn)
+    if err := context.Bind(moderationIn); err != nil {
+        return nil, err
+    }
+    if err := context.Validate(moderationIn); err != nil {
+        return nil, context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+    if moderationIn.Action == ModerationWarn && strings.TrimSpace(moderationIn.Note) == "" {
+        return nil, context.JSON(http.StatusBadRequest, "A note is required to warn the author.")
+    }
+
+    return moderationIn, nil
+}
+
+func warnAuthor(context echo.Context, author User, itemType string, note string) {
+    body := fmt.Sprintf(
+        "Hello %v,\n\nYour %v has been reported by other users and reviewed by a moderator, who has left the "+
+            "following note:\n\n%v\n\nPlease make sure that your content follows the rules of the platform.",
+        author.Name, itemType, note,
+    )
+    if err := mailer.Send(author.Email, "Warning from the moderators", body); err != nil {
+        context.Logger().Error(err)
+    }
+}
+
+// resolveReports records the action on all the open reports of the item.
+func resolveReports(context echo.Context, itemType string, itemID uint, moderationIn *ModerationIn) {
+    moderator := context.Get("User").(User)
+
+    sqlClient.Model(&Report{}).
+        Where("item_type = ? AND item_id = ? AND status = ?", itemType, itemID, ReportStatusOpen).
+        Updates(map[string]interface{}{
+            "status":           ReportStatusResolved,
+            "open_reporter_id": nil,
+            "action":           moderationIn.Action,
+            "note":             moderationIn.Note,
+            "moderator_id":     moderator.ID,
+            "resolved_at":      time.Now(),
+        })
+}
+
+// reportPost godoc
+// @Summary Report Post
+// @Tags reports
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param report body ReportIn true "Report"
+// @Security ApiKeyAuth
+// @Success 201 {object} Report
+// @Failure 400
+// @Failure 401
+// @Failure 404
+// @Failure 409
+// @Router /posts/{id}/reports [post]
+func reportPost(context echo.Context) error {
+    post, err := getPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+    if post.HiddenAt != nil || !canViewPost(currentUser(context), post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    report, reportErr := createReport(context, ReportItemPost, post.ID, post.AuthorID)
+    if report == nil {
+        return reportErr
+    }
+
+    if reachedReportHideThreshold(ReportItemPost, post.ID) {
+        hideByReports(post)
+    }
+
+    return context.JSON(http.StatusCreated, report)
+}
+
+// reportComment godoc
+// @Summary Report Comment
+// @Tags reports
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param report body ReportIn true "Report"
+// @Security ApiKeyAuth
+// @Success 201 {object} Report
+// @Failure 400
+// @Failure 401
+// @Failure 404
+// @Failure 409
+// @Router /comments/{id}/reports [post]
+func reportComment(context echo.Context) error {
+    comment, err := getCommentOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+    if comment.HiddenAt != nil || comment.Post.HiddenAt != nil || !canViewPost(currentUser(context), &comment.Post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    report, reportErr := createReport(context, ReportItemComment, comment.ID, comment.AuthorID)
+    if report == nil {
+        return reportErr
+    }
+
+    if reachedReportHideThreshold(ReportItemComment, comment.ID) {
+        hideByReports(comment)
+    }
+
+    return context.JSON(http.StatusCreated, report)
+}
+
+// listModerationQueue godoc
+// @Summary List Reported Items Awaiting Moderation
+// @Description Items are ordered by the number of open reports, the most reported first.
+// @Tags moderation
+// @Produce json
+// @Param limit query int false "Number of items on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]ModerationQueueItem}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /moderation/queue [get]
+func listModerationQueue(context echo.Context) error {
+    var rows []struct {
+        ID              uint
+        ItemType        string
+        ItemID          uint
+        ReportCount     int
+        FirstReportedAt time.Time
+        LastReportedAt  time.Time
+    }
+    var reasons []struct {
+        ItemType string
+        ItemID   uint
+        Reason   string
+        Count    int
+    }
+    var posts []Post
+    var comments []Comment
+    var next *pageCursor
+
+    page, err := getPageQuery(context, "-report_count")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
+    // The open reports are summed up per item, and the ID of the first one breaks the ties
+    openReports := sqlClient.Model(&Report{}).
+        Select("min(id) AS id, item_type, item_id, count(*) AS report_count, " +
+            "min(created_at) AS first_reported_at, max(created_at) AS last_reported_at").
+        Where("status = ?", ReportStatusOpen).
+        Group("item_type, item_id")
+    page.apply(sqlClient.Table("(?) AS queue", openReports)).Scan(&rows)
+
+    if len(rows) > page.Limit {
+        rows = rows[:page.Limit]
+        next = page.cursorAt(sortKeys{ReportCount: rows[page.Limit-1].ReportCount}, rows[page.Limit-1].ID)
+    }
+
+    postIDs, commentIDs := []uint{}, []uint{}
+    for _, row := range rows {
+        switch row.ItemType {
+        case ReportItemPost:
+            postIDs = append(postIDs, row.ItemID)
+        case ReportItemComment:
+            commentIDs = append(commentIDs, row.ItemID)
+        }
+    }
+
+    // The items of the page are loaded at once, along with their reports per reason
+    sqlClient.Preload("Author", withDeletedAuthors).Where("id IN ?", postIDs).Find(&posts)
+    sqlClient.Preload("Author", withDeletedAuthors).Where("id IN ?", commentIDs).Find(&comments)
+    sqlClient.Model(&Report{}).
+        Select("item_type, item_id, reason, count(*) AS count").
+        Where("status = ?", ReportStatusOpen).
+        Where("(item_type = ? AND item_id IN ?) OR (item_type = ? AND item_id IN ?)",
+            ReportItemPost, postIDs, ReportItemComment, commentIDs).
+        Group("item_type, item_id, reason").
+        Scan(&reasons)
+
+    postsByID := map[uint]*Post{}
+    for i := range posts {
+        postsByID[posts[i].ID] = &posts[i]
+    }
+    commentsByID := map[uint]*Comment{}
+    for i := range comments {
+        commentsByID[comments[i].ID] = &comments[i]
+    }
+    reasonsByItem := map[string]map[string]int{}
+    for _, reason := range reasons {
+        key := fmt.Sprintf("%v:%v", reason.ItemType, reason.ItemID)
+        if reasonsByItem[key] == nil {
+            reasonsByItem[key] = map[string]int{}
+        }
+        reasonsByItem[key][reason.Reason] = reason.Count
+    }
+
+    queue := []ModerationQueueItem{}
+    for _, row := range rows {
+        item := ModerationQueueItem{
+            ItemType:        row.ItemType,
+            ItemID:          row.ItemID,
+            ReportCount:     row.ReportCount,
+            Reasons:         reasonsByItem[fmt.Sprintf("%v:%v", row.ItemType, row.ItemID)],
+            FirstReportedAt: row.FirstReportedAt,
+            LastReportedAt:  row.LastReportedAt,
+        }
+        switch row.ItemType {
+        case ReportItemPost:
+            item.Post = postsByID[row.ItemID]
+        case ReportItemComment:
+            item.Comment = commentsByID[row.ItemID]
+        }
+
+        // Items deleted in the meantime by their authors are left out
+        if item.Post == nil && item.Comment == nil {
+            continue
+        }
+
+        queue = append(queue, item)
+    }
+
+    return sendPage(context, queue, next)
+}
+
+// listReports godoc
+// @Summary List Reports
+// @Tags moderation
+// @Produce json
+// @Param status query string false "Status"
+// @Param item_type query string false "Item type"
+// @Param item_id query int false "Item ID"
+// @Security ApiKeyAuth
+// @Success 200 {array} Report
+// @Failure 401
+// @Failure 403
+// @Router /moderation/reports [get]
+func listReports(context echo.Context) error {
+    var reports []Report
+
+    query := sqlClient
+    if status := context.QueryParam("status"); status != "" {
+        query = query.Where("status = ?", status)
+    }
+    if itemType := context.QueryParam("item_type"); itemType != "" {
+        query = query.Where("item_type = ?", itemType)
+    }
+    if itemID := context.QueryParam("item_id"); itemID != "" {
+        query = query.Where("item_id = ?", itemID)
+    }
+    query.Order("created_at desc").Find(&reports)
+
+    return context.JSON(http.StatusOK, reports)
+}
+
+// moderatePost godoc
+// @Summary Act on Reported Post
+// @Description Dismissing the reports makes the post visible again, in case it has been hidden by them.
+// @Tags moderation
+// @Accept json
+// @Param id path int true "ID"
+// @Param action body ModerationIn true "Action"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /moderation/posts/{id} [post]
+func moderatePost(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    post, err := getPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    moderationIn, bindErr := bindModerationIn(context)
+    if moderationIn == nil {
+        return bindErr
+    }
+
+    if countOpenReports(ReportItemPost, post.ID) == 0 {
+        return context.JSON(http.StatusNotFound, "There are no open reports of this post.")
+    }
+
+    switch moderationIn.Action {
+    case ModerationDismiss:
+        dismissReportHiding(post)
+    case ModerationHide:
+        if !canHidePost(user, post) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        if post.HiddenAt == nil || post.HiddenByReports {
+            hideByModerator(post, post.HiddenAt)
+        }
+    case ModerationDelete:
+        if !canDeletePost(user, post) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        if err := trashPost(user, post); err != nil {
+            return err
+        }
+    case ModerationWarn:
+        warnAuthor(context, post.Author, ReportItemPost, moderationIn.Note)
+    }
+
+    resolveReports(context, ReportItemPost, post.ID, moderationIn)
+    emitAudit(context, AuditModeration+moderationIn.Action, postTarget(post))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// moderateComment godoc
+// @Summary Act on Reported Comment
+// @Description Dismissing the reports makes the comment visible again, in case it has been hidden by them.
+// @Tags moderation
+// @Accept json
+// @Param id path int true "ID"
+// @Param action body ModerationIn true "Action"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /moderation/comments/{id} [post]
+func moderateComment(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    comment, err := getCommentOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    moderationIn, bindErr := bindModerationIn(context)
+    if moderationIn == nil {
+        return bindErr
+    }
+
+    if countOpenReports(ReportItemComment, comment.ID) == 0 {
+        return context.JSON(http.StatusNotFound, "There are no open reports of this comment.")
+    }
+
+    switch moderationIn.Action {
+    case ModerationDismiss:
+        dismissReportHiding(comment)
+    case ModerationHide:
+        if !canHideComment(user, comment) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        if comment.HiddenAt == nil || comment.HiddenByReports {
+            hideByModerator(comment, comment.HiddenAt)
+        }
+    case ModerationDelete:
+        if !canDeleteComment(user, comment) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        if err := trashComment(user, comment); err != nil {
+            return err
+        }
+    case ModerationWarn:
+        warnAuthor(context, comment.Author, ReportItemComment, moderationIn.Note)
+    }
+
+    resolveReports(context, ReportItemComment, comment.ID, moderationIn)
+    emitAudit(context, AuditModeration+moderationIn.Action, commentTarget(comment))
+
+    return context.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+type (
+    // PostRevision is the title and the content of the post as saved by one of its edits. Revisions are numbered from
+    // 1 within the post.
+    PostRevision struct {
+        ID        uint      `json:"id" gorm:"primarykey"`
+        CreatedAt time.Time `json:"created_at"`
+        PostID    uint      `json:"post_id" gorm:"uniqueIndex:idx_post_revisions_number"`
+        Number    int       `json:"number" gorm:"uniqueIndex:idx_post_revisions_number"`
+        EditorID  uint      `json:"editor_id"`
+        Editor    User      `json:"editor"`
+        Title     string    `json:"title" gorm:"size:255"`
+        Content   string    `json:"content"`
+    }
+)
+
+// text renders the revision as compared by the diffs, the title being the first line.
+func (revision *PostRevision) text() string {
+    return revision.Title + "\n\n" + revision.Content
+}
+
+// saveRevision records the current title and content of the post as its next revision. The post is locked, so that
+// concurrent edits get consecutive numbers.
+func saveRevision(post *Post, editor User, createdAt time.Time) {
+    _ = sqlClient.Transaction(func(tx *gorm.DB) error {
+        var number int
+
+        tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&Post{}, post.ID)
+        tx.Model(&PostRevision{}).Where("post_id = ?", post.ID).Select("COALESCE(MAX(number), 0)").Scan(&number)
+
+        revision := new(PostRevision)
+        revision.CreatedAt = createdAt
+        revision.PostID = post.ID
+        revision.Number = number + 1
+        revision.EditorID = editor.ID
+        revision.Title = post.Title
+        revision.Content = post.Content
+        return tx.Omit("Editor").Create(&revision).Error
+    })
+}
+
+// startRevisionHistory records the post as its first revision, in case it was written before the revisions were
+// kept, so that its original text is not lost with the edit.
+func startRevisionHistory(post *Post) {
+    var count int64
+
+    sqlClient.Model(&PostRevision{}).Where("post_id = ?", post.ID).Count(&count)
+    if count == 0 {
+        saveRevision(post, post.Author, post.UpdatedAt)
+    }
+}
+
+func getPostRevisionOrError(post *Post, number string) (*PostRevision, int) {
+    var revision PostRevision
+
+    rev, err := strconv.Atoi(number)
+    if err != nil {
+        return nil, http.StatusBadRequest
+    }
+
+    result := sqlClient.
+        Where("post_id = ? AND number = ?", post.ID, rev).
+        Preload("Editor", withDeletedAuthors).
+        First(&revision)
+    if result.Error != nil {
+        return nil, http.StatusNotFound
+    }
+
+    return &revision, 0
+}
+
+// getRevisedPostOrError fetches the post whose revisions are requested. They are available to the users allowed to
+// edit the post, as they may hold text removed from it on purpose.
+func getRevisedPostOrError(context echo.Context) (*Post, int) {
+    post, err := getPostOrError(context)
+    if err != 0 {
+        return nil, err
+    }
+
+    if !canUpdatePost(context.Get("User").(User), post) {
+        return nil, http.StatusForbidden
+    }
+
+    return post, 0
+}
+
+// listPostRevisions godoc
+// @Summary List Post Revisions
+// @Tags revisions
+// @Produce json
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 200 {array} PostRevision
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/revisions [get]
+func listPostRevisions(context echo.Context) error {
+    var revisions []PostRevision
+
+    post, err := getRevisedPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    sqlClient.Where("post_id = ?", post.ID).Order("number desc").Preload("Editor", withDeletedAuthors).Find(&revisions)
+
+    return context.JSON(http.StatusOK, revisions)
+}
+
+// retrievePostRevision godoc
+// @Summary Retrieve Post Revision
+// @Tags revisions
+// @Produce json
+// @Param id path int true "ID"
+// @Param rev path int true "Revision number"
+// @Security ApiKeyAuth
+// @Success 200 {object} PostRevision
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/revisions/{rev} [get]
+func retrievePostRevision(context echo.Context) error {
+    post, err := getRevisedPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    revision, err := getPostRevisionOrError(post, context.Param("rev"))
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    return context.JSON(http.StatusOK, revision)
+}
+
+// diffPostRevision godoc
+// @Summary Diff Post Revisions
+// @Description Shows the changes made by the revision, or since the revision given in from, as a unified diff. The
+// @Description title is the first line of the compared text.
+// @Tags revisions
+// @Produce plain
+// @Param id path int true "ID"
+// @Param rev path int true "Revision number"
+// @Param from query int false "Revision number to compare with, the previous one by default"
+// @Security ApiKeyAuth
+// @Success 200 {string} string
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/revisions/{rev}/diff [get]
+func diffPostRevision(context echo.Context) error {
+    post, err := getRevisedPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    revision, err := getPostRevisionOrError(post, context.Param("rev"))
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    // The first revision is compared with an empty text
+    fromName, fromText := "/dev/null", ""
+    number := context.QueryParam("from")
+    if number == "" && revision.Number > 1 {
+        number = strconv.Itoa(revision.Number - 1)
+    }
+    if number != "" {
+        from, err := getPostRevisionOrError(post, number)
+        if err != 0 {
+            return context.NoContent(err)
+        }
+        fromName, fromText = fmt.Sprintf("revision %v", from.Number), from.text()
+    }
+    diff := unifiedDiff(fromName, fmt.Sprintf("revision %v", revision.Number), fromText, revision.text())
+
+    return context.String(http.StatusOK, diff)
+}
+
+// restorePostRevision godoc
+// @Summary Restore Post Revision
+// @Description Sets the title and the content of the post back to the revision, which is recorded as a new revision.
+// @Tags revisions
+// @Produce json
+// @Param id path int true "ID"
+// @Param rev path int true "Revision number"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 409
+// @Failure 412
+// @Router /posts/{id}/revisions/{rev}/restore [post]
+func restorePostRevision(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    post, err := getRevisedPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    revision, err := getPostRevisionOrError(post, context.Param("rev"))
+    if err != 0 {
+        return context.NoContent(err)
+    }
+    if !ifMatch(context, etag(post.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
+    updatedAt := post.UpdatedAt
+    post.Title = revision.Title
+    post.Content = revision.Content
+
+    // The post is written only if nobody has changed it since it has been read
+    result := sqlClient.Select("*").Where("updated_at = ?", updatedAt).Save(post)
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return context.JSON(http.StatusConflict, "The post has been changed in the meantime.")
+    }
+    if err := assignSlug(post); err != nil {
+        return err
+    }
+    saveRevision(post, user, post.UpdatedAt)
+    emitAudit(context, AuditPostRevert, postTarget(post))
+    setETag(context, etag(post.UpdatedAt))
+
+    return context.JSON(http.StatusOK, post)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm/clause"
+    "net/http"
+    "regexp"
+    "strings"
+)
+
+var slugSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+type (
+    Tag struct {
+        ID   uint   `json:"id" gorm:"primarykey"`
+        Name string `json:"name" gorm:"size:64"`
+        // Normalized name identifying the tag
+        Slug string `json:"slug" gorm:"uniqueIndex;size:64"`
+    }
+
+    TagUsage struct {
+        Tag
+        // Number of the published posts with the tag
+        PostCount int64 `json:"post_count"`
+    }
+)
+
+// slugify normalizes the name of a tag to lowercase letters and digits separated by single hyphens.
+func slugify(name string) string {
+    return strings.Trim(slugSeparators.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// newTags returns the tags of the given names, merging the ones normalized to the same slug. It returns a message
+// explaining why a name can not be a tag, or an empty string.
+func newTags(names []string) ([]Tag, string) {
+    tags := []Tag{}
+    slugs := map[string]bool{}
+
+    for _, name := range names {
+        tag := Tag{Name: strings.TrimSpace(name), Slug: slugify(name)}
+        if tag.Slug == "" {
+            return nil, "Provided tag is invalid."
+        }
+        if !slugs[tag.Slug] {
+            slugs[tag.Slug] = true
+            tags = append(tags, tag)
+        }
+    }
+
+    return tags, ""
+}
+
+// saveTags replaces the tags with the stored ones of the same slugs, creating the missing ones. An existing tag keeps
+// the name it has been created with.
+func saveTags(tags []Tag) error {
+    for i := range tags {
+        var stored Tag
+
+        // The tag may be created by somebody else at the same time, so it is read back whoever has created it
+        err := sqlClient.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags[i]).Error
+        if err != nil {
+            return err
+        }
+        err = sqlClient.Where("slug = ?", tags[i].Slug).First(&stored).Error
+        if err != nil {
+            return err
+        }
+        tags[i] = stored
+    }
+
+    return nil
+}
+
+// tagNames returns the names of the tags of the post.
+func (post *Post) tagNames() []string {
+    names := []string{}
+    for _, tag := range post.Tags {
+        names = append(names, tag.Name)
+    }
+
+    return names
+}
+
+// listTags godoc
+// @Summary List Tags
+// @Description Lists the tags of the published posts along with the number of the posts, from the most used.
+// @Tags tags
+// @Produce json
+// @Success 200 {array} TagUsage
+// @Router /tags [get]
+func listTags(context echo.Context) error {
+    tags := []TagUsage{}
+
+    sqlClient.Model(&Tag{}).
+        Select("tags.id, tags.name, tags.slug, COUNT(*) AS post_count").
+        Joins("JOIN post_tags ON post_tags.tag_id = tags.id").
+        Joins("JOIN posts ON posts.id = post_tags.post_id").
+        Where("posts.deleted_at IS NULL AND posts.hidden_at IS NULL AND posts.status = ?", PostPublished).
+        Group("tags.id, tags.name, tags.slug").
+        Order("post_count desc, tags.slug").
+        Scan(&tags)
+
+    return context.JSON(http.StatusOK, tags)
+}
+
+// listTagPosts godoc
+// @Summary List Tag Posts
+// @Description Lists the posts with the tag, the same way as all the posts are listed.
+// @Tags tags
+// @Produce json
+// @Param slug path string true "Slug"
+// @Param author_id query string false "Author IDs, comma-separated"
+// @Param title_prefix query string false "Beginning of the title"
+// @Param created_after query string false "Created after, in RFC 3339"
+// @Param created_before query string false "Created before, in RFC 3339"
+// @Param updated_after query string false "Updated after, in RFC 3339"
+// @Param sort query string false "created_at, updated_at or title, prefixed with a minus for the descending order"
+// @Param limit query int false "Number of posts on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]Post}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
+// @Failure 404
+// @Router /tags/{slug}/posts [get]
+func listTagPosts(context echo.Context) error {
+    var tag Tag
+
+    result := sqlClient.Where("slug = ?", slugify(context.Param("slug"))).First(&tag)
+    if result.Error != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    taggedPosts := sqlClient.Table("post_tags").Select("post_id").Where("tag_id = ?", tag.ID)
+    return listMatchingPosts(context, sqlClient.Where("id IN (?)", taggedPosts))
+}
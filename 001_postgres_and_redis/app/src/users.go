@@ -1,23 +1,47 @@
 package main
 
 import (
+    "fmt"
     "github.com/labstack/echo/v4"
     "gorm.io/gorm"
     "net/http"
+    "os"
     "strconv"
     "strings"
     "time"
 )
 
+const (
+    DeletedUserContentKeep      = "keep"
+    DeletedUserContentAnonymize = "anonymize"
+    DeletedUserContentCascade   = "cascade"
+
+    // Name shown in place of the author whose account has been deleted
+    DeletedUserName = "deleted user"
+)
+
+var (
+    // What happens to the posts and comments of a deleted account
+    deletedUserContentPolicy string
+)
+
 type (
     User struct {
-        ID           uint           `json:"id" gorm:"primarykey"`
-        CreatedAt    time.Time      `json:"created_at"`
-        UpdatedAt    time.Time      `json:"updated_at"`
-        DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
-        Name         string         `json:"name" gorm:"uniqueIndex;size:255"`
-        PasswordHash string         `json:"-" gorm:"size:255"`
-        Email        string         `json:"email" gorm:"uniqueIndex;size:255"`
+        ID               uint           `json:"id" gorm:"primarykey"`
+        CreatedAt        time.Time      `json:"created_at" gorm:"index"`
+        UpdatedAt        time.Time      `json:"updated_at"`
+        DeletedAt        gorm.DeletedAt `json:"-" gorm:"index"`
+        Name             string         `json:"name" gorm:"uniqueIndex;size:255"`
+        PasswordHash     string         `json:"-" gorm:"size:255"`
+        Email            string         `json:"email" gorm:"uniqueIndex;size:255"`
+        EmailVerifiedAt  *time.Time     `json:"email_verified_at"`
+        PendingEmail     string         `json:"pending_email,omitempty" gorm:"size:255"`
+        TotpSecret       string         `json:"-" gorm:"size:64"`
+        TotpEnabled      bool           `json:"totp_enabled"`
+        Role             string         `json:"role" gorm:"size:16;default:user"`
+        SuspendedAt      *time.Time     `json:"-"`
+        SuspendedUntil   *time.Time     `json:"-"`
+        SuspensionReason string         `json:"-" gorm:"size:255"`
     }
 
     UserNew struct {
@@ -32,6 +56,41 @@ type (
     }
 )
 
+func setupUsers() {
+    deletedUserContentPolicy = os.Getenv("DELETED_USER_CONTENT_POLICY")
+    if deletedUserContentPolicy == "" {
+        deletedUserContentPolicy = DeletedUserContentKeep
+    }
+    if deletedUserContentPolicy != DeletedUserContentKeep &&
+        deletedUserContentPolicy != DeletedUserContentAnonymize &&
+        deletedUserContentPolicy != DeletedUserContentCascade {
+        panic("Unknown deleted user content policy.")
+    }
+}
+
+// withDeletedAuthors is a preload condition loading also the authors whose accounts have been deleted, so that their
+// content is not shown without an author. Their name is replaced with a placeholder and their email is left out.
+func withDeletedAuthors(db *gorm.DB) *gorm.DB {
+    return db.Unscoped().Select(
+        "id, created_at, updated_at, deleted_at, role, totp_enabled, "+
+            "CASE WHEN deleted_at IS NULL THEN name ELSE ? END AS name, "+
+            "CASE WHEN deleted_at IS NULL THEN email ELSE '' END AS email",
+        DeletedUserName,
+    )
+}
+
+// anonymizeUser removes the personal data from the deleted account, which stays behind only as the author of its
+// content. The name and email are made unique, so that they can be taken by somebody else.
+func anonymizeUser(user User) {
+    sqlClient.Unscoped().Model(&user).UpdateColumns(map[string]interface{}{
+        "name":          fmt.Sprintf("deleted-%v", user.ID),
+        "email":         fmt.Sprintf("deleted-%v@invalid", user.ID),
+        "pending_email": "",
+        "password_hash": "",
+        "totp_secret":   "",
+    })
+}
+
 func getUserOrError(context echo.Context) (*User, int) {
     var user User
 
@@ -54,10 +113,20 @@ func getUserOrError(context echo.Context) (*User, int) {
 // @Produce json
 // @Param name query string false "Name"
 // @Param email query string false "Email"
-// @Success 200 {array} User
+// @Param limit query int false "Number of users on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Success 200 {object} Page{items=[]User}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
 // @Router /users [get]
 func listUserAccounts(context echo.Context) error {
     var users []User
+    var next *pageCursor
+
+    page, err := getPageQuery(context, "created_at")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
 
     query := sqlClient
     if name := context.QueryParam("name"); name != "" {
@@ -66,9 +135,14 @@ func listUserAccounts(context echo.Context) error {
     if email := context.QueryParam("email"); email != "" {
         query = query.Where("email = ?", email)
     }
-    query.Find(&users)
+    page.apply(query).Find(&users)
 
-    return context.JSON(http.StatusOK, users)
+    if len(users) > page.Limit {
+        users = users[:page.Limit]
+        next = page.cursorAt(sortKeys{CreatedAt: users[page.Limit-1].CreatedAt}, users[page.Limit-1].ID)
+    }
+
+    return sendPage(context, users, next)
 }
 
 // createUserAccount godoc
@@ -99,12 +173,15 @@ func createUserAccount(context echo.Context) error {
     user.Name = userNew.Name
     user.PasswordHash = hashedPassword
     user.Email = userNew.Email
+    user.Role = RoleUser
 
     result := sqlClient.Create(&user)
     if result.Error != nil {
         return context.JSON(http.StatusBadRequest, "User with provided name already exists.")
     }
 
+    sendEmailVerification(context, *user, user.Email)
+
     return context.JSON(http.StatusCreated, user)
 }
 
@@ -113,7 +190,10 @@ func createUserAccount(context echo.Context) error {
 // @Tags users
 // @Produce json
 // @Param id path int true "ID"
+// @Param If-None-Match header string false "ETag of the cached version"
 // @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 304
 // @Failure 400
 // @Failure 404
 // @Router /users/{id} [get]
@@ -122,10 +202,26 @@ func retrieveUserAccount(context echo.Context) error {
     if err != 0 {
         return context.NoContent(err)
     }
+    if notModified(context, etag(user.UpdatedAt)) {
+        return context.NoContent(http.StatusNotModified)
+    }
 
     return context.JSON(http.StatusOK, user)
 }
 
+// retrieveCurrentUserAccount godoc
+// @Summary Retrieve Current User Account
+// @Tags users
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} User
+// @Failure 401
+// @Failure 403
+// @Router /users/me [get]
+func retrieveCurrentUserAccount(context echo.Context) error {
+    return context.JSON(http.StatusOK, context.Get("User").(User))
+}
+
 // updateUserAccount godoc
 // @Summary Update Current User Account
 // @Tags users
@@ -133,30 +229,113 @@ func retrieveUserAccount(context echo.Context) error {
 // @Produce json
 // @Security ApiKeyAuth
 // @Param user body UserUpdate true "User"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the resource"
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /users [put]
 func updateUserAccount(context echo.Context) error {
+    return editUserAccount(context, false)
+}
+
+// patchUserAccount godoc
+// @Summary Patch Current User Account
+// @Description Changes only the fields present in the JSON merge patch (RFC 7396), so that the password does not have
+// @Description to be sent to change the email.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user body UserUpdate true "User"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 412
+// @Router /users [patch]
+func patchUserAccount(context echo.Context) error {
+    return editUserAccount(context, true)
+}
+
+// editUserAccount replaces the password and the email of the current user with the ones in the request, or with the
+// merge patch sent with PATCH applied to them.
+func editUserAccount(context echo.Context, patch bool) error {
+    var user User
+
+    // The cached copy of the user may be outdated, so it is not written back as it is
+    result := sqlClient.First(&user, context.Get("User").(User).ID)
+    if result.Error != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+    if !ifMatch(context, etag(user.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
     userUpdate := new(UserUpdate)
-    if err := context.Bind(userUpdate); err != nil {
-        return err
+    if patch {
+        // The password is changed only if it is present in the patch, and an email waiting for verification stays
+        userUpdate.Email = user.Email
+        if user.PendingEmail != "" {
+            userUpdate.Email = user.PendingEmail
+        }
+        if err := bindMergePatch(context, userUpdate); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
+    } else {
+        if err := context.Bind(userUpdate); err != nil {
+            return err
+        }
+        if err := context.Validate(userUpdate); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
     }
-    if err := context.Validate(userUpdate); err != nil {
-        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+
+    // A new email address replaces the current one only once it is verified
+    emailChanged := userUpdate.Email != user.Email && userUpdate.Email != user.PendingEmail
+    if userUpdate.Email != user.Email {
+        var count int64
+        sqlClient.Model(&User{}).Where("email = ?", userUpdate.Email).Count(&count)
+        if count > 0 {
+            return context.JSON(http.StatusBadRequest, "User with provided email already exists.")
+        }
+        user.PendingEmail = userUpdate.Email
+    } else {
+        user.PendingEmail = ""
     }
 
-    hashedPassword, err := hashAndSalt(userUpdate.Password)
-    if err != nil {
-        return err
+    updatedAt := user.UpdatedAt
+    if userUpdate.Password != "" {
+        hashedPassword, err := hashAndSalt(userUpdate.Password)
+        if err != nil {
+            return err
+        }
+        user.PasswordHash = hashedPassword
     }
 
-    user := context.Get("User").(User)
-    user.PasswordHash = hashedPassword
-    user.Email = userUpdate.Email
-    sqlClient.Save(&user)
+    // The account is written only if nobody has changed it since it has been read
+    result = sqlClient.Select("*").Where("updated_at = ?", updatedAt).Save(&user)
+    if result.RowsAffected == 0 {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+    emitAudit(context, AuditUserUpdate, userTarget(user))
+
+    if emailChanged {
+        sendEmailVerification(context, user, user.PendingEmail)
+    }
+
+    // If the password has been replaced, all the other sessions are terminated, and the current one is refreshed
+    if userUpdate.Password != "" {
+        revokeUserSessions(user, context.Get("Session").(Session).ID)
+    }
+    updateUserSessions(user)
+    setETag(context, etag(user.UpdatedAt))
 
     return context.JSON(http.StatusOK, user)
 }
@@ -164,16 +343,41 @@ func updateUserAccount(context echo.Context) error {
 // deleteUserAccount godoc
 // @Summary Delete Current User Account
 // @Tags users
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 204
 // @Failure 401
+// @Failure 412
 // @Router /users [delete]
 func deleteUserAccount(context echo.Context) error {
+    var current User
+
     user := context.Get("User").(User)
 
+    // The cached copy of the user may be outdated, so the version is checked against the stored one
+    result := sqlClient.First(&current, user.ID)
+    if result.Error != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+    if !ifMatch(context, etag(current.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
     sqlClient.Delete(&user)
+    sqlClient.Where("user_id = ?", user.ID).Delete(&ApiKey{})
+
+    switch deletedUserContentPolicy {
+    case DeletedUserContentAnonymize:
+        anonymizeUser(user)
+    case DeletedUserContentCascade:
+        // The account is gone already, so the rest is done anyway and the content left behind is only logged
+        if err := trashUserContent(user); err != nil {
+            context.Logger().Error(err)
+        }
+    }
 
-    // TODO: Delete user sessions here or during session retrieval once upon a time
+    revokeUserSessions(user, "")
+    emitAudit(context, AuditUserDelete, userTarget(user))
 
     return context.NoContent(http.StatusNoContent)
 }
@@ -0,0 +1,403 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "net/http"
+    "strings"
+    "time"
+)
+
+type (
+    // Impersonation records an admin logging in as another user, so that it can be reviewed later.
+    Impersonation struct {
+        ID        uint      `json:"id" gorm:"primarykey"`
+        CreatedAt time.Time `json:"created_at"`
+        AdminID   uint      `json:"admin_id" gorm:"index"`
+        UserID    uint      `json:"user_id" gorm:"index"`
+        SessionID string    `json:"session_id" gorm:"size:32"`
+        Reason    string    `json:"reason" gorm:"size:255"`
+        ClientIP  string    `json:"client_ip" gorm:"size:64"`
+    }
+
+    UserRoleIn struct {
+        Role string `json:"role" validate:"required,oneof=user moderator admin"`
+    }
+
+    // UserSuspensionIn suspends the user for the duration, or bans them for good if it is left empty.
+    UserSuspensionIn struct {
+        Reason   string `json:"reason" validate:"required,min=3"`
+        Duration string `json:"duration"`
+    }
+
+    ImpersonationIn struct {
+        Reason string `json:"reason" validate:"required,min=3"`
+    }
+
+    // AdminUserOut is the user along with the fields not revealed to anybody but admins.
+    AdminUserOut struct {
+        User
+        SuspendedAt      *time.Time `json:"suspended_at"`
+        SuspendedUntil   *time.Time `json:"suspended_until"`
+        SuspensionReason string     `json:"suspension_reason"`
+        ActiveSessions   int        `json:"active_sessions"`
+    }
+
+    SuspensionOut struct {
+        Reason         string     `json:"reason"`
+        SuspendedUntil *time.Time `json:"suspended_until"`
+    }
+)
+
+// setupAdmin restores the suspension markers of the users suspended at the moment, in case Redis has lost them.
+func setupAdmin() {
+    var users []User
+
+    sqlClient.Where("suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > ?)", time.Now()).
+        Find(&users)
+    for _, user := range users {
+        markUserSuspended(user)
+    }
+}
+
+func suspendedUserKey(userID uint) string {
+    return fmt.Sprintf("suspended_user:%v", userID)
+}
+
+func (user *User) suspended() bool {
+    return user.SuspendedAt != nil && (user.SuspendedUntil == nil || user.SuspendedUntil.After(time.Now()))
+}
+
+func (user *User) adminOut(activeSessions int) AdminUserOut {
+    return AdminUserOut{
+        User:             *user,
+        SuspendedAt:      user.SuspendedAt,
+        SuspendedUntil:   user.SuspendedUntil,
+        SuspensionReason: user.SuspensionReason,
+        ActiveSessions:   activeSessions,
+    }
+}
+
+// markUserSuspended puts a marker in Redis, which lives as long as the suspension. The marker is checked on every
+// authenticated request, as the copies of the user cached in sessions and access tokens do not change on suspension.
+func markUserSuspended(user User) {
+    var expiration time.Duration
+
+    if user.SuspendedUntil != nil {
+        expiration = time.Until(*user.SuspendedUntil)
+        if expiration <= 0 {
+            return
+        }
+    }
+
+    err := redisClient.Set(redisCtx, suspendedUserKey(user.ID), user.SuspensionReason, expiration).Err()
+    if err != nil {
+        panic(err)
+    }
+}
+
+func respondWithSuspension(context echo.Context, user User) error {
+    return context.JSON(http.StatusForbidden, SuspensionOut{
+        Reason:         user.SuspensionReason,
+        SuspendedUntil: user.SuspendedUntil,
+    })
+}
+
+// requireAccountOwner is a middleware rejecting requests made within an impersonated session. It guards the endpoints
+// changing the account and its credentials, which the admin has no business of touching on behalf of the user.
+func requireAccountOwner(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if session, ok := context.Get("Session").(Session); ok && session.ImpersonatedBy != "" {
+            return context.JSON(http.StatusForbidden, "This endpoint can not be used while impersonating a user.")
+        }
+
+        return next(context)
+    }
+}
+
+// listAdminUsers godoc
+// @Summary List Users Accounts with Internal Fields
+// @Tags admin
+// @Produce json
+// @Param name query string false "Name"
+// @Param email query string false "Email"
+// @Param role query string false "Role"
+// @Param suspended query bool false "Suspended"
+// @Param limit query int false "Number of users on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]AdminUserOut}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /admin/users [get]
+func listAdminUsers(context echo.Context) error {
+    var users []User
+    var next *pageCursor
+
+    page, err := getPageQuery(context, "created_at")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
+    query := sqlClient
+    if name := context.QueryParam("name"); name != "" {
+        query = query.Where("name = ?", name)
+    }
+    if email := context.QueryParam("email"); email != "" {
+        query = query.Where("email = ?", email)
+    }
+    if role := context.QueryParam("role"); role != "" {
+        query = query.Where("role = ?", role)
+    }
+    if context.QueryParam("suspended") == "true" {
+        query = query.Where("suspended_at IS NOT NULL AND (suspended_until IS NULL OR suspended_until > ?)", time.Now())
+    }
+    page.apply(query).Find(&users)
+
+    if len(users) > page.Limit {
+        users = users[:page.Limit]
+        next = page.cursorAt(sortKeys{CreatedAt: users[page.Limit-1].CreatedAt}, users[page.Limit-1].ID)
+    }
+
+    usersOut := []AdminUserOut{}
+    for i, count := range countUserSessions(users) {
+        usersOut = append(usersOut, users[i].adminOut(count))
+    }
+
+    return sendPage(context, usersOut, next)
+}
+
+// updateUserRole godoc
+// @Summary Change Role of User Account
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param role body UserRoleIn true "Role"
+// @Security ApiKeyAuth
+// @Success 200 {object} User
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /admin/users/{id}/role [put]
+func updateUserRole(context echo.Context) error {
+    user, err := getUserOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    userRoleIn := new(UserRoleIn)
+    if err := context.Bind(userRoleIn); err != nil {
+        return err
+    }
+    if err := context.Validate(userRoleIn); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    // Otherwise the last admin could lock everybody out of the administration
+    if user.ID == context.Get("User").(User).ID {
+        return context.JSON(http.StatusBadRequest, "Own role can not be changed.")
+    }
+
+    user.Role = userRoleIn.Role
+    sqlClient.Model(user).Update("role", user.Role)
+    updateUserSessions(*user)
+    emitAudit(context, AuditRoleChange, userTarget(*user))
+
+    return context.JSON(http.StatusOK, user)
+}
+
+// suspendUser godoc
+// @Summary Suspend or Ban User Account
+// @Description The account is banned for good if the duration is left empty.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param suspension body UserSuspensionIn true "Suspension"
+// @Security ApiKeyAuth
+// @Success 200 {object} AdminUserOut
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /admin/users/{id}/suspension [put]
+func suspendUser(context echo.Context) error {
+    user, err := getUserOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    userSuspensionIn := new(UserSuspensionIn)
+    if err := context.Bind(userSuspensionIn); err != nil {
+        return err
+    }
+    if err := context.Validate(userSuspensionIn); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    // Admins have to be demoted first, so that they cannot lock each other out
+    if isAdmin(*user) {
+        return context.JSON(http.StatusBadRequest, "Admins can not be suspended.")
+    }
+
+    suspendedAt := time.Now()
+    user.SuspendedAt = &suspendedAt
+    user.SuspendedUntil = nil
+    user.SuspensionReason = userSuspensionIn.Reason
+
+    if userSuspensionIn.Duration != "" {
+        duration, err := time.ParseDuration(userSuspensionIn.Duration)
+        if err != nil || duration <= 0 {
+            return context.JSON(http.StatusBadRequest, "Provided duration is invalid.")
+        }
+        suspendedUntil := suspendedAt.Add(duration)
+        user.SuspendedUntil = &suspendedUntil
+    }
+
+    sqlClient.Model(user).Updates(map[string]interface{}{
+        "suspended_at":      user.SuspendedAt,
+        "suspended_until":   user.SuspendedUntil,
+        "suspension_reason": user.SuspensionReason,
+    })
+
+    markUserSuspended(*user)
+    revokeUserSessions(*user, "")
+    emitAudit(context, AuditSuspend, userTarget(*user))
+
+    return context.JSON(http.StatusOK, user.adminOut(len(getUserSessions(*user))))
+}
+
+// liftUserSuspension godoc
+// @Summary Lift Suspension or Ban of User Account
+// @Tags admin
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /admin/users/{id}/suspension [delete]
+func liftUserSuspension(context echo.Context) error {
+    user, err := getUserOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    sqlClient.Model(user).Updates(map[string]interface{}{
+        "suspended_at":      nil,
+        "suspended_until":   nil,
+        "suspension_reason": "",
+    })
+    redisClient.Del(redisCtx, suspendedUserKey(user.ID))
+    emitAudit(context, AuditLiftSuspension, userTarget(*user))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// revokeUserSessionsAsAdmin godoc
+// @Summary Revoke All Sessions of User Account
+// @Tags admin
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /admin/users/{id}/sessions [delete]
+func revokeUserSessionsAsAdmin(context echo.Context) error {
+    user, err := getUserOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    revokeUserSessions(*user, "")
+    emitAudit(context, AuditRevokeSessions, userTarget(*user))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// impersonateUser godoc
+// @Summary Impersonate User Account
+// @Description Issues a session of the user marked with the name of the admin. Every impersonation is recorded.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param impersonation body ImpersonationIn true "Impersonation"
+// @Security ApiKeyAuth
+// @Success 201 {object} TokenOut
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /admin/users/{id}/impersonate [post]
+func impersonateUser(context echo.Context) error {
+    admin := context.Get("User").(User)
+
+    user, err := getUserOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    impersonationIn := new(ImpersonationIn)
+    if err := context.Bind(impersonationIn); err != nil {
+        return err
+    }
+    if err := context.Validate(impersonationIn); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    if isAdmin(*user) {
+        return context.JSON(http.StatusBadRequest, "Admins can not be impersonated.")
+    }
+    if user.suspended() {
+        return respondWithSuspension(context, *user)
+    }
+
+    session := newSession(context, *user)
+    session.ImpersonatedBy = admin.Name
+    token := storeSession(session)
+
+    impersonation := new(Impersonation)
+    impersonation.AdminID = admin.ID
+    impersonation.UserID = user.ID
+    impersonation.SessionID = session.ID
+    impersonation.Reason = impersonationIn.Reason
+    impersonation.ClientIP = context.RealIP()
+    sqlClient.Create(&impersonation)
+    emitAudit(context, AuditImpersonate, userTarget(*user))
+
+    return respondWithTokens(context, token, session)
+}
+
+// listImpersonations godoc
+// @Summary List Impersonations
+// @Tags admin
+// @Produce json
+// @Param admin_id query int false "Admin ID"
+// @Param user_id query int false "User ID"
+// @Security ApiKeyAuth
+// @Success 200 {array} Impersonation
+// @Failure 401
+// @Failure 403
+// @Router /admin/impersonations [get]
+func listImpersonations(context echo.Context) error {
+    var impersonations []Impersonation
+
+    query := sqlClient
+    if adminID := context.QueryParam("admin_id"); adminID != "" {
+        query = query.Where("admin_id = ?", adminID)
+    }
+    if userID := context.QueryParam("user_id"); userID != "" {
+        query = query.Where("user_id = ?", userID)
+    }
+    query.Order("created_at desc").Find(&impersonations)
+
+    return context.JSON(http.StatusOK, impersonations)
+}
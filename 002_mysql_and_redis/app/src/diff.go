@@ -0,0 +1,159 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    // Number of unchanged lines shown around every change
+    diffContext = 3
+    // Size of the largest table computed for the longest common subsequence, past which the texts are shown as
+    // replaced as a whole
+    diffMaxCells = 4 * 1000 * 1000
+)
+
+type (
+    diffLine struct {
+        op   byte
+        text string
+        // Number of the lines of both texts preceding this one
+        fromLine int
+        toLine   int
+    }
+)
+
+// diffLines lines up the two texts along their longest common subsequence of lines.
+func diffLines(from []string, to []string) []diffLine {
+    var lines []diffLine
+
+    n, m := len(from), len(to)
+    i, j := 0, 0
+    add := func(op byte, text string) {
+        lines = append(lines, diffLine{op: op, text: text, fromLine: i, toLine: j})
+    }
+
+    if n*m <= diffMaxCells {
+        lcs := make([][]int32, n+1)
+        for k := range lcs {
+            lcs[k] = make([]int32, m+1)
+        }
+        for k := n - 1; k >= 0; k-- {
+            for l := m - 1; l >= 0; l-- {
+                if from[k] == to[l] {
+                    lcs[k][l] = lcs[k+1][l+1] + 1
+                } else if lcs[k+1][l] >= lcs[k][l+1] {
+                    lcs[k][l] = lcs[k+1][l]
+                } else {
+                    lcs[k][l] = lcs[k][l+1]
+                }
+            }
+        }
+
+        for i < n && j < m {
+            if from[i] == to[j] {
+                add(' ', from[i])
+                i++
+                j++
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                add('-', from[i])
+                i++
+            } else {
+                add('+', to[j])
+                j++
+            }
+        }
+    }
+
+    for ; i < n; i++ {
+        add('-', from[i])
+    }
+    for ; j < m; j++ {
+        add('+', to[j])
+    }
+
+    return lines
+}
+
+// splitLines splits the text into lines, not counting the line break ending the text as the start of another one.
+func splitLines(text string) []string {
+    if text == "" {
+        return nil
+    }
+    return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// unifiedDiff describes the changes between the texts in the unified format, as shown by diff -u.
+func unifiedDiff(fromName string, toName string, from string, to string) string {
+    var out strings.Builder
+
+    lines := diffLines(splitLines(from), splitLines(to))
+    fmt.Fprintf(&out, "--- %v\n+++ %v\n", fromName, toName)
+
+    for i := 0; i < len(lines); {
+        for i < len(lines) && lines[i].op == ' ' {
+            i++
+        }
+        if i == len(lines) {
+            break
+        }
+
+        // A hunk takes in the following changes as long as they are close enough for their context to overlap
+        start := i - diffContext
+        if start < 0 {
+            start = 0
+        }
+        end := i
+        for {
+            for end < len(lines) && lines[end].op != ' ' {
+                end++
+            }
+            next := end
+            for next < len(lines) && lines[next].op == ' ' {
+                next++
+            }
+            if next < len(lines) && next-end <= 2*diffContext {
+                end = next
+                continue
+            }
+            end += diffContext
+            if end > len(lines) {
+                end = len(lines)
+            }
+            break
+        }
+
+        fromCount, toCount := 0, 0
+        for _, line := range lines[start:end] {
+            if line.op != '+' {
+                fromCount++
+            }
+            if line.op != '-' {
+                toCount++
+            }
+        }
+        fmt.Fprintf(&out, "@@ -%v +%v @@\n",
+            hunkRange(lines[start].fromLine, fromCount), hunkRange(lines[start].toLine, toCount))
+        for _, line := range lines[start:end] {
+            out.WriteByte(line.op)
+            out.WriteString(line.text)
+            out.WriteByte('\n')
+        }
+
+        i = end
+    }
+
+    return out.String()
+}
+
+// hunkRange formats the lines of a hunk, which start after the given number of lines. An empty range points at the
+// line preceding it.
+func hunkRange(preceding int, count int) string {
+    if count == 0 {
+        return fmt.Sprintf("%v,0", preceding)
+    }
+    if count == 1 {
+        return fmt.Sprintf("%v", preceding+1)
+    }
+    return fmt.Sprintf("%v,%v", preceding+1, count)
+}
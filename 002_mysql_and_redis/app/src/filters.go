@@ -0,0 +1,56 @@
+package main
+
+import (
+    "errors"
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Conditions of the filters by time, whose values are given in RFC 3339
+var timeFilters = map[string]string{
+    "created_after":  "created_at > ?",
+    "created_before": "created_at < ?",
+    "updated_after":  "updated_at > ?",
+}
+
+// filterByTime narrows the listing down to the items created or updated within the requested times.
+func filterByTime(context echo.Context, query *gorm.DB) (*gorm.DB, error) {
+    for param, condition := range timeFilters {
+        if value := context.QueryParam(param); value != "" {
+            t, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return nil, errors.New("Provided " + param + " time is invalid.")
+            }
+            query = query.Where(condition, t)
+        }
+    }
+
+    return query, nil
+}
+
+// getIDsParam reads the IDs given in the parameter, either as a comma-separated list or by repeating the parameter.
+func getIDsParam(context echo.Context, param string) ([]uint, error) {
+    var ids []uint
+
+    for _, value := range context.QueryParams()[param] {
+        for _, part := range strings.Split(value, ",") {
+            id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+            if err != nil {
+                return nil, errors.New("Provided " + param + " is invalid.")
+            }
+            ids = append(ids, uint(id))
+        }
+    }
+
+    return ids, nil
+}
+
+// likePrefix returns the LIKE pattern matching the values starting with the prefix. The wildcards in the prefix are
+// escaped, so that they are matched literally.
+func likePrefix(prefix string) string {
+    replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+    return replacer.Replace(prefix) + "%"
+}
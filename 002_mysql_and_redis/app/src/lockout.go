@@ -0,0 +1,120 @@
+package main
+
+import (
+    "github.com/go-redis/redis/v8"
+    "github.com/labstack/echo/v4"
+    "github.com/prometheus/client_golang/prometheus"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+var (
+    loginMaxAttempts      int
+    loginMaxAttemptsPerIP int
+    loginFailureWindow    time.Duration
+    loginLockoutBase      time.Duration
+    loginLockoutMax       time.Duration
+
+    loginLockoutsCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name: "auth_login_lockouts_total",
+            Help: "Number of login attempts rejected because of a lockout of the account or the client IP.",
+        },
+        []string{"scope"},
+    )
+)
+
+func setupLoginLockout() {
+    loginMaxAttempts = getEnvInt("LOGIN_MAX_ATTEMPTS", 5)
+    loginMaxAttemptsPerIP = getEnvInt("LOGIN_MAX_ATTEMPTS_PER_IP", 20)
+    loginFailureWindow = getEnvDuration("LOGIN_FAILURE_WINDOW", 1 * time.Hour)
+    loginLockoutBase = getEnvDuration("LOGIN_LOCKOUT_BASE", 1 * time.Minute)
+    loginLockoutMax = getEnvDuration("LOGIN_LOCKOUT_MAX", 1 * time.Hour)
+
+    prometheus.MustRegister(loginLockoutsCounter)
+}
+
+func loginFailuresKey(scope string, value string) string {
+    return "login_failures:" + scope + ":" + value
+}
+
+func loginLockoutKey(scope string, value string) string {
+    return "login_lockout:" + scope + ":" + value
+}
+
+// lockoutDuration doubles the lockout with every failure above the limit, up to the configured maximum.
+func lockoutDuration(failures int64, limit int) time.Duration {
+    exponent := float64(failures - int64(limit))
+    duration := time.Duration(float64(loginLockoutBase) * math.Pow(2, exponent))
+    if duration <= 0 || duration > loginLockoutMax {
+        return loginLockoutMax
+    }
+    return duration
+}
+
+// checkLoginLockout reports whether logging in to the account or from the client IP is locked out at the moment and
+// for how long.
+func checkLoginLockout(context echo.Context, name string) (time.Duration, bool) {
+    var accountTTL, ipTTL *redis.DurationCmd
+
+    _, err := redisClient.Pipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        accountTTL = pipe.TTL(redisCtx, loginLockoutKey("account", name))
+        ipTTL = pipe.TTL(redisCtx, loginLockoutKey("ip", context.RealIP()))
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    if accountTTL.Val() > 0 && accountTTL.Val() >= ipTTL.Val() {
+        loginLockoutsCounter.WithLabelValues("account").Inc()
+        return accountTTL.Val(), true
+    }
+    if ipTTL.Val() > 0 {
+        loginLockoutsCounter.WithLabelValues("ip").Inc()
+        return ipTTL.Val(), true
+    }
+
+    return 0, false
+}
+
+func registerLoginFailure(context echo.Context, name string) {
+    var accountFailures, ipFailures *redis.IntCmd
+
+    accountKey := loginFailuresKey("account", name)
+    ipKey := loginFailuresKey("ip", context.RealIP())
+
+    _, err := redisClient.TxPipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        accountFailures = pipe.Incr(redisCtx, accountKey)
+        pipe.Expire(redisCtx, accountKey, loginFailureWindow)
+        ipFailures = pipe.Incr(redisCtx, ipKey)
+        pipe.Expire(redisCtx, ipKey, loginFailureWindow)
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    if accountFailures.Val() >= int64(loginMaxAttempts) {
+        duration := lockoutDuration(accountFailures.Val(), loginMaxAttempts)
+        redisClient.Set(redisCtx, loginLockoutKey("account", name), accountFailures.Val(), duration)
+    }
+    if ipFailures.Val() >= int64(loginMaxAttemptsPerIP) {
+        duration := lockoutDuration(ipFailures.Val(), loginMaxAttemptsPerIP)
+        redisClient.Set(redisCtx, loginLockoutKey("ip", context.RealIP()), ipFailures.Val(), duration)
+    }
+}
+
+// clearLoginFailures forgets the failures of the account after a successful login. The failures of the client IP are
+// kept, so a single valid account cannot be used to reset them.
+func clearLoginFailures(name string) {
+    redisClient.Del(redisCtx, loginFailuresKey("account", name), loginLockoutKey("account", name))
+}
+
+func respondWithLockout(context echo.Context, retryAfter time.Duration) error {
+    seconds := int(math.Ceil(retryAfter.Seconds()))
+    context.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+    return context.NoContent(http.StatusTooManyRequests)
+}
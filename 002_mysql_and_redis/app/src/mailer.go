@@ -0,0 +1,90 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/smtp"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+type (
+    Mailer interface {
+        Send(to string, subject string, body string) error
+    }
+
+    // SMTPMailer delivers messages through an SMTP relay.
+    SMTPMailer struct {
+        addr string
+        auth smtp.Auth
+        from string
+    }
+
+    // LogMailer writes messages to a file, or to the standard output, instead of delivering them. It is meant for local
+    // development and testing.
+    LogMailer struct {
+        path  string
+        mutex sync.Mutex
+    }
+)
+
+var (
+    mailer     Mailer
+    appBaseURL string
+)
+
+func setupMailer() {
+    appBaseURL = strings.TrimRight(os.Getenv("APP_BASE_URL"), "/")
+    if appBaseURL == "" {
+        appBaseURL = "http://127.0.0.1:1323"
+    }
+
+    switch os.Getenv("MAILER") {
+    case "smtp":
+        host := os.Getenv("SMTP_HOST")
+        port := os.Getenv("SMTP_PORT")
+        username := os.Getenv("SMTP_USERNAME")
+        password := os.Getenv("SMTP_PASSWORD")
+
+        smtpMailer := new(SMTPMailer)
+        smtpMailer.addr = fmt.Sprintf("%v:%v", host, port)
+        smtpMailer.from = os.Getenv("MAIL_FROM")
+        if username != "" {
+            smtpMailer.auth = smtp.PlainAuth("", username, password, host)
+        }
+        mailer = smtpMailer
+    case "", "log":
+        mailer = &LogMailer{path: os.Getenv("MAIL_LOG_PATH")}
+    default:
+        panic("Unknown mailer.")
+    }
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+    template := "From: %v\r\nTo: %v\r\nSubject: %v\r\nDate: %v\r\nMIME-Version: 1.0\r\n" +
+        "Content-Type: text/plain; charset=UTF-8\r\n\r\n%v"
+    message := fmt.Sprintf(template, m.from, to, subject, time.Now().Format(time.RFC1123Z), body)
+    return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(message))
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+    var writer io.Writer = os.Stdout
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if m.path != "" {
+        file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        writer = file
+    }
+
+    template := "To: %v\nSubject: %v\nDate: %v\n\n%v\n\n"
+    _, err := fmt.Fprintf(writer, template, to, subject, time.Now().Format(time.RFC1123Z), body)
+    return err
+}
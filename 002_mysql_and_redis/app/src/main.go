@@ -14,6 +14,7 @@ import (
     "gorm.io/gorm"
     "os"
     "strconv"
+    "time"
 )
 
 type (
@@ -28,10 +29,62 @@ var (
     redisClient *redis.Client
 )
 
+// Statements making the database refuse to change or remove audit events. They are safe to run on every startup.
+var auditLogTriggers = []string{
+    `DROP TRIGGER IF EXISTS audit_events_no_update`,
+    `CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit events can not be changed or removed'`,
+    `DROP TRIGGER IF EXISTS audit_events_no_delete`,
+    `CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit events can not be changed or removed'`,
+}
+
+// Full-text indexes of the posts and comments, on the same columns as the ones searched
+var searchIndexes = []searchIndex{
+    {
+        Model:     &Post{},
+        Name:      "idx_posts_search",
+        Statement: `CREATE FULLTEXT INDEX idx_posts_search ON posts (title, content)`,
+    },
+    {
+        Model:     &Comment{},
+        Name:      "idx_comments_search",
+        Statement: `CREATE FULLTEXT INDEX idx_comments_search ON comments (content)`,
+    },
+}
+
+// The posts and comments are searched with the full-text search of MySQL in the natural language mode, which ranks them
+// by relevance
+var searcher Searcher = sqlSearcher{Statements: []string{
+    `SELECT 'post' AS type, id, id AS post_id, title, content AS snippet,
+        MATCH (title, content) AGAINST (@query IN NATURAL LANGUAGE MODE) AS score
+    FROM posts
+    WHERE MATCH (title, content) AGAINST (@query IN NATURAL LANGUAGE MODE)
+        AND deleted_at IS NULL AND hidden_at IS NULL AND status = 'published'
+    ORDER BY score DESC
+    LIMIT @limit
+    `,
+    `SELECT 'comment' AS type, comments.id, comments.post_id, comments.content AS snippet,
+        MATCH (comments.content) AGAINST (@query IN NATURAL LANGUAGE MODE) AS score
+    FROM comments
+    JOIN posts ON posts.id = comments.post_id
+    WHERE MATCH (comments.content) AGAINST (@query IN NATURAL LANGUAGE MODE)
+        AND comments.deleted_at IS NULL AND comments.hidden_at IS NULL
+        AND posts.deleted_at IS NULL AND posts.hidden_at IS NULL AND posts.status = 'published'
+    ORDER BY score DESC
+    LIMIT @limit
+    `,
+}}
+
 func (cv *CustomValidator) Validate(i interface{}) error {
     return cv.validator.Struct(i)
 }
 
+// ValidatePartial validates only the given fields of the struct.
+func (cv *CustomValidator) ValidatePartial(i interface{}, fields ...string) error {
+    return cv.validator.StructPartial(i, fields...)
+}
+
 func setupSql() {
     var err error
 
@@ -43,7 +96,14 @@ func setupSql() {
 
     template := "%v:%v@tcp(%v:%v)/%v?charset=utf8mb4&parseTime=True&loc=Local"
     dsn := fmt.Sprintf(template, user, password, host, port, dbname)
-    sqlClient, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+    // Timestamps are kept with millisecond precision, as stored by MySQL, so that the entity tags derived from them do
+    // not change once they are read back
+    config := gorm.Config{
+        NowFunc: func() time.Time {
+            return time.Now().Truncate(time.Millisecond)
+        },
+    }
+    sqlClient, err = gorm.Open(mysql.Open(dsn), &config)
     if err != nil {
         panic("Could not connect to database.")
     }
@@ -53,6 +113,11 @@ func setupSql() {
         panic("Could not migrate posts.")
     }
 
+    err = sqlClient.AutoMigrate(&Tag{})
+    if err != nil {
+        panic("Could not migrate tags.")
+    }
+
     err = sqlClient.AutoMigrate(&Comment{})
     if err != nil {
         panic("Could not migrate comments.")
@@ -62,6 +127,88 @@ func setupSql() {
     if err != nil {
         panic("Could not migrate users.")
     }
+
+    err = sqlClient.AutoMigrate(&PostRevision{})
+    if err != nil {
+        panic("Could not migrate post revisions.")
+    }
+
+    err = sqlClient.AutoMigrate(&PostSlug{})
+    if err != nil {
+        panic("Could not migrate post slugs.")
+    }
+    assignMissingSlugs()
+
+    err = sqlClient.AutoMigrate(&RecoveryCode{})
+    if err != nil {
+        panic("Could not migrate recovery codes.")
+    }
+
+    err = sqlClient.AutoMigrate(&ApiKey{})
+    if err != nil {
+        panic("Could not migrate API keys.")
+    }
+
+    err = sqlClient.AutoMigrate(&Impersonation{})
+    if err != nil {
+        panic("Could not migrate impersonations.")
+    }
+
+    err = sqlClient.AutoMigrate(&Report{})
+    if err != nil {
+        panic("Could not migrate reports.")
+    }
+
+    err = sqlClient.AutoMigrate(&AuditEvent{})
+    if err != nil {
+        panic("Could not migrate audit events.")
+    }
+
+    // The audit log is append-only, so the database refuses to change or remove its rows
+    for _, statement := range auditLogTriggers {
+        err = sqlClient.Exec(statement).Error
+        if err != nil {
+            panic("Could not protect audit events.")
+        }
+    }
+
+    // The full-text indexes of the search are not known to GORM, so they are created here
+    for _, index := range searchIndexes {
+        if !sqlClient.Migrator().HasIndex(index.Model, index.Name) {
+            err = sqlClient.Exec(index.Statement).Error
+            if err != nil {
+                panic("Could not create search indexes.")
+            }
+        }
+    }
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        panic(fmt.Sprintf("Invalid duration in %v.", key))
+    }
+
+    return duration
+}
+
+func getEnvInt(key string, fallback int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+
+    number, err := strconv.Atoi(value)
+    if err != nil {
+        panic(fmt.Sprintf("Invalid number in %v.", key))
+    }
+
+    return number
 }
 
 func setupRedis() {
@@ -95,6 +242,19 @@ func setupRedis() {
 func main() {
     setupSql()
     setupRedis()
+    setupAuth()
+    setupLoginLockout()
+    setupPasswords()
+    setupMailer()
+    setupPasswordReset()
+    setupEmailVerification()
+    setupTotp()
+    setupPolicy()
+    setupAdmin()
+    setupReports()
+    setupTrash()
+    setupUsers()
+    setupScheduler()
 
     e := echo.New()
 
@@ -108,26 +268,97 @@ func main() {
     // Swagger
     e.GET("/swagger/*", echoSwagger.WrapHandler)
 
+    // Authentication with a session token or an API key
+    auth := middleware.KeyAuth(checkAuthToken)
+
+    // Authentication on the endpoints open to everybody, which show more to the logged in users
+    optionalAuth := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+        Skipper: func(context echo.Context) bool {
+            return context.Request().Header.Get(echo.HeaderAuthorization) == ""
+        },
+        Validator: checkAuthToken,
+    })
+
     e.GET("/users", listUserAccounts)
     e.POST("/users", createUserAccount)
+    e.GET("/users/me", retrieveCurrentUserAccount, auth, requireScope(ScopeUsersRead))
     e.GET("/users/:id", retrieveUserAccount)
-    e.PUT("/users", updateUserAccount, middleware.KeyAuth(checkAuthToken))
-    e.DELETE("/users", deleteUserAccount, middleware.KeyAuth(checkAuthToken))
+    e.PUT("/users", updateUserAccount, auth, requireSession, requireAccountOwner)
+    e.PATCH("/users", patchUserAccount, auth, requireSession, requireAccountOwner)
+    e.DELETE("/users", deleteUserAccount, auth, requireSession, requireAccountOwner)
 
     e.POST("/token", issueAuthToken)
-    e.DELETE("/token", revokeAuthToken, middleware.KeyAuth(checkAuthToken))
+    e.DELETE("/token", revokeAuthToken, auth, requireSession)
+    e.DELETE("/token/all", revokeAllAuthTokens, auth, requireSession, requireAccountOwner)
+    if authMode == AuthModeJWT {
+        e.POST("/token/refresh", refreshAuthToken)
+    }
+    e.POST("/token/mfa", issueMfaAuthToken)
+
+    e.POST("/totp/enroll", enrollTotp, auth, requireSession, requireAccountOwner)
+    e.POST("/totp/confirm", confirmTotp, auth, requireSession, requireAccountOwner)
+    e.DELETE("/totp", disableTotp, auth, requireSession, requireAccountOwner)
+
+    e.POST("/password-reset", requestPasswordReset)
+    e.POST("/password-reset/confirm", confirmPasswordReset)
 
-    e.GET("/posts", listPosts)
-    e.POST("/posts", createPost, middleware.KeyAuth(checkAuthToken))
-    e.GET("/posts/:id", retrievePost)
-    e.PUT("/posts/:id", updatePost, middleware.KeyAuth(checkAuthToken))
-    e.DELETE("/posts/:id", deletePost, middleware.KeyAuth(checkAuthToken))
+    e.POST("/email-verification", resendEmailVerification, auth, requireSession, requireAccountOwner)
+    e.POST("/email-verification/confirm", confirmEmailVerification)
+
+    e.GET("/api-keys", listApiKeys, auth, requireSession, requireAccountOwner)
+    e.POST("/api-keys", createApiKey, auth, requireSession, requireAccountOwner)
+    e.DELETE("/api-keys/:id", deleteApiKey, auth, requireSession, requireAccountOwner)
+
+    e.GET("/sessions", listSessions, auth, requireSession)
+    e.DELETE("/sessions/:id", deleteSession, auth, requireSession)
+
+    e.GET("/posts", listPosts, optionalAuth)
+    e.POST("/posts", createPost, auth, requireScope(ScopePostsWrite), checkVerifiedEmail)
+    e.GET("/posts/by-slug/:slug", retrievePostBySlug, optionalAuth)
+    e.GET("/posts/:id", retrievePost, optionalAuth)
+    e.PUT("/posts/:id", updatePost, auth, requireScope(ScopePostsWrite))
+    e.PATCH("/posts/:id", patchPost, auth, requireScope(ScopePostsWrite))
+    e.DELETE("/posts/:id", deletePost, auth, requireScope(ScopePostsWrite))
+    e.POST("/posts/:id/hide", hidePost, auth, requireScope(ScopePostsWrite))
+    e.POST("/posts/:id/unhide", unhidePost, auth, requireScope(ScopePostsWrite))
+    e.POST("/posts/:id/reports", reportPost, auth, requireSession)
+    e.POST("/posts/:id/restore", restorePost, auth, requireScope(ScopePostsWrite))
+    e.GET("/posts/:id/revisions", listPostRevisions, auth)
+    e.GET("/posts/:id/revisions/:rev", retrievePostRevision, auth)
+    e.GET("/posts/:id/revisions/:rev/diff", diffPostRevision, auth)
+    e.POST("/posts/:id/revisions/:rev/restore", restorePostRevision, auth, requireScope(ScopePostsWrite))
 
     e.GET("/comments", listComments)
-    e.POST("/comments", createComment, middleware.KeyAuth(checkAuthToken))
-    e.GET("/comments/:id", retrieveComment)
-    e.PUT("/comments/:id", updateComment, middleware.KeyAuth(checkAuthToken))
-    e.DELETE("/comments/:id", deleteComment, middleware.KeyAuth(checkAuthToken))
+    e.POST("/comments", createComment, auth, requireScope(ScopeCommentsWrite), checkVerifiedEmail)
+    e.GET("/comments/:id", retrieveComment, optionalAuth)
+    e.PUT("/comments/:id", updateComment, auth, requireScope(ScopeCommentsWrite))
+    e.PATCH("/comments/:id", patchComment, auth, requireScope(ScopeCommentsWrite))
+    e.DELETE("/comments/:id", deleteComment, auth, requireScope(ScopeCommentsWrite))
+    e.POST("/comments/:id/hide", hideComment, auth, requireScope(ScopeCommentsWrite))
+    e.POST("/comments/:id/unhide", unhideComment, auth, requireScope(ScopeCommentsWrite))
+    e.POST("/comments/:id/reports", reportComment, auth, requireSession)
+    e.POST("/comments/:id/restore", restoreComment, auth, requireScope(ScopeCommentsWrite))
+
+    e.GET("/search", searchContent)
+
+    e.GET("/tags", listTags)
+    e.GET("/tags/:slug/posts", listTagPosts, optionalAuth)
+
+    e.GET("/trash", listTrash, auth, requireSession)
+
+    e.GET("/moderation/queue", listModerationQueue, auth, requireSession, requireModerator)
+    e.GET("/moderation/reports", listReports, auth, requireSession, requireModerator)
+    e.POST("/moderation/posts/:id", moderatePost, auth, requireSession, requireModerator)
+    e.POST("/moderation/comments/:id", moderateComment, auth, requireSession, requireModerator)
+
+    e.GET("/admin/users", listAdminUsers, auth, requireSession, requireAdmin)
+    e.PUT("/admin/users/:id/role", updateUserRole, auth, requireSession, requireAdmin)
+    e.PUT("/admin/users/:id/suspension", suspendUser, auth, requireSession, requireAdmin)
+    e.DELETE("/admin/users/:id/suspension", liftUserSuspension, auth, requireSession, requireAdmin)
+    e.DELETE("/admin/users/:id/sessions", revokeUserSessionsAsAdmin, auth, requireSession, requireAdmin)
+    e.POST("/admin/users/:id/impersonate", impersonateUser, auth, requireSession, requireAdmin)
+    e.GET("/admin/impersonations", listImpersonations, auth, requireSession, requireAdmin)
+    e.GET("/admin/audit", listAuditEvents, auth, requireSession, requireAdmin)
 
     e.Logger.Fatal(e.Start(":1323"))
 }
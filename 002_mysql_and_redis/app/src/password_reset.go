@@ -0,0 +1,165 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "github.com/go-redis/redis/v8"
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/random"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type (
+    PasswordResetRequest struct {
+        Email string `json:"email" validate:"required,email"`
+    }
+
+    PasswordResetConfirm struct {
+        Token    string `json:"token" validate:"required"`
+        Password string `json:"password" validate:"required,min=6"`
+    }
+)
+
+// Minimal interval between two reset emails sent to the same account
+const passwordResetThrottle = 1 * time.Minute
+
+var (
+    passwordResetTTL time.Duration
+)
+
+func setupPasswordReset() {
+    passwordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", 1 * time.Hour)
+}
+
+// hashToken is used to key the one-time tokens in Redis, so the tokens themselves are never stored.
+func hashToken(token string) string {
+    hash := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(hash[:])
+}
+
+func passwordResetKey(token string) string {
+    return "password_reset:" + hashToken(token)
+}
+
+func passwordResetThrottleKey(userID uint) string {
+    return fmt.Sprintf("password_reset_throttle:%v", userID)
+}
+
+// consumeOneTimeToken returns the value stored under the key and deletes the key, so the token cannot be used twice.
+func consumeOneTimeToken(key string) (string, bool) {
+    var getCmd *redis.StringCmd
+
+    _, err := redisClient.TxPipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        getCmd = pipe.Get(redisCtx, key)
+        pipe.Del(redisCtx, key)
+        return nil
+    })
+    if err == redis.Nil {
+        return "", false
+    } else if err != nil {
+        panic(err)
+    }
+
+    return getCmd.Val(), true
+}
+
+// requestPasswordReset godoc
+// @Summary Request Password Reset
+// @Tags password-reset
+// @Accept json
+// @Param request body PasswordResetRequest true "Request"
+// @Success 202
+// @Failure 400
+// @Router /password-reset [post]
+func requestPasswordReset(context echo.Context) error {
+    var user User
+
+    passwordResetRequest := new(PasswordResetRequest)
+    if err := context.Bind(passwordResetRequest); err != nil {
+        return err
+    }
+    if err := context.Validate(passwordResetRequest); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    // The response is the same whether the account exists or not, so it cannot be used to look up email addresses
+    result := sqlClient.First(&user, "email = ?", passwordResetRequest.Email)
+    if result.Error != nil {
+        return context.NoContent(http.StatusAccepted)
+    }
+
+    sent, err := redisClient.SetNX(redisCtx, passwordResetThrottleKey(user.ID), 1, passwordResetThrottle).Result()
+    if err != nil {
+        panic(err)
+    }
+    if !sent {
+        return context.NoContent(http.StatusAccepted)
+    }
+
+    token := random.String(32, random.Alphanumeric)
+    err = redisClient.Set(redisCtx, passwordResetKey(token), user.ID, passwordResetTTL).Err()
+    if err != nil {
+        panic(err)
+    }
+
+    body := fmt.Sprintf(
+        "Hello %v,\n\nA password reset has been requested for your account. To choose a new password, follow the "+
+            "link below within %v:\n\n%v/password-reset?token=%v\n\nIf it was not you, just ignore this message.",
+        user.Name, passwordResetTTL, appBaseURL, token,
+    )
+    if err := mailer.Send(user.Email, "Password reset", body); err != nil {
+        context.Logger().Error(err)
+    }
+
+    return context.NoContent(http.StatusAccepted)
+}
+
+// confirmPasswordReset godoc
+// @Summary Confirm Password Reset
+// @Tags password-reset
+// @Accept json
+// @Param confirmation body PasswordResetConfirm true "Confirmation"
+// @Success 204
+// @Failure 400
+// @Router /password-reset/confirm [post]
+func confirmPasswordReset(context echo.Context) error {
+    var user User
+
+    passwordResetConfirm := new(PasswordResetConfirm)
+    if err := context.Bind(passwordResetConfirm); err != nil {
+        return err
+    }
+    if err := context.Validate(passwordResetConfirm); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    userID, ok := consumeOneTimeToken(passwordResetKey(passwordResetConfirm.Token))
+    if !ok {
+        return context.JSON(http.StatusBadRequest, "Provided token is invalid or has expired.")
+    }
+
+    id, _ := strconv.Atoi(userID)
+    result := sqlClient.First(&user, id)
+    if result.Error != nil {
+        return context.JSON(http.StatusBadRequest, "Provided token is invalid or has expired.")
+    }
+
+    hashedPassword, err := hashAndSalt(passwordResetConfirm.Password)
+    if err != nil {
+        return err
+    }
+
+    user.PasswordHash = hashedPassword
+    sqlClient.Model(&user).Update("password_hash", hashedPassword)
+
+    // Whoever might have known the old password is logged out
+    revokeUserSessions(user, "")
+    clearLoginFailures(user.Name)
+    emitAuditAs(context, &user, AuditPasswordReset, userTarget(user))
+
+    return context.NoContent(http.StatusNoContent)
+}
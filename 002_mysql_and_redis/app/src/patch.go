@@ -0,0 +1,87 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/labstack/echo/v4"
+    "io/ioutil"
+    "reflect"
+    "strings"
+)
+
+// bindMergePatch applies the JSON merge patch (RFC 7396) from the request body to the input, which holds the current
+// values. Only the fields present in the patch are validated, as the other ones are left as they are.
+func bindMergePatch(context echo.Context, input interface{}) error {
+    var patch map[string]interface{}
+    var document interface{}
+
+    body, err := ioutil.ReadAll(context.Request().Body)
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+        return errors.New("The merge patch has to be a JSON object.")
+    }
+
+    current, err := json.Marshal(input)
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(current, &document); err != nil {
+        return err
+    }
+    merged, err := json.Marshal(mergePatch(document, patch))
+    if err != nil {
+        return err
+    }
+
+    // The input is decoded from scratch, so that the members removed by the patch are left empty
+    value := reflect.ValueOf(input).Elem()
+    value.Set(reflect.Zero(value.Type()))
+    if err := json.Unmarshal(merged, input); err != nil {
+        return err
+    }
+
+    return context.Echo().Validator.(*CustomValidator).ValidatePartial(input, patchedFields(value.Type(), patch)...)
+}
+
+// mergePatch merges the patch into the document: null removes a member, objects are merged member by member and any
+// other value replaces the one in the document.
+func mergePatch(document interface{}, patch interface{}) interface{} {
+    patchObject, ok := patch.(map[string]interface{})
+    if !ok {
+        return patch
+    }
+
+    documentObject, ok := document.(map[string]interface{})
+    if !ok {
+        documentObject = map[string]interface{}{}
+    }
+    for key, value := range patchObject {
+        if value == nil {
+            delete(documentObject, key)
+        } else {
+            documentObject[key] = mergePatch(documentObject[key], value)
+        }
+    }
+
+    return documentObject
+}
+
+// patchedFields lists the names of the struct fields whose JSON members are present in the patch.
+func patchedFields(structType reflect.Type, patch map[string]interface{}) []string {
+    var fields []string
+
+    for i := 0; i < structType.NumField(); i++ {
+        field := structType.Field(i)
+        name := strings.Split(field.Tag.Get("json"), ",")[0]
+        if name == "" {
+            name = field.Name
+        }
+        if _, ok := patch[name]; ok {
+            fields = append(fields, field.Name)
+        }
+    }
+
+    return fields
+}
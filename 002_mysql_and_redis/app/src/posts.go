@@ -9,24 +9,85 @@ import (
     "time"
 )
 
+const (
+    PostDraft     = "draft"
+    PostScheduled = "scheduled"
+    PostPublished = "published"
+    PostUnlisted  = "unlisted"
+    PostPrivate   = "private"
+)
+
 type (
     Post struct {
-        ID         uint           `json:"id" gorm:"primarykey"`
-        CreatedAt  time.Time      `json:"created_at"`
-        UpdatedAt  time.Time      `json:"updated_at"`
-        DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
-        AuthorID   uint           `json:"author_id"`
-        Author     User           `json:"author"`
-        Title      string         `json:"title" gorm:"size:255"`
-        Content    string         `json:"content"`
+        ID              uint           `json:"id" gorm:"primarykey"`
+        CreatedAt       time.Time      `json:"created_at" gorm:"index"`
+        UpdatedAt       time.Time      `json:"updated_at" gorm:"index"`
+        DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
+        // User who has moved the post to the trash
+        DeletedByID     *uint          `json:"-"`
+        AuthorID        uint           `json:"author_id"`
+        Author          User           `json:"author"`
+        Title           string         `json:"title" gorm:"size:255;index"`
+        Content         string         `json:"content"`
+        HiddenAt        *time.Time     `json:"hidden_at,omitempty" gorm:"index"`
+        // Whether the post has been hidden by reaching the report threshold rather than by a moderator
+        HiddenByReports bool           `json:"-"`
+        Status          string         `json:"status" gorm:"size:16;default:published;index"`
+        // Time the post has been or is going to be published at
+        PublishAt       *time.Time     `json:"publish_at"`
+        Tags            []Tag          `json:"tags" gorm:"many2many:post_tags"`
+        // Current slug, made of the title
+        Slug            string         `json:"slug" gorm:"size:255;index"`
     }
 
     PostIn struct {
-        Title   string `json:"title" validate:"required,min=3"`
-        Content string `json:"content" validate:"required,min=3"`
+        Title     string     `json:"title" validate:"required,min=3"`
+        Content   string     `json:"content" validate:"required,min=3"`
+        Status    string     `json:"status" validate:"omitempty,oneof=draft scheduled published unlisted private"`
+        PublishAt *time.Time `json:"publish_at"`
+        Tags      []string   `json:"tags" validate:"max=10,dive,required,max=64"`
     }
 )
 
+// setStatus moves the post to the status, leaving the current one if none is given. It returns a message explaining
+// why the status can not be set, or an empty string.
+func (post *Post) setStatus(status string, publishAt *time.Time) string {
+    now := time.Now()
+
+    if status == "" {
+        status = post.Status
+    }
+
+    switch status {
+    case PostScheduled:
+        if publishAt == nil {
+            publishAt = post.PublishAt
+        }
+        if publishAt == nil || !publishAt.After(now) {
+            return "A scheduled post needs publish_at in the future."
+        }
+        post.PublishAt = publishAt
+    case PostPublished, PostUnlisted:
+        // The time of the first publication is kept
+        if post.PublishAt == nil || post.PublishAt.After(now) {
+            post.PublishAt = &now
+        }
+    default:
+        // A schedule given up on is forgotten
+        if post.PublishAt != nil && post.PublishAt.After(now) {
+            post.PublishAt = nil
+        }
+    }
+
+    post.Status = status
+    return ""
+}
+
+// sortKeys returns the values of the fields the posts can be sorted by.
+func (post *Post) sortKeys() sortKeys {
+    return sortKeys{CreatedAt: post.CreatedAt, UpdatedAt: post.UpdatedAt, Title: post.Title}
+}
+
 func getPostOrError(context echo.Context) (*Post, int) {
     var post Post
 
@@ -35,7 +96,7 @@ func getPostOrError(context echo.Context) (*Post, int) {
         return nil, http.StatusBadRequest
     }
 
-    result := sqlClient.Preload("Author").First(&post, id)
+    result := sqlClient.Preload("Author", withDeletedAuthors).Preload("Tags").First(&post, id)
     if result.Error != nil {
         return nil, http.StatusNotFound
     }
@@ -45,21 +106,63 @@ func getPostOrError(context echo.Context) (*Post, int) {
 
 // listPosts godoc
 // @Summary List Posts
+// @Description Lists the published posts, along with all the posts of the current user if there is one.
 // @Tags posts
 // @Produce json
-// @Param author_id query int false "Author ID"
-// @Success 200 {array} Post
+// @Param author_id query string false "Author IDs, comma-separated"
+// @Param title_prefix query string false "Beginning of the title"
+// @Param created_after query string false "Created after, in RFC 3339"
+// @Param created_before query string false "Created before, in RFC 3339"
+// @Param updated_after query string false "Updated after, in RFC 3339"
+// @Param sort query string false "created_at, updated_at or title, prefixed with a minus for the descending order"
+// @Param limit query int false "Number of posts on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]Post}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
 // @Router /posts [get]
 func listPosts(context echo.Context) error {
+    return listMatchingPosts(context, sqlClient)
+}
+
+// listMatchingPosts lists the visible posts found by the query, narrowed down and sorted as requested.
+func listMatchingPosts(context echo.Context, query *gorm.DB) error {
     var posts []Post
+    var next *pageCursor
 
-    query := sqlClient
-    if authorID := context.QueryParam("author_id"); authorID != "" {
-        query = query.Where("author_id = ?", authorID)
+    page, err := getPageQuery(context, "created_at", "updated_at", "title")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    authorIDs, err := getIDsParam(context, "author_id")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
+    query, err = filterByTime(context, query.Where("hidden_at IS NULL"))
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    if user := currentUser(context); user != nil {
+        query = query.Where("(status = ? OR author_id = ?)", PostPublished, user.ID)
+    } else {
+        query = query.Where("status = ?", PostPublished)
+    }
+    if len(authorIDs) > 0 {
+        query = query.Where("author_id IN ?", authorIDs)
+    }
+    if prefix := context.QueryParam("title_prefix"); prefix != "" {
+        query = query.Where("title LIKE ?", likePrefix(prefix))
+    }
+    page.apply(query).Preload("Author", withDeletedAuthors).Preload("Tags").Find(&posts)
+
+    if len(posts) > page.Limit {
+        posts = posts[:page.Limit]
+        next = page.cursorAt(posts[page.Limit-1].sortKeys(), posts[page.Limit-1].ID)
     }
-    query.Preload("Author").Find(&posts)
 
-    return context.JSON(http.StatusOK, posts)
+    return sendPage(context, posts, next)
 }
 
 // createPost godoc
@@ -87,21 +190,42 @@ func createPost(context echo.Context) error {
     post.Author = context.Get("User").(User)
     post.Title = postIn.Title
     post.Content = postIn.Content
+    post.Status = PostPublished
+    if message := post.setStatus(postIn.Status, postIn.PublishAt); message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    tags, message := newTags(postIn.Tags)
+    if message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    if err := saveTags(tags); err != nil {
+        return err
+    }
+    post.Tags = tags
 
     result := sqlClient.Create(&post)
     if result.Error != nil {
         return result.Error
     }
+    if err := assignSlug(post); err != nil {
+        return err
+    }
+    saveRevision(post, post.Author, post.CreatedAt)
 
     return context.JSON(http.StatusCreated, post)
 }
 
 // retrievePost godoc
 // @Summary Retrieve Post
+// @Description Drafts, scheduled and private posts are found only by their authors.
 // @Tags posts
 // @Produce json
 // @Param id path int true "ID"
+// @Param If-None-Match header string false "ETag of the cached version"
+// @Security ApiKeyAuth
 // @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 304
 // @Failure 400
 // @Failure 404
 // @Router /posts/{id} [get]
@@ -110,6 +234,18 @@ func retrievePost(context echo.Context) error {
     if err != 0 {
         return context.NoContent(err)
     }
+    if post.HiddenAt != nil || !canViewPost(currentUser(context), post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    return sendPost(context, post)
+}
+
+// sendPost responds with the post, or with no content if the client already has its current version.
+func sendPost(context echo.Context, post *Post) error {
+    if notModified(context, etag(post.UpdatedAt)) {
+        return context.NoContent(http.StatusNotModified)
+    }
 
     return context.JSON(http.StatusOK, post)
 }
@@ -121,34 +257,105 @@ func retrievePost(context echo.Context) error {
 // @Produce json
 // @Param id path int true "ID"
 // @Param post body PostIn true "Post"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /posts/{id} [put]
 func updatePost(context echo.Context) error {
+    return editPost(context, false)
+}
+
+// patchPost godoc
+// @Summary Patch Post
+// @Description Changes only the fields present in the JSON merge patch (RFC 7396).
+// @Tags posts
+// @Accept json
+// @Produce json
+// @Param id path int true "ID"
+// @Param post body PostIn true "Post"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 412
+// @Router /posts/{id} [patch]
+func patchPost(context echo.Context) error {
+    return editPost(context, true)
+}
+
+// editPost replaces the post with the one in the request, or with the merge patch sent with PATCH applied to it.
+func editPost(context echo.Context, patch bool) error {
     post, err := getPostOrError(context)
     if err != 0 {
         return context.NoContent(err)
     }
 
-    if post.AuthorID != context.Get("User").(User).ID {
+    user := context.Get("User").(User)
+    if !canUpdatePost(user, post) {
         return context.NoContent(http.StatusForbidden)
     }
+    if !ifMatch(context, etag(post.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
 
     postIn := new(PostIn)
-    if err := context.Bind(postIn); err != nil {
-        return err
-    }
-    if err := context.Validate(postIn); err != nil {
-        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    if patch {
+        postIn.Title = post.Title
+        postIn.Content = post.Content
+        postIn.Status = post.Status
+        postIn.PublishAt = post.PublishAt
+        postIn.Tags = post.tagNames()
+        if err := bindMergePatch(context, postIn); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
+    } else {
+        if err := context.Bind(postIn); err != nil {
+            return err
+        }
+        if err := context.Validate(postIn); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
     }
 
+    startRevisionHistory(post)
+
+    updatedAt := post.UpdatedAt
     post.Title = postIn.Title
     post.Content = postIn.Content
-    sqlClient.Save(&post)
+    if message := post.setStatus(postIn.Status, postIn.PublishAt); message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    tags, message := newTags(postIn.Tags)
+    if message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+
+    // The post is written only if nobody has changed it since it has been read
+    result := sqlClient.Select("*").Where("updated_at = ?", updatedAt).Save(&post)
+    if result.RowsAffected == 0 {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+    if err := saveTags(tags); err != nil {
+        return err
+    }
+    if err := sqlClient.Model(post).Association("Tags").Replace(tags); err != nil {
+        return err
+    }
+    if err := assignSlug(post); err != nil {
+        return err
+    }
+    saveRevision(post, user, post.UpdatedAt)
+    setETag(context, etag(post.UpdatedAt))
 
     return context.JSON(http.StatusOK, post)
 }
@@ -157,12 +364,14 @@ func updatePost(context echo.Context) error {
 // @Summary Delete Post
 // @Tags posts
 // @Param id path int true "ID"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 204
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /posts/{id} [delete]
 func deletePost(context echo.Context) error {
     post, err := getPostOrError(context)
@@ -170,11 +379,73 @@ func deletePost(context echo.Context) error {
         return context.NoContent(err)
     }
 
-    if post.AuthorID != context.Get("User").(User).ID {
+    if !canDeletePost(context.Get("User").(User), post) {
+        return context.NoContent(http.StatusForbidden)
+    }
+    if !ifMatch(context, etag(post.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
+    if err := trashPost(context.Get("User").(User), post); err != nil {
+        return err
+    }
+    emitAudit(context, AuditPostDelete, postTarget(post))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// hidePost godoc
+// @Summary Hide Post
+// @Tags posts
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/hide [post]
+func hidePost(context echo.Context) error {
+    post, err := getPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canHidePost(context.Get("User").(User), post) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    if post.HiddenAt == nil || post.HiddenByReports {
+        hideByModerator(post, post.HiddenAt)
+        emitAudit(context, AuditPostHide, postTarget(post))
+    }
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// unhidePost godoc
+// @Summary Unhide Post
+// @Tags posts
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/unhide [post]
+func unhidePost(context echo.Context) error {
+    post, err := getPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canHidePost(context.Get("User").(User), post) {
         return context.NoContent(http.StatusForbidden)
     }
 
-    sqlClient.Delete(&post)
+    unhide(post)
+    emitAudit(context, AuditPostUnhide, postTarget(post))
 
     return context.NoContent(http.StatusNoContent)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "html"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // Number of bytes of the text shown in a snippet
+    snippetLength = 160
+)
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+type (
+    SearchResult struct {
+        // Either post or comment
+        Type    string  `json:"type"`
+        ID      uint    `json:"id"`
+        PostID  uint    `json:"post_id"`
+        Title   string  `json:"title,omitempty"`
+        // Part of the content around the first match, as HTML with the matching words in <mark>
+        Snippet string  `json:"snippet"`
+        Score   float64 `json:"score"`
+    }
+
+    // Searcher finds the published posts and their comments matching the query, ranked from the most relevant.
+    Searcher interface {
+        Search(query string, limit int) ([]SearchResult, error)
+    }
+
+    // sqlSearcher searches with the full-text search of the database. Each statement selects the rows of SearchResult
+    // matching @query, at most @limit of them, with the whole content in the snippet.
+    sqlSearcher struct {
+        Statements []string
+    }
+
+    // searchIndex is a full-text index used by the search, which is created on startup unless it exists.
+    searchIndex struct {
+        Model     interface{}
+        Name      string
+        Statement string
+    }
+)
+
+func (searcher sqlSearcher) Search(query string, limit int) ([]SearchResult, error) {
+    results := []SearchResult{}
+
+    for _, statement := range searcher.Statements {
+        var rows []SearchResult
+
+        params := map[string]interface{}{"query": query, "limit": limit}
+        err := sqlClient.Raw(statement, params).Scan(&rows).Error
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, rows...)
+    }
+
+    sort.SliceStable(results, func(i int, j int) bool {
+        return results[i].Score > results[j].Score
+    })
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    for i := range results {
+        results[i].Snippet = highlight(results[i].Snippet, query)
+    }
+
+    return results, nil
+}
+
+// matchesSearch tells whether the word starts with one of the words of the query, so that the inflected forms found
+// by the search are matched too.
+func matchesSearch(word string, query string) bool {
+    word = strings.ToLower(word)
+    for _, term := range wordPattern.FindAllString(strings.ToLower(query), -1) {
+        if strings.HasPrefix(word, term) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// highlight returns the part of the text around the first word matching the query, as HTML with the matching words
+// in <mark>.
+func highlight(text string, query string) string {
+    var snippet strings.Builder
+
+    words := wordPattern.FindAllStringIndex(text, -1)
+
+    start := 0
+    for _, word := range words {
+        if matchesSearch(text[word[0]:word[1]], query) {
+            start = word[0] - snippetLength/4
+            break
+        }
+    }
+    if start < 0 {
+        start = 0
+    }
+    end := start + snippetLength
+    if end > len(text) {
+        end = len(text)
+    }
+
+    // The text is cut between the characters
+    for start > 0 && !utf8.RuneStart(text[start]) {
+        start--
+    }
+    for end < len(text) && !utf8.RuneStart(text[end]) {
+        end++
+    }
+
+    if start > 0 {
+        snippet.WriteString("…")
+    }
+    position := start
+    for _, word := range words {
+        if word[0] < start || word[1] > end || !matchesSearch(text[word[0]:word[1]], query) {
+            continue
+        }
+        snippet.WriteString(html.EscapeString(text[position:word[0]]))
+        snippet.WriteString("<mark>" + html.EscapeString(text[word[0]:word[1]]) + "</mark>")
+        position = word[1]
+    }
+    snippet.WriteString(html.EscapeString(text[position:end]))
+    if end < len(text) {
+        snippet.WriteString("…")
+    }
+
+    return snippet.String()
+}
+
+// searchContent godoc
+// @Summary Search
+// @Description Finds the published posts and their comments matching the query, ranked from the most relevant.
+// @Tags search
+// @Produce json
+// @Param q query string true "Query"
+// @Param limit query int false "Number of results, 20 by default and 100 at most"
+// @Success 200 {array} SearchResult
+// @Failure 400
+// @Router /search [get]
+func searchContent(context echo.Context) error {
+    query := strings.TrimSpace(context.QueryParam("q"))
+    if query == "" {
+        return context.JSON(http.StatusBadRequest, "Provided query is empty.")
+    }
+
+    limit := defaultPageLimit
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > maxPageLimit {
+            return context.JSON(http.StatusBadRequest, "Provided limit is invalid.")
+        }
+        limit = number
+    }
+
+    results, err := searcher.Search(query, limit)
+    if err != nil {
+        return err
+    }
+
+    return context.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/go-redis/redis/v8"
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/random"
+    "net/http"
+    "sort"
+    "time"
+)
+
+type (
+    Session struct {
+        ID             string    `json:"id"`
+        CreatedAt      time.Time `json:"created_at"`
+        LastSeenAt     time.Time `json:"last_seen_at"`
+        ClientIP       string    `json:"client_ip"`
+        UserAgent      string    `json:"user_agent"`
+        User           User      `json:"user"`
+        // Name of the admin who has logged in as the user, if any
+        ImpersonatedBy string    `json:"impersonated_by,omitempty"`
+    }
+
+    SessionOut struct {
+        ID             string    `json:"id"`
+        CreatedAt      time.Time `json:"created_at"`
+        LastSeenAt     time.Time `json:"last_seen_at"`
+        ClientIP       string    `json:"client_ip"`
+        UserAgent      string    `json:"user_agent"`
+        Current        bool      `json:"current"`
+        ImpersonatedBy string    `json:"impersonated_by,omitempty"`
+    }
+)
+
+// How often the last seen time of a session is written back to Redis
+const sessionLastSeenResolution = 1 * time.Minute
+
+// Deletes every session listed in the user's session index (KEYS[1]) except the one with the ID passed in ARGV[1].
+// Running it as a single script makes the revocation atomic, so no session created in the meantime can survive it.
+// When ARGV[2] is a positive number of seconds, the revoked sessions are also marked as such for that long.
+var revokeSessionsScript = redis.NewScript(`
+local keys = redis.call('SMEMBERS', KEYS[1])
+local revoked = 0
+for _, key in ipairs(keys) do
+    local session = redis.call('GET', key)
+    local id = session and cjson.decode(session).id
+    if id ~= ARGV[1] then
+        redis.call('DEL', key)
+        redis.call('SREM', KEYS[1], key)
+        if id and tonumber(ARGV[2]) > 0 then
+            redis.call('SET', 'revoked_session:' .. id, 1, 'EX', ARGV[2])
+        end
+        revoked = revoked + 1
+    end
+end
+return revoked
+`)
+
+func userSessionsKey(userID uint) string {
+    return fmt.Sprintf("user_sessions:%v", userID)
+}
+
+// revokedSessionKey returns the Redis key marking a revoked session. In the JWT mode the access tokens already issued
+// for the session are checked against it, as they can not be recalled otherwise.
+func revokedSessionKey(sessionID string) string {
+    return "revoked_session:" + sessionID
+}
+
+// revokedSessionTTL returns how long a revoked session has to stay marked, which is until the last of its access
+// tokens expires. There is nothing to mark in the opaque mode.
+func revokedSessionTTL() time.Duration {
+    if authMode == AuthModeJWT {
+        return jwtAccessTokenTTL
+    }
+    return 0
+}
+
+// sessionKey returns the Redis key of the session identified by the token handed to the client. It is the bearer token
+// itself in the opaque mode and the refresh token in the JWT mode.
+func sessionKey(token string) string {
+    if authMode == AuthModeJWT {
+        return "refresh_token:" + token
+    }
+    return token
+}
+
+// sessionExpiration returns the time remaining until the session expires if it is left unused. It is not positive for
+// sessions which have already outlived their maximum lifetime.
+func sessionExpiration(session *Session) time.Duration {
+    remaining := time.Until(session.CreatedAt.Add(sessionMaxLifetime))
+    if remaining < sessionIdleTimeout {
+        return remaining
+    }
+    return sessionIdleTimeout
+}
+
+func getSession(key string) (*Session, bool) {
+    var session Session
+
+    sessionJson, err := redisClient.Get(redisCtx, key).Result()
+    if err != nil {
+        return nil, false
+    }
+
+    err = json.Unmarshal([]byte(sessionJson), &session)
+    if err != nil {
+        panic(err)
+    }
+
+    // Sessions stored before the metadata was introduced have no ID and are not accepted anymore
+    if session.ID == "" {
+        return nil, false
+    }
+
+    return &session, true
+}
+
+func saveSession(key string, session *Session) {
+    sessionJson, err := json.Marshal(session)
+    if err != nil {
+        panic(err)
+    }
+
+    err = redisClient.Set(redisCtx, key, string(sessionJson), redis.KeepTTL).Err()
+    if err != nil {
+        panic(err)
+    }
+}
+
+// storeSession saves the session under a freshly generated token and returns the token.
+func storeSession(session *Session) string {
+    token := random.String(32, random.Alphanumeric)
+    indexKey := userSessionsKey(session.User.ID)
+
+    sessionJson, err := json.Marshal(session)
+    if err != nil {
+        panic(err)
+    }
+
+    _, err = redisClient.TxPipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        pipe.Set(redisCtx, sessionKey(token), string(sessionJson), sessionExpiration(session))
+        pipe.SAdd(redisCtx, indexKey, sessionKey(token))
+        // No session outlives its maximum lifetime, so neither does the index need to
+        pipe.Expire(redisCtx, indexKey, sessionMaxLifetime)
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    return token
+}
+
+// newSession prepares a session of the user logging in with the request, without storing it yet.
+func newSession(context echo.Context, user User) *Session {
+    session := new(Session)
+    session.ID = random.String(16, random.Alphanumeric)
+    session.CreatedAt = time.Now()
+    session.LastSeenAt = session.CreatedAt
+    session.ClientIP = context.RealIP()
+    session.UserAgent = context.Request().UserAgent()
+    session.User = user
+
+    return session
+}
+
+func createSession(context echo.Context, user User) (string, *Session) {
+    session := newSession(context, user)
+    return storeSession(session), session
+}
+
+func touchSession(key string, session *Session) {
+    if time.Since(session.LastSeenAt) < sessionLastSeenResolution {
+        return
+    }
+
+    session.LastSeenAt = time.Now()
+    saveSession(key, session)
+}
+
+func revokeSession(key string, session *Session) {
+    _, err := redisClient.TxPipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        pipe.Del(redisCtx, key)
+        pipe.SRem(redisCtx, userSessionsKey(session.User.ID), key)
+        if ttl := revokedSessionTTL(); ttl > 0 {
+            pipe.Set(redisCtx, revokedSessionKey(session.ID), 1, ttl)
+        }
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+}
+
+// revokeUserSession invalidates a single session of the user and reports whether it has been found.
+func revokeUserSession(user User, sessionID string) bool {
+    for key, session := range getUserSessions(user) {
+        if session.ID == sessionID {
+            revokeSession(key, session)
+            return true
+        }
+    }
+
+    return false
+}
+
+// revokeUserSessions invalidates all the sessions of the user apart from the one with the keepSessionID, which may be
+// left empty to log the user out everywhere.
+func revokeUserSessions(user User, keepSessionID string) {
+    keys := []string{userSessionsKey(user.ID)}
+    ttl := int(revokedSessionTTL().Seconds())
+
+    err := revokeSessionsScript.Run(redisCtx, redisClient, keys, keepSessionID, ttl).Err()
+    if err != nil {
+        panic(err)
+    }
+}
+
+// updateUserSessions replaces the copy of the user cached in each of their sessions.
+func updateUserSessions(user User) {
+    for key, session := range getUserSessions(user) {
+        session.User = user
+        saveSession(key, session)
+    }
+}
+
+// getUserSessions returns the live sessions of the user keyed by their Redis keys. Sessions which have already expired
+// are removed from the index on the way.
+func getUserSessions(user User) map[string]*Session {
+    sessions := map[string]*Session{}
+
+    keys, err := redisClient.SMembers(redisCtx, userSessionsKey(user.ID)).Result()
+    if err != nil {
+        panic(err)
+    }
+
+    for _, key := range keys {
+        session, ok := getSession(key)
+        if !ok {
+            redisClient.SRem(redisCtx, userSessionsKey(user.ID), key)
+            continue
+        }
+
+        sessions[key] = session
+    }
+
+    return sessions
+}
+
+// countUserSessions counts the live sessions of each of the users. Unlike getUserSessions, it takes two round trips to
+// Redis however many users there are, the first one reading the session keys and the second one checking which exist.
+func countUserSessions(users []User) []int {
+    members := make([]*redis.StringSliceCmd, len(users))
+    _, err := redisClient.Pipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        for i, user := range users {
+            members[i] = pipe.SMembers(redisCtx, userSessionsKey(user.ID))
+        }
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    exists := make([][]*redis.IntCmd, len(users))
+    _, err = redisClient.Pipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        for i := range users {
+            for _, key := range members[i].Val() {
+                exists[i] = append(exists[i], pipe.Exists(redisCtx, key))
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    counts := make([]int, len(users))
+    for i := range users {
+        for _, cmd := range exists[i] {
+            counts[i] += int(cmd.Val())
+        }
+    }
+    return counts
+}
+
+// listSessions godoc
+// @Summary List Sessions of Current User
+// @Tags sessions
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} SessionOut
+// @Failure 401
+// @Router /sessions [get]
+func listSessions(context echo.Context) error {
+    sessionsOut := []SessionOut{}
+
+    for _, session := range getUserSessions(context.Get("User").(User)) {
+        sessionsOut = append(sessionsOut, SessionOut{
+            ID:             session.ID,
+            CreatedAt:      session.CreatedAt,
+            LastSeenAt:     session.LastSeenAt,
+            ClientIP:       session.ClientIP,
+            UserAgent:      session.UserAgent,
+            Current:        session.ID == context.Get("Session").(Session).ID,
+            ImpersonatedBy: session.ImpersonatedBy,
+        })
+    }
+
+    sort.Slice(sessionsOut, func(i, j int) bool {
+        return sessionsOut[i].CreatedAt.After(sessionsOut[j].CreatedAt)
+    })
+
+    return context.JSON(http.StatusOK, sessionsOut)
+}
+
+// deleteSession godoc
+// @Summary Revoke Session of Current User
+// @Tags sessions
+// @Param id path string true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 401
+// @Failure 404
+// @Router /sessions/{id} [delete]
+func deleteSession(context echo.Context) error {
+    if !revokeUserSession(context.Get("User").(User), context.Param("id")) {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    return context.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "gorm.io/gorm/clause"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+const (
+    // Number of bytes of the title kept in a slug
+    maxSlugLength = 64
+)
+
+type (
+    // PostSlug is a slug the post can be found by. Besides the current one, the slugs of its former titles are kept,
+    // so that the old links lead to it.
+    PostSlug struct {
+        ID        uint      `gorm:"primarykey"`
+        CreatedAt time.Time
+        PostID    uint      `gorm:"index"`
+        Slug      string    `gorm:"uniqueIndex;size:255"`
+    }
+)
+
+// slugBase returns the slug made of the title, before a number is added to it to make it unique.
+func slugBase(title string) string {
+    slug := slugify(title)
+    if len(slug) > maxSlugLength {
+        end := maxSlugLength
+        for !utf8.RuneStart(slug[end]) {
+            end--
+        }
+        slug = strings.TrimRight(slug[:end], "-")
+    }
+    if slug == "" {
+        slug = "post"
+    }
+
+    return slug
+}
+
+// hasSlugBase tells whether the slug has been made of the base, with or without a number.
+func hasSlugBase(slug string, base string) bool {
+    if slug == base {
+        return true
+    }
+
+    number := strings.TrimPrefix(slug, base+"-")
+    return number != slug && number != "" && strings.Trim(number, "0123456789") == ""
+}
+
+// assignSlug gives the post a unique slug made of its title, unless the current one has been made of the same words.
+// The previous slug stays behind, pointing at the post.
+func assignSlug(post *Post) error {
+    base := slugBase(post.Title)
+    if hasSlugBase(post.Slug, base) {
+        return nil
+    }
+
+    for number := 1; ; number++ {
+        var postSlug PostSlug
+
+        slug := base
+        if number > 1 {
+            slug = fmt.Sprintf("%v-%v", base, number)
+        }
+
+        result := sqlClient.Where("slug = ?", slug).First(&postSlug)
+        if result.Error == nil {
+            // A former slug of the post is taken back, but nobody else's
+            if postSlug.PostID != post.ID {
+                continue
+            }
+        } else {
+            // The slug may be taken by somebody else at the same time, in which case the next one is tried
+            postSlug = PostSlug{PostID: post.ID, Slug: slug}
+            result = sqlClient.Clauses(clause.OnConflict{DoNothing: true}).Create(&postSlug)
+            if result.Error != nil {
+                return result.Error
+            }
+            if result.RowsAffected == 0 {
+                continue
+            }
+        }
+
+        post.Slug = slug
+        return sqlClient.Unscoped().Model(post).UpdateColumn("slug", slug).Error
+    }
+}
+
+// assignMissingSlugs gives slugs to the posts created before the slugs have been introduced.
+func assignMissingSlugs() {
+    var posts []Post
+
+    sqlClient.Unscoped().Where("slug IS NULL OR slug = ?", "").Find(&posts)
+    for i := range posts {
+        if err := assignSlug(&posts[i]); err != nil {
+            panic("Could not assign post slugs.")
+        }
+    }
+}
+
+// retrievePostBySlug godoc
+// @Summary Retrieve Post by Slug
+// @Description A former slug of the post redirects to the current one.
+// @Tags posts
+// @Produce json
+// @Param slug path string true "Slug"
+// @Param If-None-Match header string false "ETag of the cached version"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 301
+// @Header 301 {string} Location "Current slug of the post"
+// @Success 304
+// @Failure 404
+// @Router /posts/by-slug/{slug} [get]
+func retrievePostBySlug(context echo.Context) error {
+    var postSlug PostSlug
+    var post Post
+
+    result := sqlClient.Where("slug = ?", context.Param("slug")).First(&postSlug)
+    if result.Error != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+    result = sqlClient.Preload("Author", withDeletedAuthors).Preload("Tags").First(&post, postSlug.PostID)
+    if result.Error != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    // The post is checked first, so that the redirect does not reveal the slugs of the posts which can not be seen
+    if post.HiddenAt != nil || !canViewPost(currentUser(context), &post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+    if post.Slug != postSlug.Slug {
+        return context.Redirect(http.StatusMovedPermanently, "/posts/by-slug/"+url.PathEscape(post.Slug))
+    }
+
+    return sendPost(context, &post)
+}
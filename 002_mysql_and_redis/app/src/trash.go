@@ -0,0 +1,316 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/log"
+    "gorm.io/gorm"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+var (
+    // How long deleted posts and comments stay in the trash before being purged, 0 keeps them for good
+    trashRetention time.Duration
+    // How often the trash is checked for items to purge
+    trashPurgeInterval time.Duration
+)
+
+type (
+    TrashedPost struct {
+        Post
+        DeletedAt time.Time  `json:"deleted_at"`
+        PurgeAt   *time.Time `json:"purge_at,omitempty"`
+    }
+
+    TrashedComment struct {
+        Comment
+        DeletedAt time.Time  `json:"deleted_at"`
+        PurgeAt   *time.Time `json:"purge_at,omitempty"`
+    }
+
+    TrashOut struct {
+        Posts    []TrashedPost    `json:"posts"`
+        Comments []TrashedComment `json:"comments"`
+    }
+)
+
+func setupTrash() {
+    trashRetention = getEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+    trashPurgeInterval = getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour)
+
+    if trashRetention > 0 {
+        go purgeTrashPeriodically()
+    }
+}
+
+func purgeTrashPeriodically() {
+    for {
+        // The purge runs in the background, so a failed one is only logged and tried again next time
+        if err := purgeTrash(); err != nil {
+            log.Error(err)
+        }
+        time.Sleep(trashPurgeInterval)
+    }
+}
+
+// purgeTrash removes for good the items deleted longer than the retention ago. Comments go first, as they refer to
+// their posts, together with the comments left under the purged posts, their revisions, tags and slugs. It all happens
+// in a single transaction, so that a failure does not leave posts behind without their comments or revisions.
+func purgeTrash() error {
+    cutoff := time.Now().Add(-trashRetention)
+
+    return sqlClient.Transaction(func(tx *gorm.DB) error {
+        purgedPosts := tx.Unscoped().Model(&Post{}).Select("id").Where("deleted_at < ?", cutoff)
+
+        err := tx.Unscoped().Where("deleted_at < ? OR post_id IN (?)", cutoff, purgedPosts).Delete(&Comment{}).Error
+        if err != nil {
+            return err
+        }
+        err = tx.Where("post_id IN (?)", purgedPosts).Delete(&PostRevision{}).Error
+        if err != nil {
+            return err
+        }
+        err = tx.Exec("DELETE FROM post_tags WHERE post_id IN (?)", purgedPosts).Error
+        if err != nil {
+            return err
+        }
+        err = tx.Where("post_id IN (?)", purgedPosts).Delete(&PostSlug{}).Error
+        if err != nil {
+            return err
+        }
+        return tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&Post{}).Error
+    })
+}
+
+func purgeTime(deletedAt gorm.DeletedAt) *time.Time {
+    if trashRetention <= 0 {
+        return nil
+    }
+
+    purgeAt := deletedAt.Time.Add(trashRetention)
+    return &purgeAt
+}
+
+// trashPost moves the post to the trash, remembering who did it, as only they and admins can restore it. Its comments
+// go along and come back with it, unlike the ones deleted on their own before. The post is updated first, so that a
+// comment being added at the same time either waits for it or finds the post gone.
+func trashPost(user User, post *Post) error {
+    deletedAt := time.Now()
+
+    return sqlClient.Transaction(func(tx *gorm.DB) error {
+        result := tx.Model(post).
+            UpdateColumns(map[string]interface{}{"deleted_at": deletedAt, "deleted_by_id": user.ID})
+        if result.Error != nil {
+            return result.Error
+        }
+        return tx.Model(&Comment{}).Where("post_id = ?", post.ID).UpdateColumns(map[string]interface{}{
+            "deleted_at":        deletedAt,
+            "deleted_by_id":     user.ID,
+            "deleted_with_post": true,
+        }).Error
+    })
+}
+
+// trashComment moves the comment to the trash, remembering who did it, as only they and admins can restore it.
+func trashComment(user User, comment *Comment) error {
+    return sqlClient.Model(comment).
+        UpdateColumns(map[string]interface{}{"deleted_at": time.Now(), "deleted_by_id": user.ID}).
+        Error
+}
+
+// trashUserContent moves all the posts and comments of the deleted user to the trash, from which only admins can
+// restore them. It stops at the first failure.
+func trashUserContent(user User) error {
+    var posts []Post
+
+    sqlClient.Where("author_id = ?", user.ID).Find(&posts)
+    for i := range posts {
+        if err := trashPost(user, &posts[i]); err != nil {
+            return err
+        }
+    }
+
+    var comments []Comment
+
+    sqlClient.Where("author_id = ?", user.ID).Find(&comments)
+    for i := range comments {
+        if err := trashComment(user, &comments[i]); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func getTrashedPostOrError(context echo.Context) (*Post, int) {
+    var post Post
+
+    id, err := strconv.Atoi(context.Param("id"))
+    if err != nil {
+        return nil, http.StatusBadRequest
+    }
+
+    result := sqlClient.Unscoped().
+        Where("deleted_at IS NOT NULL").
+        Preload("Author", withDeletedAuthors).
+        Preload("Tags").
+        First(&post, id)
+    if result.Error != nil {
+        return nil, http.StatusNotFound
+    }
+
+    return &post, 0
+}
+
+func getTrashedCommentOrError(context echo.Context) (*Comment, int) {
+    var comment Comment
+
+    id, err := strconv.Atoi(context.Param("id"))
+    if err != nil {
+        return nil, http.StatusBadRequest
+    }
+
+    result := sqlClient.Unscoped().
+        Where("deleted_at IS NOT NULL").
+        Preload("Author", withDeletedAuthors).
+        First(&comment, id)
+    if result.Error != nil {
+        return nil, http.StatusNotFound
+    }
+
+    return &comment, 0
+}
+
+// listTrash godoc
+// @Summary List Trash
+// @Description Lists the posts and comments deleted by the current user, which can still be restored.
+// @Tags trash
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} TrashOut
+// @Failure 401
+// @Router /trash [get]
+func listTrash(context echo.Context) error {
+    var posts []Post
+    var comments []Comment
+
+    user := context.Get("User").(User)
+
+    sqlClient.Unscoped().
+        Where("deleted_at IS NOT NULL AND deleted_by_id = ?", user.ID).
+        Order("deleted_at desc").
+        Preload("Author", withDeletedAuthors).
+        Preload("Tags").
+        Find(&posts)
+
+    // The comments deleted together with their post are restored with it, so they are not listed on their own
+    sqlClient.Unscoped().
+        Where("deleted_at IS NOT NULL AND deleted_by_id = ? AND deleted_with_post = ?", user.ID, false).
+        Order("deleted_at desc").
+        Preload("Author", withDeletedAuthors).
+        Preload("Post", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+        Preload("Post.Author", withDeletedAuthors).
+        Find(&comments)
+
+    trashOut := TrashOut{Posts: []TrashedPost{}, Comments: []TrashedComment{}}
+    for _, post := range posts {
+        trashOut.Posts = append(trashOut.Posts, TrashedPost{
+            Post:      post,
+            DeletedAt: post.DeletedAt.Time,
+            PurgeAt:   purgeTime(post.DeletedAt),
+        })
+    }
+    for _, comment := range comments {
+        trashOut.Comments = append(trashOut.Comments, TrashedComment{
+            Comment:   comment,
+            DeletedAt: comment.DeletedAt.Time,
+            PurgeAt:   purgeTime(comment.DeletedAt),
+        })
+    }
+
+    return context.JSON(http.StatusOK, trashOut)
+}
+
+// restorePost godoc
+// @Summary Restore Post from Trash
+// @Tags trash
+// @Produce json
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/restore [post]
+func restorePost(context echo.Context) error {
+    post, err := getTrashedPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canRestorePost(context.Get("User").(User), post) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    restoreErr := sqlClient.Transaction(func(tx *gorm.DB) error {
+        result := tx.Unscoped().Model(post).
+            UpdateColumns(map[string]interface{}{"deleted_at": nil, "deleted_by_id": nil})
+        if result.Error != nil {
+            return result.Error
+        }
+        return tx.Unscoped().Model(&Comment{}).Where("post_id = ? AND deleted_with_post = ?", post.ID, true).
+            UpdateColumns(map[string]interface{}{"deleted_at": nil, "deleted_by_id": nil, "deleted_with_post": false}).
+            Error
+    })
+    if restoreErr != nil {
+        return restoreErr
+    }
+    post.DeletedAt = gorm.DeletedAt{}
+    post.DeletedByID = nil
+    emitAudit(context, AuditPostRestore, postTarget(post))
+
+    return context.JSON(http.StatusOK, post)
+}
+
+// restoreComment godoc
+// @Summary Restore Comment from Trash
+// @Description The post of the comment has to be restored first if it has been deleted as well.
+// @Tags trash
+// @Produce json
+// @Param id path int true "ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} Comment
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 409
+// @Router /comments/{id}/restore [post]
+func restoreComment(context echo.Context) error {
+    comment, err := getTrashedCommentOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canRestoreComment(context.Get("User").(User), comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    result := sqlClient.Preload("Author", withDeletedAuthors).First(&comment.Post, comment.PostID)
+    if result.Error != nil {
+        return context.JSON(http.StatusConflict, "The post of this comment has been deleted.")
+    }
+
+    result = sqlClient.Unscoped().Model(comment).
+        UpdateColumns(map[string]interface{}{"deleted_at": nil, "deleted_by_id": nil})
+    if result.Error != nil {
+        return result.Error
+    }
+    comment.DeletedAt = gorm.DeletedAt{}
+    comment.DeletedByID = nil
+    emitAudit(context, AuditCommentRestore, commentTarget(comment))
+
+    return context.JSON(http.StatusOK, comment)
+}
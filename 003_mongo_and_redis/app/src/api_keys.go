@@ -0,0 +1,241 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/random"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    ScopePostsWrite    = "posts:write"
+    ScopeCommentsWrite = "comments:write"
+    ScopeUsersRead     = "users:read"
+)
+
+// Keys are told apart from session tokens by the prefix, which no session token can start with
+const apiKeyPrefix = "bpk_"
+
+// How often the last use time of a key is written back to the database
+const apiKeyLastUsedResolution = 1 * time.Minute
+
+type (
+    // ApiKey is a long-lived credential for automation clients. Only the hash of the key is stored.
+    ApiKey struct {
+        ID         primitive.ObjectID `bson:"_id"`
+        CreatedAt  time.Time          `bson:"created_at"`
+        UserID     primitive.ObjectID `bson:"user_id"`
+        Name       string             `bson:"name"`
+        KeyHash    string             `bson:"key_hash"`
+        KeyHint    string             `bson:"key_hint"`
+        Scopes     []string           `bson:"scopes"`
+        LastUsedAt *time.Time         `bson:"last_used_at"`
+    }
+
+    ApiKeyIn struct {
+        Name   string   `json:"name" validate:"required,min=3"`
+        Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=posts:write comments:write users:read"`
+    }
+
+    ApiKeyOut struct {
+        ID         primitive.ObjectID `json:"_id"`
+        CreatedAt  time.Time          `json:"created_at"`
+        Name       string             `json:"name"`
+        KeyHint    string             `json:"key_hint"`
+        Scopes     []string           `json:"scopes"`
+        LastUsedAt *time.Time         `json:"last_used_at"`
+        Key        string             `json:"key,omitempty"`
+    }
+)
+
+func (apiKey *ApiKey) hasScope(scope string) bool {
+    for _, s := range apiKey.Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+func (apiKey *ApiKey) out() ApiKeyOut {
+    return ApiKeyOut{
+        ID:         apiKey.ID,
+        CreatedAt:  apiKey.CreatedAt,
+        Name:       apiKey.Name,
+        KeyHint:    apiKey.KeyHint,
+        Scopes:     apiKey.Scopes,
+        LastUsedAt: apiKey.LastUsedAt,
+    }
+}
+
+// checkApiKey authenticates a request made with an API key. Contrary to sessions, the user is always loaded from the
+// database, as keys live much longer than a cached copy could be trusted.
+func checkApiKey(key string, context echo.Context) (bool, error) {
+    var apiKey ApiKey
+    var user User
+
+    err := apiKeysCollection.FindOne(mongoCtx, bson.M{"key_hash": hashToken(key)}).Decode(&apiKey)
+    if err != nil {
+        return false, nil
+    }
+
+    err = usersCollection.FindOne(mongoCtx, bson.M{"_id": apiKey.UserID}).Decode(&user)
+    if err != nil {
+        return false, nil
+    }
+
+    if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) >= apiKeyLastUsedResolution {
+        update := bson.M{"$set": bson.M{"last_used_at": time.Now()}}
+        _, _ = apiKeysCollection.UpdateOne(mongoCtx, bson.M{"_id": apiKey.ID}, update)
+    }
+
+    context.Set("ApiKey", apiKey)
+    context.Set("User", user.withoutSecrets())
+
+    return true, nil
+}
+
+// requireScope returns a middleware rejecting requests made with an API key lacking the scope. Requests authenticated
+// with a session are let through, as sessions carry all the scopes.
+func requireScope(scope string) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(context echo.Context) error {
+            if apiKey, ok := context.Get("ApiKey").(ApiKey); ok && !apiKey.hasScope(scope) {
+                return context.JSON(http.StatusForbidden, "API key lacks the "+scope+" scope.")
+            }
+
+            return next(context)
+        }
+    }
+}
+
+// requireSession is a middleware rejecting requests made with an API key. It guards the endpoints managing the account
+// and its credentials, which only a logged in user can use.
+func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if _, ok := context.Get("ApiKey").(ApiKey); ok {
+            return context.JSON(http.StatusForbidden, "This endpoint can not be used with an API key.")
+        }
+
+        return next(context)
+    }
+}
+
+// listApiKeys godoc
+// @Summary List API Keys of Current User
+// @Tags api-keys
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} ApiKeyOut
+// @Failure 401
+// @Failure 403
+// @Router /api-keys [get]
+func listApiKeys(context echo.Context) error {
+    apiKeysOut := []ApiKeyOut{}
+
+    filter := bson.M{
+        "user_id": context.Get("User").(User).ID,
+    }
+    findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+    cursor, err := apiKeysCollection.Find(mongoCtx, filter, findOptions)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var apiKey ApiKey
+
+        err := cursor.Decode(&apiKey)
+        if err != nil {
+            panic(err)
+        }
+
+        apiKeysOut = append(apiKeysOut, apiKey.out())
+    }
+
+    return context.JSON(http.StatusOK, apiKeysOut)
+}
+
+// createApiKey godoc
+// @Summary Create API Key for Current User
+// @Description The key is returned only in this response.
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param key body ApiKeyIn true "API key"
+// @Success 201 {object} ApiKeyOut
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /api-keys [post]
+func createApiKey(context echo.Context) error {
+    apiKeyIn := new(ApiKeyIn)
+    if err := context.Bind(apiKeyIn); err != nil {
+        return err
+    }
+    if err := context.Validate(apiKeyIn); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    key := apiKeyPrefix + random.String(40, random.Alphanumeric)
+
+    apiKey := new(ApiKey)
+    apiKey.ID = primitive.NewObjectID()
+    apiKey.CreatedAt = time.Now()
+    apiKey.UserID = context.Get("User").(User).ID
+    apiKey.Name = apiKeyIn.Name
+    apiKey.KeyHash = hashToken(key)
+    apiKey.KeyHint = key[:len(apiKeyPrefix)+4]
+    apiKey.Scopes = apiKeyIn.Scopes
+
+    _, err := apiKeysCollection.InsertOne(mongoCtx, apiKey)
+    if err != nil {
+        panic(err)
+    }
+
+    emitAudit(context, AuditApiKeyCreate, AuditTarget{Type: AuditTargetApiKey, ID: apiKey.ID, Name: apiKey.Name})
+
+    apiKeyOut := apiKey.out()
+    apiKeyOut.Key = key
+
+    return context.JSON(http.StatusCreated, apiKeyOut)
+}
+
+// deleteApiKey godoc
+// @Summary Revoke API Key of Current User
+// @Tags api-keys
+// @Param id path string true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /api-keys/{id} [delete]
+func deleteApiKey(context echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(context.Param("id"))
+    if err != nil {
+        return context.NoContent(http.StatusBadRequest)
+    }
+
+    filter := bson.M{
+        "_id":     id,
+        "user_id": context.Get("User").(User).ID,
+    }
+    result, err := apiKeysCollection.DeleteOne(mongoCtx, filter)
+    if err != nil {
+        panic(err)
+    }
+    if result.DeletedCount == 0 {
+        return context.NoContent(http.StatusNotFound)
+    }
+    emitAudit(context, AuditApiKeyDelete, AuditTarget{Type: AuditTargetApiKey, ID: id})
+
+    return context.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+const (
+    AuditLogin          = "auth.login"
+    AuditLoginFailed    = "auth.login_failed"
+    AuditLogout         = "auth.logout"
+    AuditLogoutAll      = "auth.logout_all"
+    AuditUserUpdate     = "user.update"
+    AuditUserDelete     = "user.delete"
+    AuditPasswordReset  = "user.password_reset"
+    AuditTotpEnable     = "user.totp_enable"
+    AuditTotpDisable    = "user.totp_disable"
+    AuditApiKeyCreate   = "api_key.create"
+    AuditApiKeyDelete   = "api_key.delete"
+    AuditPostDelete     = "post.delete"
+    AuditPostHide       = "post.hide"
+    AuditPostUnhide     = "post.unhide"
+    AuditPostRestore    = "post.restore"
+    AuditPostRevert     = "post.revert"
+    AuditCommentDelete  = "comment.delete"
+    AuditCommentHide    = "comment.hide"
+    AuditCommentUnhide  = "comment.unhide"
+    AuditCommentRestore = "comment.restore"
+    AuditModeration     = "moderation."
+    AuditRoleChange     = "admin.role_change"
+    AuditSuspend        = "admin.suspend"
+    AuditLiftSuspension = "admin.lift_suspension"
+    AuditRevokeSessions = "admin.revoke_sessions"
+    AuditImpersonate    = "admin.impersonate"
+
+    AuditTargetUser    = "user"
+    AuditTargetPost    = "post"
+    AuditTargetComment = "comment"
+    AuditTargetApiKey  = "api_key"
+)
+
+// How many events are returned at most by a single request
+const auditMaxLimit = 1000
+
+type (
+    // AuditEvent records who did what to which object. Events are only ever inserted, the application has no way of
+    // changing or removing them. Names are copied, so that events stay readable once the objects are gone.
+    AuditEvent struct {
+        ID             primitive.ObjectID  `bson:"_id" json:"_id"`
+        CreatedAt      time.Time           `bson:"created_at" json:"created_at"`
+        ActorID        *primitive.ObjectID `bson:"actor_id" json:"actor_id"`
+        ActorName      string              `bson:"actor_name" json:"actor_name"`
+        // Name of the admin acting on behalf of the actor within an impersonated session
+        ImpersonatedBy string              `bson:"impersonated_by,omitempty" json:"impersonated_by,omitempty"`
+        Action         string              `bson:"action" json:"action"`
+        TargetType     string              `bson:"target_type" json:"target_type"`
+        TargetID       *primitive.ObjectID `bson:"target_id" json:"target_id"`
+        TargetName     string              `bson:"target_name" json:"target_name"`
+        ClientIP       string              `bson:"client_ip" json:"client_ip"`
+        UserAgent      string              `bson:"user_agent" json:"user_agent"`
+    }
+
+    AuditTarget struct {
+        Type string
+        ID   primitive.ObjectID
+        Name string
+    }
+)
+
+func userTarget(user User) AuditTarget {
+    return AuditTarget{Type: AuditTargetUser, ID: user.ID, Name: user.Name}
+}
+
+func postTarget(post *Post) AuditTarget {
+    return AuditTarget{Type: AuditTargetPost, ID: post.ID, Name: post.Title}
+}
+
+func commentTarget(comment *Comment) AuditTarget {
+    return AuditTarget{Type: AuditTargetComment, ID: comment.ID}
+}
+
+// emitAudit records the action of the authenticated user, if there is one.
+func emitAudit(context echo.Context, action string, target AuditTarget) {
+    var actor *User
+
+    if user, ok := context.Get("User").(User); ok {
+        actor = &user
+    }
+
+    emitAuditAs(context, actor, action, target)
+}
+
+// emitAuditAs records the action of the given actor, which may be nil for anonymous requests. Failing to record the
+// event does not fail the request, which has already taken effect.
+func emitAuditAs(context echo.Context, actor *User, action string, target AuditTarget) {
+    event := new(AuditEvent)
+    event.ID = primitive.NewObjectID()
+    event.CreatedAt = time.Now()
+    event.Action = action
+    event.TargetType = target.Type
+    event.TargetName = target.Name
+    event.ClientIP = context.RealIP()
+    event.UserAgent = context.Request().UserAgent()
+
+    if actor != nil {
+        event.ActorID = &actor.ID
+        event.ActorName = actor.Name
+    }
+    if session, ok := context.Get("Session").(Session); ok {
+        event.ImpersonatedBy = session.ImpersonatedBy
+    }
+    if !target.ID.IsZero() {
+        event.TargetID = &target.ID
+    }
+    if len(event.UserAgent) > 255 {
+        event.UserAgent = event.UserAgent[:255]
+    }
+
+    _, err := auditEventsCollection.InsertOne(mongoCtx, event)
+    if err != nil {
+        context.Logger().Error(err)
+    }
+}
+
+// listAuditEvents godoc
+// @Summary List Audit Events
+// @Description Events are ordered from the newest. Times are given in RFC 3339.
+// @Tags admin
+// @Produce json
+// @Param from query string false "Since"
+// @Param to query string false "Until"
+// @Param actor_id query string false "Actor ID"
+// @Param action query string false "Action"
+// @Param target_type query string false "Target type"
+// @Param target_id query string false "Target ID"
+// @Param limit query int false "Limit"
+// @Security ApiKeyAuth
+// @Success 200 {array} AuditEvent
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /admin/audit [get]
+func listAuditEvents(context echo.Context) error {
+    events := []AuditEvent{}
+    filter := bson.M{}
+
+    createdAt := bson.M{}
+    for param, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+        if value := context.QueryParam(param); value != "" {
+            t, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return context.JSON(http.StatusBadRequest, "Provided "+param+" time is invalid.")
+            }
+            createdAt[operator] = t
+        }
+    }
+    if len(createdAt) > 0 {
+        filter["created_at"] = createdAt
+    }
+    for _, param := range []string{"actor_id", "target_id"} {
+        if value := context.QueryParam(param); value != "" {
+            id, err := primitive.ObjectIDFromHex(value)
+            if err != nil {
+                return context.NoContent(http.StatusBadRequest)
+            }
+            filter[param] = id
+        }
+    }
+    for _, param := range []string{"action", "target_type"} {
+        if value := context.QueryParam(param); value != "" {
+            filter[param] = value
+        }
+    }
+
+    limit := 100
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > auditMaxLimit {
+            return context.JSON(http.StatusBadRequest, "Provided limit is invalid.")
+        }
+        limit = number
+    }
+
+    findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit))
+    cursor, err := auditEventsCollection.Find(mongoCtx, filter, findOptions)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var event AuditEvent
+
+        err := cursor.Decode(&event)
+        if err != nil {
+            panic(err)
+        }
+
+        events = append(events, event)
+    }
+
+    return context.JSON(http.StatusOK, events)
+}
@@ -1,50 +1,155 @@
 package main
 
 import (
-    "encoding/json"
     "github.com/labstack/echo/v4"
-    "github.com/labstack/gommon/random"
     "go.mongodb.org/mongo-driver/bson"
-    "golang.org/x/crypto/bcrypt"
     "net/http"
+    "os"
+    "strings"
     "time"
 )
 
-func hashAndSalt(pwd string) (string, error) {
-    bytePwd := []byte(pwd)
-    hash, err := bcrypt.GenerateFromPassword(bytePwd, bcrypt.MinCost)
-    if err != nil {
-        return "", err
+const (
+    AuthModeOpaque = "opaque"
+    AuthModeJWT    = "jwt"
+)
+
+var (
+    authMode           string
+    jwtSecret          []byte
+    jwtAccessTokenTTL  time.Duration
+    sessionIdleTimeout time.Duration
+    sessionMaxLifetime time.Duration
+)
+
+type (
+    TokenOut struct {
+        AccessToken           string     `json:"access_token"`
+        TokenType             string     `json:"token_type"`
+        ExpiresAt             time.Time  `json:"expires_at"`
+        RefreshToken          string     `json:"refresh_token,omitempty"`
+        RefreshTokenExpiresAt *time.Time `json:"refresh_token_expires_at,omitempty"`
+    }
+)
+
+func setupAuth() {
+    authMode = os.Getenv("BP_AUTH_MODE")
+    if authMode == "" {
+        authMode = AuthModeOpaque
+    }
+    if authMode != AuthModeOpaque && authMode != AuthModeJWT {
+        panic("Unknown authentication mode.")
+    }
+
+    if authMode == AuthModeJWT {
+        jwtSecret = []byte(os.Getenv("BP_JWT_SECRET"))
+        if len(jwtSecret) < 32 {
+            panic("JWT secret has to be at least 32 bytes long.")
+        }
+    }
+
+    jwtAccessTokenTTL = getEnvDuration("BP_JWT_ACCESS_TOKEN_TTL", 15 * time.Minute)
+    sessionIdleTimeout = getEnvDuration("BP_SESSION_IDLE_TIMEOUT", 1 * time.Hour)
+    sessionMaxLifetime = getEnvDuration("BP_SESSION_MAX_LIFETIME", 30 * 24 * time.Hour)
+    if sessionIdleTimeout <= 0 || sessionMaxLifetime <= 0 {
+        panic("Session timeouts have to be positive.")
     }
-    return string(hash), nil
 }
 
-func comparePasswords(hashedPwd string, plainPwd string) bool {
-    byteHashedPwd := []byte(hashedPwd)
-    bytePlainPwd := []byte(plainPwd)
-    err := bcrypt.CompareHashAndPassword(byteHashedPwd, bytePlainPwd)
-    return err == nil
+// respondWithTokens returns the token of a newly created session. In the JWT mode the token is the refresh token, and
+// an access token is issued along with it.
+func respondWithTokens(context echo.Context, token string, session *Session) error {
+    tokenOut := TokenOut{TokenType: "Bearer"}
+    expiresAt := time.Now().Add(sessionExpiration(session))
+
+    if authMode == AuthModeJWT {
+        tokenOut.AccessToken, tokenOut.ExpiresAt = signAccessToken(session)
+        tokenOut.RefreshToken = token
+        tokenOut.RefreshTokenExpiresAt = &expiresAt
+    } else {
+        tokenOut.AccessToken = token
+        tokenOut.ExpiresAt = expiresAt
+    }
+
+    return context.JSON(http.StatusCreated, tokenOut)
 }
 
+// checkAuthToken authenticates the request with an API key, an access token or a session token, whichever it carries.
+// Suspended users are turned away regardless of the credential, as the copies of the user cached in sessions and
+// access tokens do not reflect the suspension, and so are the access tokens of revoked sessions.
 func checkAuthToken(token string, context echo.Context) (bool, error) {
-    var userObj User
-    var userJson string
+    var ok bool
     var err error
 
-    userJson, err = redisClient.Get(redisCtx, token).Result()
-    if err != nil {
+    if strings.HasPrefix(token, apiKeyPrefix) {
+        ok, err = checkApiKey(token, context)
+    } else if authMode == AuthModeJWT {
+        ok, err = checkAccessToken(token, context)
+    } else {
+        ok, err = checkSessionToken(token, context)
+    }
+    if !ok || err != nil {
+        return ok, err
+    }
+
+    if isAccessRevoked(context) {
         return false, nil
     }
 
-    _ = redisClient.Expire(redisCtx, token, 1 * time.Hour).Err()
+    return true, nil
+}
+
+// isAccessRevoked tells whether the user has been suspended or, in the JWT mode, the session of the access token
+// revoked. Both markers are looked up with a single call to Redis. As this happens on every authenticated request, a
+// failure of Redis is only logged and lets the request through rather than failing them all; logging in and refreshing
+// tokens still check the suspension in the database.
+func isAccessRevoked(context echo.Context) bool {
+    keys := []string{suspendedUserKey(context.Get("User").(User).ID)}
+    if session, ok := context.Get("Session").(Session); ok && authMode == AuthModeJWT {
+        keys = append(keys, revokedSessionKey(session.ID))
+    }
 
-    err = json.Unmarshal([]byte(userJson), &userObj)
+    count, err := redisClient.Exists(redisCtx, keys...).Result()
     if err != nil {
-        panic(err)
+        context.Logger().Error(err)
+        return false
+    }
+    return count > 0
+}
+
+// checkSessionToken verifies an opaque session token against Redis.
+func checkSessionToken(token string, context echo.Context) (bool, error) {
+    session, ok := getSession(token)
+    if !ok {
+        return false, nil
+    }
+
+    // The idle timeout slides with every use, but never past the maximum lifetime of the session
+    expiration := sessionExpiration(session)
+    if expiration <= 0 {
+        revokeSession(token, session)
+        return false, nil
+    }
+
+    _ = redisClient.Expire(redisCtx, token, expiration).Err()
+    touchSession(token, session)
+
+    context.Set("Session", *session)
+    context.Set("User", session.User)
+
+    return true, nil
+}
+
+// checkAccessToken verifies a JWT access token without reaching Redis, which is left to checkAuthToken. The session is
+// only partially known here, as the token carries just its ID and the user.
+func checkAccessToken(accessToken string, context echo.Context) (bool, error) {
+    claims, ok := parseAccessToken(accessToken)
+    if !ok {
+        return false, nil
     }
 
-    context.Set("token", token)
-    context.Set("User", userObj)
+    context.Set("Session", Session{ID: claims.SessionID, User: claims.User, ImpersonatedBy: claims.ImpersonatedBy})
+    context.Set("User", claims.User)
 
     return true, nil
 }
@@ -53,42 +158,65 @@ func checkAuthToken(token string, context echo.Context) (bool, error) {
 // @Summary Issue Auth Token / Login
 // @Tags auth
 // @Accept mpfd
-// @Produce plain
+// @Produce json
 // @Param name formData string true "Name"
 // @Param password formData string true "Password"
-// @Success 201
+// @Success 201 {object} TokenOut
+// @Success 202 {object} MfaChallengeOut
 // @Failure 401
+// @Failure 403 {object} SuspensionOut
+// @Failure 429
 // @Failure 500
 // @Router /token [post]
 func issueAuthToken(context echo.Context) error {
     var userObj User
-    var userJson []byte
     var err error
 
     name := context.FormValue("name")
-    filter := bson.D{{"name", name}}
+    if retryAfter, locked := checkLoginLockout(context, name); locked {
+        return respondWithLockout(context, retryAfter)
+    }
+
+    filter := bson.D{{Key: "name", Value: name}}
     err = mongoDatabase.Collection("users").FindOne(mongoCtx, filter).Decode(&userObj)
     if err != nil {
+        registerLoginFailure(context, name)
+        emitAuditAs(context, nil, AuditLoginFailed, AuditTarget{Type: AuditTargetUser, Name: name})
         return context.NoContent(http.StatusUnauthorized)
     }
 
-    if !comparePasswords(userObj.PasswordHash, context.FormValue("password")) {
+    password := context.FormValue("password")
+    if !comparePasswords(userObj.PasswordHash, password) {
+        registerLoginFailure(context, name)
+        emitAuditAs(context, nil, AuditLoginFailed, userTarget(userObj))
         return context.NoContent(http.StatusUnauthorized)
     }
 
-    token := random.String(32, random.Alphanumeric)
+    // The reason is revealed only to someone who knows the password
+    if userObj.suspended() {
+        return respondWithSuspension(context, userObj)
+    }
 
-    userJson, err = json.Marshal(userObj)
-    if err != nil {
-        panic(err)
+    // Hashes created with an outdated algorithm or cost are replaced while the plain password is at hand
+    if passwordNeedsRehash(userObj.PasswordHash) {
+        if hashedPassword, err := hashAndSalt(password); err == nil {
+            userObj.PasswordHash = hashedPassword
+            update := bson.M{"$set": bson.M{"password_hash": hashedPassword}}
+            _, _ = usersCollection.UpdateOne(mongoCtx, bson.M{"_id": userObj.ID}, update)
+        }
     }
 
-    err = redisClient.Set(redisCtx, token, string(userJson), 1 * time.Hour).Err()
-    if err != nil {
-        panic(err)
+    // The failures are cleared only once the second factor is checked as well
+    if userObj.TotpEnabled {
+        return respondWithMfaChallenge(context, userObj)
     }
 
-    return context.String(http.StatusCreated, token)
+    clearLoginFailures(name)
+
+    token, session := createSession(context, userObj)
+    emitAuditAs(context, &userObj, AuditLogin, userTarget(userObj))
+
+    return respondWithTokens(context, token, session)
 }
 
 // revokeAuthToken godoc
@@ -98,7 +226,19 @@ func issueAuthToken(context echo.Context) error {
 // @Success 204
 // @Router /token [delete]
 func revokeAuthToken(context echo.Context) error {
-    token := context.Get("token").(string)
-    redisClient.Del(redisCtx, token)
+    revokeUserSession(context.Get("User").(User), context.Get("Session").(Session).ID)
+    emitAudit(context, AuditLogout, userTarget(context.Get("User").(User)))
+    return context.NoContent(http.StatusNoContent)
+}
+
+// revokeAllAuthTokens godoc
+// @Summary Revoke All Auth Tokens / Logout Current User Everywhere
+// @Tags auth
+// @Security ApiKeyAuth
+// @Success 204
+// @Router /token/all [delete]
+func revokeAllAuthTokens(context echo.Context) error {
+    revokeUserSessions(context.Get("User").(User), "")
+    emitAudit(context, AuditLogoutAll, userTarget(context.Get("User").(User)))
     return context.NoContent(http.StatusNoContent)
 }
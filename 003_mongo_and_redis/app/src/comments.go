@@ -4,6 +4,7 @@ import (
     "github.com/labstack/echo/v4"
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
     "net/http"
     "strings"
     "time"
@@ -11,11 +12,14 @@ import (
 
 type (
     Comment struct {
-        ID        primitive.ObjectID `bson:"_id" json:"_id"`
-        CreatedAt time.Time          `bson:"created_at" json:"created_at"`
-        UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
-        Author    User               `bson:"author" json:"author"`
-        Content   string             `bson:"content" json:"content"`
+        ID              primitive.ObjectID `bson:"_id" json:"_id"`
+        CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+        UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
+        Author          User               `bson:"author" json:"author"`
+        Content         string             `bson:"content" json:"content"`
+        HiddenAt        *time.Time         `bson:"hidden_at" json:"hidden_at,omitempty"`
+        // Whether the comment has been hidden by reaching the report threshold rather than by a moderator
+        HiddenByReports bool               `bson:"hidden_by_reports" json:"-"`
     }
 
     CommentIn struct {
@@ -23,6 +27,44 @@ type (
     }
 )
 
+// findComment fetches the comment embedded in the post, leaving out the rest of the post.
+func findComment(postID primitive.ObjectID, commentID primitive.ObjectID) (*Comment, bool) {
+    var post Post
+
+    filter := bson.M{
+        "_id": postID,
+        "comments._id": commentID,
+    }
+    findOptions := options.FindOne().SetProjection(bson.M{"comments.$": 1})
+    err := postsCollection.FindOne(mongoCtx, filter, findOptions).Decode(&post)
+    if err != nil || len(post.Comments) != 1 {
+        return nil, false
+    }
+
+    return &post.Comments[0], true
+}
+
+// getCommentOrError fetches the comment embedded in the post, so that it can be checked against the policy before
+// being modified.
+func getCommentOrError(context echo.Context) (*Comment, int) {
+    postID, err := primitive.ObjectIDFromHex(context.Param("post_id"))
+    if err != nil {
+        return nil, http.StatusBadRequest
+    }
+
+    commentID, err := primitive.ObjectIDFromHex(context.Param("comment_id"))
+    if err != nil {
+        return nil, http.StatusBadRequest
+    }
+
+    comment, ok := findComment(postID, commentID)
+    if !ok {
+        return nil, http.StatusNotFound
+    }
+
+    return comment, 0
+}
+
 // createComment godoc
 // @Summary Create Comment
 // @Tags comments
@@ -60,9 +102,13 @@ func createComment(context echo.Context) error {
         return context.NoContent(http.StatusBadRequest)
     }
 
-    // Prepare and execute query
+    // Prepare and execute query, only the posts visible to the user can be commented on
     filter := bson.M{
         "_id": postID,
+        "$or": []bson.M{
+            {"status": bson.M{"$in": []string{PostPublished, PostUnlisted}}},
+            {"author._id": comment.Author.ID},
+        },
     }
     update := bson.M{
         "$push": bson.M{
@@ -87,26 +133,77 @@ func createComment(context echo.Context) error {
 // @Param post_id path string true "Post ID"
 // @Param comment_id path string true "Comment ID"
 // @Param comment body CommentIn true "Comment"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 200 {object} Comment
+// @Header 200 {string} ETag "Version of the resource"
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /posts/{post_id}/comments/{comment_id} [put]
 func updateComment(context echo.Context) error {
+    return editComment(context, false)
+}
+
+// patchComment godoc
+// @Summary Patch Comment
+// @Description Changes only the fields present in the JSON merge patch (RFC 7396).
+// @Tags comments
+// @Accept json
+// @Produce json
+// @Param post_id path string true "Post ID"
+// @Param comment_id path string true "Comment ID"
+// @Param comment body CommentIn true "Comment"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Security ApiKeyAuth
+// @Success 200 {object} Comment
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 412
+// @Router /posts/{post_id}/comments/{comment_id} [patch]
+func patchComment(context echo.Context) error {
+    return editComment(context, true)
+}
+
+// editComment replaces the content of the comment with the one in the request, or with the merge patch sent with
+// PATCH applied to it.
+func editComment(context echo.Context, patch bool) error {
+    comment, code := getCommentOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    if !canUpdateComment(context.Get("User").(User), comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+    if !ifMatch(context, etag(comment.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
     // Validate data and prepare final Comment object
     commentIn := new(CommentIn)
-    comment := new(Comment)
 
-    if err := context.Bind(commentIn); err != nil {
-        return err
-    }
+    if patch {
+        commentIn.Content = comment.Content
+        if err := bindMergePatch(context, commentIn); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
+    } else {
+        if err := context.Bind(commentIn); err != nil {
+            return err
+        }
 
-    if err := context.Validate(commentIn); err != nil {
-        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        if err := context.Validate(commentIn); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
     }
 
+    updatedAt := comment.UpdatedAt
     comment.UpdatedAt = time.Now()
     comment.Content = commentIn.Content
 
@@ -121,10 +218,15 @@ func updateComment(context echo.Context) error {
         return context.NoContent(http.StatusBadRequest)
     }
 
-    // Prepare and execute query
+    // Prepare and execute query, the comment is written only if nobody has changed it since it has been read
     filter := bson.M{
         "_id": postID,
-        "comments._id": commentID,
+        "comments": bson.M{
+            "$elemMatch": bson.M{
+                "_id": commentID,
+                "updated_at": updatedAt,
+            },
+        },
     }
     update := bson.M{
         "$set": bson.M{
@@ -136,8 +238,9 @@ func updateComment(context echo.Context) error {
     if err != nil {
         panic(err)
     } else if result.MatchedCount != 1 {
-        return context.NoContent(http.StatusNotFound)
+        return context.NoContent(http.StatusPreconditionFailed)
     } else {
+        setETag(context, etag(comment.UpdatedAt))
         return context.NoContent(http.StatusOK)
     }
 }
@@ -147,40 +250,92 @@ func updateComment(context echo.Context) error {
 // @Tags comments
 // @Param post_id path string true "Post ID"
 // @Param comment_id path string true "Comment ID"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 204
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /posts/{post_id}/comments/{comment_id} [delete]
 func deleteComment(context echo.Context) error {
-    // Retrieve Post ID and Comment ID
-    postID, err := primitive.ObjectIDFromHex(context.Param("post_id"))
-    if err != nil {
-        return context.NoContent(http.StatusBadRequest)
+    comment, code := getCommentOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
     }
 
-    commentID, err := primitive.ObjectIDFromHex(context.Param("comment_id"))
-    if err != nil {
-        return context.NoContent(http.StatusBadRequest)
+    user := context.Get("User").(User)
+    if !canDeleteComment(user, comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+    if !ifMatch(context, etag(comment.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
     }
 
-    // Prepare and execute query
-    filter := bson.M{
-        "_id": postID,
+    postID, _ := primitive.ObjectIDFromHex(context.Param("post_id"))
+
+    if !trashComment(user, postID, comment) {
+        return context.NoContent(http.StatusNotFound)
     }
-    update := bson.M{
-        "$pull": bson.M{
-            "comments": bson.M{"_id": commentID},
-        },
+    emitAudit(context, AuditCommentDelete, commentTarget(comment))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// setCommentHidden marks the comment as hidden at the given time, or as visible again when it is nil.
+func setCommentHidden(context echo.Context, hiddenAt *time.Time) error {
+    comment, code := getCommentOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
     }
-    result, err := postsCollection.UpdateOne(mongoCtx, filter, update)
-    if err != nil {
-        panic(err)
-    } else if result.MatchedCount != 1 || result.ModifiedCount != 1 {
-        return context.NoContent(http.StatusNotFound)
+
+    if !canHideComment(context.Get("User").(User), comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    postID, _ := primitive.ObjectIDFromHex(context.Param("post_id"))
+
+    updateCommentHiddenAt(postID, comment.ID, nil, hiddenAt, false)
+
+    if hiddenAt != nil {
+        emitAudit(context, AuditCommentHide, commentTarget(comment))
     } else {
-        return context.NoContent(http.StatusNoContent)
+        emitAudit(context, AuditCommentUnhide, commentTarget(comment))
     }
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// hideComment godoc
+// @Summary Hide Comment
+// @Tags comments
+// @Param post_id path string true "Post ID"
+// @Param comment_id path string true "Comment ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{post_id}/comments/{comment_id}/hide [post]
+func hideComment(context echo.Context) error {
+    hiddenAt := time.Now()
+    return setCommentHidden(context, &hiddenAt)
+}
+
+// unhideComment godoc
+// @Summary Unhide Comment
+// @Tags comments
+// @Param post_id path string true "Post ID"
+// @Param comment_id path string true "Comment ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{post_id}/comments/{comment_id}/unhide [post]
+func unhideComment(context echo.Context) error {
+    return setCommentHidden(context, nil)
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/random"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+type (
+    // EmailVerification is stored in Redis under the hash of the token sent to the address being verified.
+    EmailVerification struct {
+        UserID primitive.ObjectID `json:"user_id"`
+        Email  string             `json:"email"`
+    }
+
+    EmailVerificationConfirm struct {
+        Token string `json:"token" validate:"required"`
+    }
+)
+
+// Minimal interval between two verification emails sent to the same account
+const emailVerificationThrottle = 1 * time.Minute
+
+var (
+    emailVerificationTTL time.Duration
+    requireVerifiedEmail bool
+)
+
+func setupEmailVerification() {
+    emailVerificationTTL = getEnvDuration("BP_EMAIL_VERIFICATION_TTL", 24 * time.Hour)
+    requireVerifiedEmail = os.Getenv("BP_REQUIRE_VERIFIED_EMAIL") == "true"
+}
+
+func emailVerificationKey(token string) string {
+    return "email_verification:" + hashToken(token)
+}
+
+func emailVerificationThrottleKey(userID primitive.ObjectID) string {
+    return fmt.Sprintf("email_verification_throttle:%v", userID.Hex())
+}
+
+// sendEmailVerification mails a verification link for the address to it. The address is either the current, not yet
+// verified, email of the user or the one they are changing it to.
+func sendEmailVerification(context echo.Context, user User, email string) {
+    token := random.String(32, random.Alphanumeric)
+
+    verificationJson, err := json.Marshal(EmailVerification{UserID: user.ID, Email: email})
+    if err != nil {
+        panic(err)
+    }
+
+    err = redisClient.Set(redisCtx, emailVerificationKey(token), string(verificationJson), emailVerificationTTL).Err()
+    if err != nil {
+        panic(err)
+    }
+
+    err = redisClient.Set(redisCtx, emailVerificationThrottleKey(user.ID), 1, emailVerificationThrottle).Err()
+    if err != nil {
+        panic(err)
+    }
+
+    body := fmt.Sprintf(
+        "Hello %v,\n\nTo confirm that %v is your email address, follow the link below within %v:\n\n"+
+            "%v/email-verification?token=%v\n\nIf it was not you, just ignore this message.",
+        user.Name, email, emailVerificationTTL, appBaseURL, token,
+    )
+    if err := mailer.Send(email, "Email address verification", body); err != nil {
+        context.Logger().Error(err)
+    }
+}
+
+// checkVerifiedEmail is a middleware rejecting users whose email address has not been verified yet. It lets everyone
+// through unless BP_REQUIRE_VERIFIED_EMAIL is enabled.
+func checkVerifiedEmail(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if requireVerifiedEmail && context.Get("User").(User).EmailVerifiedAt == nil {
+            return context.JSON(http.StatusForbidden, "Email address has to be verified first.")
+        }
+
+        return next(context)
+    }
+}
+
+// resendEmailVerification godoc
+// @Summary Resend Email Verification of Current User
+// @Tags email-verification
+// @Security ApiKeyAuth
+// @Success 202
+// @Failure 400
+// @Failure 401
+// @Failure 429
+// @Router /email-verification [post]
+func resendEmailVerification(context echo.Context) error {
+    var user User
+
+    // The cached copy of the user may be outdated, so the pending email is read from the database
+    err := usersCollection.FindOne(mongoCtx, bson.M{"_id": context.Get("User").(User).ID}).Decode(&user)
+    if err != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    email := user.PendingEmail
+    if email == "" && user.EmailVerifiedAt == nil {
+        email = user.Email
+    }
+    if email == "" {
+        return context.JSON(http.StatusBadRequest, "Email address is already verified.")
+    }
+
+    ttl, err := redisClient.TTL(redisCtx, emailVerificationThrottleKey(user.ID)).Result()
+    if err != nil {
+        panic(err)
+    }
+    if ttl > 0 {
+        return respondWithLockout(context, ttl)
+    }
+
+    sendEmailVerification(context, user, email)
+
+    return context.NoContent(http.StatusAccepted)
+}
+
+// confirmEmailVerification godoc
+// @Summary Confirm Email Verification
+// @Tags email-verification
+// @Accept json
+// @Produce json
+// @Param confirmation body EmailVerificationConfirm true "Confirmation"
+// @Success 200 {object} User
+// @Failure 400
+// @Router /email-verification/confirm [post]
+func confirmEmailVerification(context echo.Context) error {
+    var user User
+    var verification EmailVerification
+
+    emailVerificationConfirm := new(EmailVerificationConfirm)
+    if err := context.Bind(emailVerificationConfirm); err != nil {
+        return err
+    }
+    if err := context.Validate(emailVerificationConfirm); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    verificationJson, ok := consumeOneTimeToken(emailVerificationKey(emailVerificationConfirm.Token))
+    if !ok {
+        return context.JSON(http.StatusBadRequest, "Provided token is invalid or has expired.")
+    }
+
+    err := json.Unmarshal([]byte(verificationJson), &verification)
+    if err != nil {
+        panic(err)
+    }
+
+    err = usersCollection.FindOne(mongoCtx, bson.M{"_id": verification.UserID}).Decode(&user)
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, "Provided token is invalid or has expired.")
+    }
+
+    // A token sent to an address the user has given up in the meantime is not valid anymore
+    if verification.Email != user.PendingEmail && verification.Email != user.Email {
+        return context.JSON(http.StatusBadRequest, "Provided token is invalid or has expired.")
+    }
+
+    verifiedAt := time.Now()
+    user.Email = verification.Email
+    user.PendingEmail = ""
+    user.EmailVerifiedAt = &verifiedAt
+
+    filter := bson.M{
+        "_id": user.ID,
+    }
+    update := bson.M{
+        "$set": bson.M{
+            "email":             user.Email,
+            "pending_email":     user.PendingEmail,
+            "email_verified_at": user.EmailVerifiedAt,
+        },
+    }
+    _, err = usersCollection.UpdateOne(mongoCtx, filter, update)
+    if err != nil {
+        if strings.Contains(err.Error(), "E11000") {
+            return context.JSON(http.StatusBadRequest, "User with provided email already exists.")
+        }
+        panic(err)
+    }
+
+    updateUserSessions(user)
+
+    return context.JSON(http.StatusOK, user)
+}
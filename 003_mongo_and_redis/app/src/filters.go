@@ -0,0 +1,62 @@
+package main
+
+import (
+    "errors"
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "regexp"
+    "strings"
+    "time"
+)
+
+type timeFilter struct {
+    Field    string
+    Operator string
+}
+
+// Filters by time, whose values are given in RFC 3339
+var timeFilters = map[string]timeFilter{
+    "created_after":  {Field: "created_at", Operator: "$gt"},
+    "created_before": {Field: "created_at", Operator: "$lt"},
+    "updated_after":  {Field: "updated_at", Operator: "$gt"},
+}
+
+// filterByTime narrows the listing down to the items created or updated within the requested times.
+func filterByTime(context echo.Context, filters []bson.M) ([]bson.M, error) {
+    for param, filter := range timeFilters {
+        if value := context.QueryParam(param); value != "" {
+            t, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return nil, errors.New("Provided " + param + " time is invalid.")
+            }
+            filters = append(filters, bson.M{
+                filter.Field: bson.M{filter.Operator: t},
+            })
+        }
+    }
+
+    return filters, nil
+}
+
+// getIDsParam reads the IDs given in the parameter, either as a comma-separated list or by repeating the parameter.
+func getIDsParam(context echo.Context, param string) ([]primitive.ObjectID, error) {
+    var ids []primitive.ObjectID
+
+    for _, value := range context.QueryParams()[param] {
+        for _, part := range strings.Split(value, ",") {
+            id, err := primitive.ObjectIDFromHex(strings.TrimSpace(part))
+            if err != nil {
+                return nil, errors.New("Provided " + param + " is invalid.")
+            }
+            ids = append(ids, id)
+        }
+    }
+
+    return ids, nil
+}
+
+// prefixRegex returns the regular expression matching the values starting with the prefix, which is matched literally.
+func prefixRegex(prefix string) primitive.Regex {
+    return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}
+}
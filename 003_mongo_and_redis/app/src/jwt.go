@@ -0,0 +1,147 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/dgrijalva/jwt-go"
+    "github.com/go-redis/redis/v8"
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "net/http"
+    "time"
+)
+
+type (
+    AccessTokenClaims struct {
+        jwt.StandardClaims
+        SessionID      string `json:"sid"`
+        User           User   `json:"user"`
+        ImpersonatedBy string `json:"impersonated_by,omitempty"`
+    }
+)
+
+func usedRefreshTokenKey(token string) string {
+    return "used_refresh_token:" + token
+}
+
+func signAccessToken(session *Session) (string, time.Time) {
+    expiresAt := time.Now().Add(jwtAccessTokenTTL)
+
+    claims := AccessTokenClaims{
+        StandardClaims: jwt.StandardClaims{
+            Subject:   session.User.ID.Hex(),
+            IssuedAt:  time.Now().Unix(),
+            ExpiresAt: expiresAt.Unix(),
+        },
+        SessionID:      session.ID,
+        User:           session.User,
+        ImpersonatedBy: session.ImpersonatedBy,
+    }
+
+    accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+    if err != nil {
+        panic(err)
+    }
+
+    return accessToken, expiresAt
+}
+
+func parseAccessToken(accessToken string) (*AccessTokenClaims, bool) {
+    claims := new(AccessTokenClaims)
+
+    token, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        }
+        return jwtSecret, nil
+    })
+    if err != nil || !token.Valid {
+        return nil, false
+    }
+
+    return claims, true
+}
+
+// detectRefreshTokenReuse revokes the whole session when a refresh token which has already been rotated is presented
+// again, as it means that either the client or an attacker holds a stolen copy of it.
+func detectRefreshTokenReuse(refreshToken string) {
+    var session Session
+
+    sessionJson, err := redisClient.Get(redisCtx, usedRefreshTokenKey(refreshToken)).Result()
+    if err != nil {
+        return
+    }
+
+    err = json.Unmarshal([]byte(sessionJson), &session)
+    if err != nil {
+        panic(err)
+    }
+
+    revokeUserSession(session.User, session.ID)
+}
+
+// refreshAuthToken godoc
+// @Summary Refresh Auth Tokens
+// @Tags auth
+// @Accept mpfd
+// @Produce json
+// @Param refresh_token formData string true "Refresh Token"
+// @Success 201 {object} TokenOut
+// @Failure 401
+// @Failure 500
+// @Router /token/refresh [post]
+func refreshAuthToken(context echo.Context) error {
+    var session Session
+    var getCmd *redis.StringCmd
+    var delCmd *redis.IntCmd
+    var userObj User
+
+    refreshToken := context.FormValue("refresh_token")
+    key := sessionKey(refreshToken)
+
+    // Only the request which actually deletes the refresh token is allowed to rotate it
+    _, err := redisClient.TxPipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        getCmd = pipe.Get(redisCtx, key)
+        delCmd = pipe.Del(redisCtx, key)
+        return nil
+    })
+    if err != nil && err != redis.Nil {
+        panic(err)
+    }
+
+    if delCmd.Val() != 1 {
+        detectRefreshTokenReuse(refreshToken)
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    err = json.Unmarshal([]byte(getCmd.Val()), &session)
+    if err != nil {
+        panic(err)
+    }
+
+    _, err = redisClient.TxPipelined(redisCtx, func(pipe redis.Pipeliner) error {
+        pipe.Set(redisCtx, usedRefreshTokenKey(refreshToken), getCmd.Val(), sessionMaxLifetime)
+        pipe.SRem(redisCtx, userSessionsKey(session.User.ID), key)
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    // The user is reloaded, so the new access token never carries stale data
+    err = usersCollection.FindOne(mongoCtx, bson.M{"_id": session.User.ID}).Decode(&userObj)
+    if err != nil || userObj.suspended() {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    if sessionExpiration(&session) <= 0 {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    session.User = userObj
+    session.LastSeenAt = time.Now()
+    session.ClientIP = context.RealIP()
+    session.UserAgent = context.Request().UserAgent()
+
+    return respondWithTokens(context, storeSession(&session), &session)
+}
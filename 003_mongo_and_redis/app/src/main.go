@@ -2,6 +2,7 @@ package main
 
 import (
     "context"
+    "fmt"
     _ "github.com/akurczyk/golang_echo_blogging_platform/003_mongo_and_redis/app/src/docs"
     "github.com/go-playground/validator"
     "github.com/go-redis/redis/v8"
@@ -33,14 +34,26 @@ var (
     mongoCtx        context.Context
     mongoClient     *mongo.Client
     mongoDatabase   *mongo.Database
-    usersCollection *mongo.Collection
-    postsCollection *mongo.Collection
+    usersCollection          *mongo.Collection
+    postsCollection          *mongo.Collection
+    apiKeysCollection        *mongo.Collection
+    impersonationsCollection *mongo.Collection
+    reportsCollection        *mongo.Collection
+    auditEventsCollection    *mongo.Collection
+    trashCollection          *mongo.Collection
+    postRevisionsCollection  *mongo.Collection
+    postSlugsCollection      *mongo.Collection
 )
 
 func (cv *CustomValidator) Validate(i interface{}) error {
     return cv.validator.Struct(i)
 }
 
+// ValidatePartial validates only the given fields of the struct.
+func (cv *CustomValidator) ValidatePartial(i interface{}, fields ...string) error {
+    return cv.validator.StructPartial(i, fields...)
+}
+
 func setupMongo() {
     var err error
 
@@ -93,14 +106,166 @@ func setupMongo() {
     }
     postsCollection = mongoDatabase.Collection("posts", &postsOptions)
 
-    // Setup users unique indexes
+    // Create API keys collection handle
+    apiKeysCollection = mongoDatabase.Collection("api_keys", &usersOptions)
+
+    // Create impersonations collection handle
+    impersonationsCollection = mongoDatabase.Collection("impersonations", &usersOptions)
+
+    // Create reports collection handle
+    reportsCollection = mongoDatabase.Collection("reports", &usersOptions)
+
+    // Create audit events collection handle
+    auditEventsCollection = mongoDatabase.Collection("audit_events", &usersOptions)
+
+    // Create trash collection handle
+    trashCollection = mongoDatabase.Collection("trash", &postsOptions)
+
+    // Create post revisions collection handle
+    postRevisionsCollection = mongoDatabase.Collection("post_revisions", &postsOptions)
+
+    // Create post slugs collection handle
+    postSlugsCollection = mongoDatabase.Collection("post_slugs", &postsOptions)
+
+    // Setup users indexes
     _, _ = usersCollection.Indexes().CreateMany(
         mongoCtx,
         []mongo.IndexModel{
             {Keys: bson.D{{Key: "name",  Value: 1}}, Options: options.Index().SetUnique(true)},
             {Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+            {Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+        },
+    )
+
+    // Setup API keys indexes
+    _, _ = apiKeysCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+            {Keys: bson.D{{Key: "user_id",  Value: 1}}},
+        },
+    )
+
+    // Setup impersonations indexes
+    _, _ = impersonationsCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "admin_id", Value: 1}}},
+            {Keys: bson.D{{Key: "user_id",  Value: 1}}},
+        },
+    )
+
+    // Setup reports indexes
+    _, _ = reportsCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "item_type", Value: 1}, {Key: "item_id", Value: 1}, {Key: "status", Value: 1}}},
+            {Keys: bson.D{{Key: "status", Value: 1}}},
+            // Every user gets a single open report per item
+            {
+                Keys: bson.D{{Key: "reporter_id", Value: 1}, {Key: "item_type", Value: 1}, {Key: "item_id", Value: 1}},
+                Options: options.Index().
+                    SetUnique(true).
+                    SetPartialFilterExpression(bson.M{"status": ReportStatusOpen}),
+            },
+        },
+    )
+
+    // Setup audit events indexes
+    _, _ = auditEventsCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "created_at", Value: -1}}},
+            {Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "created_at", Value: -1}}},
+        },
+    )
+
+    // Setup posts indexes
+    _, _ = postsCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "status", Value: 1}, {Key: "publish_at", Value: 1}}},
+            {Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+            {Keys: bson.D{{Key: "updated_at", Value: 1}, {Key: "_id", Value: 1}}},
+            {Keys: bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}}},
+            {Keys: bson.D{{Key: "tags.slug", Value: 1}}},
+            {
+                Keys: bson.D{
+                    {Key: "title", Value: "text"},
+                    {Key: "content", Value: "text"},
+                    {Key: "comments.content", Value: "text"},
+                },
+                Options: options.Index().SetName("search"),
+            },
+        },
+    )
+
+    // Posts created before the statuses were introduced have been published
+    _, err = postsCollection.UpdateMany(
+        mongoCtx,
+        bson.M{"status": bson.M{"$exists": false}},
+        bson.M{"$set": bson.M{"status": PostPublished}},
+    )
+    if err != nil {
+        panic(err)
+    }
+
+    // Setup trash indexes
+    _, _ = trashCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "deleted_by_id", Value: 1}, {Key: "deleted_at", Value: -1}}},
+            {Keys: bson.D{{Key: "deleted_at", Value: 1}}},
         },
     )
+
+    // Setup post revisions unique index
+    _, _ = postRevisionsCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {
+                Keys:    bson.D{{Key: "post_id", Value: 1}, {Key: "number", Value: 1}},
+                Options: options.Index().SetUnique(true),
+            },
+        },
+    )
+
+    // Setup post slugs indexes, the slugs themselves being unique as the IDs
+    _, _ = postSlugsCollection.Indexes().CreateMany(
+        mongoCtx,
+        []mongo.IndexModel{
+            {Keys: bson.D{{Key: "post_id", Value: 1}}},
+        },
+    )
+    assignMissingSlugs()
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        panic(fmt.Sprintf("Invalid duration in %v.", key))
+    }
+
+    return duration
+}
+
+func getEnvInt(key string, fallback int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+
+    number, err := strconv.Atoi(value)
+    if err != nil {
+        panic(fmt.Sprintf("Invalid number in %v.", key))
+    }
+
+    return number
 }
 
 func setupRedis() {
@@ -132,6 +297,18 @@ func setupRedis() {
 func main() {
     setupMongo()
     setupRedis()
+    setupAuth()
+    setupLoginLockout()
+    setupPasswords()
+    setupMailer()
+    setupPasswordReset()
+    setupEmailVerification()
+    setupTotp()
+    setupPolicy()
+    setupAdmin()
+    setupReports()
+    setupTrash()
+    setupScheduler()
 
     e := echo.New()
 
@@ -145,24 +322,95 @@ func main() {
     // Swagger
     e.GET("/swagger/*", echoSwagger.WrapHandler)
 
+    // Authentication with a session token or an API key
+    auth := middleware.KeyAuth(checkAuthToken)
+
+    // Authentication on the endpoints open to everybody, which show more to the logged in users
+    optionalAuth := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+        Skipper: func(context echo.Context) bool {
+            return context.Request().Header.Get(echo.HeaderAuthorization) == ""
+        },
+        Validator: checkAuthToken,
+    })
+
     e.GET("/users", listUserAccounts)
     e.POST("/users", createUserAccount)
+    e.GET("/users/me", retrieveCurrentUserAccount, auth, requireScope(ScopeUsersRead))
     e.GET("/users/:id", retrieveUserAccount)
-    e.PUT("/users", updateUserAccount, middleware.KeyAuth(checkAuthToken))
-    e.DELETE("/users", deleteUserAccount, middleware.KeyAuth(checkAuthToken))
+    e.PUT("/users", updateUserAccount, auth, requireSession, requireAccountOwner)
+    e.PATCH("/users", patchUserAccount, auth, requireSession, requireAccountOwner)
+    e.DELETE("/users", deleteUserAccount, auth, requireSession, requireAccountOwner)
 
     e.POST("/token", issueAuthToken)
-    e.DELETE("/token", revokeAuthToken, middleware.KeyAuth(checkAuthToken))
+    e.DELETE("/token", revokeAuthToken, auth, requireSession)
+    e.DELETE("/token/all", revokeAllAuthTokens, auth, requireSession, requireAccountOwner)
+    if authMode == AuthModeJWT {
+        e.POST("/token/refresh", refreshAuthToken)
+    }
+    e.POST("/token/mfa", issueMfaAuthToken)
+
+    e.POST("/totp/enroll", enrollTotp, auth, requireSession, requireAccountOwner)
+    e.POST("/totp/confirm", confirmTotp, auth, requireSession, requireAccountOwner)
+    e.DELETE("/totp", disableTotp, auth, requireSession, requireAccountOwner)
+
+    e.POST("/password-reset", requestPasswordReset)
+    e.POST("/password-reset/confirm", confirmPasswordReset)
+
+    e.POST("/email-verification", resendEmailVerification, auth, requireSession, requireAccountOwner)
+    e.POST("/email-verification/confirm", confirmEmailVerification)
+
+    e.GET("/api-keys", listApiKeys, auth, requireSession, requireAccountOwner)
+    e.POST("/api-keys", createApiKey, auth, requireSession, requireAccountOwner)
+    e.DELETE("/api-keys/:id", deleteApiKey, auth, requireSession, requireAccountOwner)
+
+    e.GET("/sessions", listSessions, auth, requireSession)
+    e.DELETE("/sessions/:id", deleteSession, auth, requireSession)
+
+    e.GET("/posts", listPosts, optionalAuth)
+    e.POST("/posts", createPost, auth, requireScope(ScopePostsWrite), checkVerifiedEmail)
+    e.GET("/posts/by-slug/:slug", retrievePostBySlug, optionalAuth)
+    e.GET("/posts/:id", retrievePost, optionalAuth)
+    e.PUT("/posts/:id", updatePost, auth, requireScope(ScopePostsWrite))
+    e.PATCH("/posts/:id", patchPost, auth, requireScope(ScopePostsWrite))
+    e.DELETE("/posts/:id", deletePost, auth, requireScope(ScopePostsWrite))
+    e.POST("/posts/:id/hide", hidePost, auth, requireScope(ScopePostsWrite))
+    e.POST("/posts/:id/unhide", unhidePost, auth, requireScope(ScopePostsWrite))
+    e.POST("/posts/:id/reports", reportPost, auth, requireSession)
+    e.POST("/posts/:id/restore", restorePost, auth, requireScope(ScopePostsWrite))
+    e.GET("/posts/:id/revisions", listPostRevisions, auth)
+    e.GET("/posts/:id/revisions/:rev", retrievePostRevision, auth)
+    e.GET("/posts/:id/revisions/:rev/diff", diffPostRevision, auth)
+    e.POST("/posts/:id/revisions/:rev/restore", restorePostRevision, auth, requireScope(ScopePostsWrite))
+
+    e.POST("/posts/:post_id/comments", createComment, auth, requireScope(ScopeCommentsWrite), checkVerifiedEmail)
+    e.PUT("/posts/:post_id/comments/:comment_id", updateComment, auth, requireScope(ScopeCommentsWrite))
+    e.PATCH("/posts/:post_id/comments/:comment_id", patchComment, auth, requireScope(ScopeCommentsWrite))
+    e.DELETE("/posts/:post_id/comments/:comment_id", deleteComment, auth, requireScope(ScopeCommentsWrite))
+    e.POST("/posts/:post_id/comments/:comment_id/hide", hideComment, auth, requireScope(ScopeCommentsWrite))
+    e.POST("/posts/:post_id/comments/:comment_id/unhide", unhideComment, auth, requireScope(ScopeCommentsWrite))
+    e.POST("/posts/:post_id/comments/:comment_id/reports", reportComment, auth, requireSession)
+    e.POST("/posts/:post_id/comments/:comment_id/restore", restoreComment, auth, requireScope(ScopeCommentsWrite))
+
+    e.GET("/search", searchContent)
+
+    e.GET("/tags", listTags)
+    e.GET("/tags/:slug/posts", listTagPosts, optionalAuth)
+
+    e.GET("/trash", listTrash, auth, requireSession)
 
-    e.GET("/posts", listPosts)
-    e.POST("/posts", createPost, middleware.KeyAuth(checkAuthToken))
-    e.GET("/posts/:id", retrievePost)
-    e.PUT("/posts/:id", updatePost, middleware.KeyAuth(checkAuthToken))
-    e.DELETE("/posts/:id", deletePost, middleware.KeyAuth(checkAuthToken))
+    e.GET("/moderation/queue", listModerationQueue, auth, requireSession, requireModerator)
+    e.GET("/moderation/reports", listReports, auth, requireSession, requireModerator)
+    e.POST("/moderation/posts/:id", moderatePost, auth, requireSession, requireModerator)
+    e.POST("/moderation/posts/:post_id/comments/:comment_id", moderateComment, auth, requireSession, requireModerator)
 
-    e.POST("/posts/:post_id/comments", createComment, middleware.KeyAuth(checkAuthToken))
-    e.PUT("/posts/:post_id/comments/:comment_id", updateComment, middleware.KeyAuth(checkAuthToken))
-    e.DELETE("/posts/:post_id/comments/:comment_id", deleteComment, middleware.KeyAuth(checkAuthToken))
+    e.GET("/admin/users", listAdminUsers, auth, requireSession, requireAdmin)
+    e.PUT("/admin/users/:id/role", updateUserRole, auth, requireSession, requireAdmin)
+    e.PUT("/admin/users/:id/suspension", suspendUser, auth, requireSession, requireAdmin)
+    e.DELETE("/admin/users/:id/suspension", liftUserSuspension, auth, requireSession, requireAdmin)
+    e.DELETE("/admin/users/:id/sessions", revokeUserSessionsAsAdmin, auth, requireSession, requireAdmin)
+    e.POST("/admin/users/:id/impersonate", impersonateUser, auth, requireSession, requireAdmin)
+    e.GET("/admin/impersonations", listImpersonations, auth, requireSession, requireAdmin)
+    e.GET("/admin/audit", listAuditEvents, auth, requireSession, requireAdmin)
 
     e.GET("/alive", func(c echo.Context) error {
         return c.NoContent(http.StatusOK)
@@ -171,7 +419,6 @@ func main() {
     e.Logger.Fatal(e.Start(":1323"))
 }
 
-// TODO: Add pagination
 // TODO: Write tests
 // TODO: Auto update of authors of posts and comments during update of users
 // TODO: Add Sentinel support for Redis
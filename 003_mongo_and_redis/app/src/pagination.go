@@ -0,0 +1,190 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // Number of items on a page when no limit is given
+    defaultPageLimit = 20
+    maxPageLimit     = 100
+)
+
+// Fields the listings can be sorted by. Only the fields listed here get into the queries.
+var sortFields = map[string]sortField{
+    "created_at":   {Field: "created_at", Time: true},
+    "updated_at":   {Field: "updated_at", Time: true},
+    "title":        {Field: "title"},
+    "report_count": {Field: "report_count", Number: true},
+}
+
+type (
+    // Page is a part of a listing. The next part is listed by passing next_cursor as the cursor, which is null on the
+    // last page.
+    Page struct {
+        Items      interface{} `json:"items"`
+        NextCursor *string     `json:"next_cursor"`
+    }
+
+    sortField struct {
+        Field  string
+        Time   bool
+        Number bool
+    }
+
+    // sortKeys are the values of the fields an item can be sorted by.
+    sortKeys struct {
+        CreatedAt   time.Time
+        UpdatedAt   time.Time
+        Title       string
+        ReportCount int
+    }
+
+    // pageCursor points at the last item of the previous page, in the order the listing is sorted in.
+    pageCursor struct {
+        Sort string             `json:"sort"`
+        Key  string             `json:"key"`
+        ID   primitive.ObjectID `json:"id"`
+    }
+
+    pageQuery struct {
+        Limit int
+        // Name of the sort field, prefixed with a minus for the descending order
+        Sort  string
+        After *pageCursor
+        // Value of the sort field in the cursor
+        afterKey interface{}
+    }
+)
+
+// getPageQuery reads the limit, the order and the cursor of the requested page. The listing can be sorted by the given
+// fields, and by the first one by default.
+func getPageQuery(context echo.Context, sorts ...string) (*pageQuery, error) {
+    page := &pageQuery{Limit: defaultPageLimit, Sort: sorts[0]}
+
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > maxPageLimit {
+            return nil, errors.New("Provided limit is invalid.")
+        }
+        page.Limit = number
+    }
+
+    if value := context.QueryParam("sort"); value != "" {
+        for _, sort := range sorts {
+            if strings.TrimPrefix(value, "-") == sort {
+                page.Sort = value
+            }
+        }
+        if page.Sort != value {
+            return nil, errors.New("Provided sort is invalid.")
+        }
+    }
+
+    if value := context.QueryParam("cursor"); value != "" {
+        page.After = new(pageCursor)
+        data, err := base64.RawURLEncoding.DecodeString(value)
+        if err != nil || json.Unmarshal(data, page.After) != nil || page.After.Sort != page.Sort {
+            return nil, errors.New("Provided cursor is invalid.")
+        }
+
+        page.afterKey = page.After.Key
+        if page.field().Time {
+            page.afterKey, err = time.Parse(time.RFC3339Nano, page.After.Key)
+            if err != nil {
+                return nil, errors.New("Provided cursor is invalid.")
+            }
+        }
+        if page.field().Number {
+            page.afterKey, err = strconv.Atoi(page.After.Key)
+            if err != nil {
+                return nil, errors.New("Provided cursor is invalid.")
+            }
+        }
+    }
+
+    return page, nil
+}
+
+func (page *pageQuery) field() sortField {
+    return sortFields[strings.TrimPrefix(page.Sort, "-")]
+}
+
+func (page *pageQuery) descending() bool {
+    return strings.HasPrefix(page.Sort, "-")
+}
+
+// apply limits the filters to the page and returns the options sorting it and fetching one item more than fits on it
+// to learn whether there is a next one. The ID breaks the ties.
+func (page *pageQuery) apply(filters []bson.M) ([]bson.M, *options.FindOptions) {
+    field, operator, direction := page.field().Field, "$gt", 1
+    if page.descending() {
+        operator, direction = "$lt", -1
+    }
+
+    if page.After != nil {
+        filters = append(filters, bson.M{
+            "$or": []bson.M{
+                {field: bson.M{operator: page.afterKey}},
+                {field: page.afterKey, "_id": bson.M{operator: page.After.ID}},
+            },
+        })
+    }
+
+    findOptions := options.Find().
+        SetSort(bson.D{{Key: field, Value: direction}, {Key: "_id", Value: direction}}).
+        SetLimit(int64(page.Limit + 1))
+    return filters, findOptions
+}
+
+// cursorAt returns the cursor pointing at the item with the given sort keys and ID.
+func (page *pageQuery) cursorAt(keys sortKeys, id primitive.ObjectID) *pageCursor {
+    cursor := &pageCursor{Sort: page.Sort, ID: id}
+
+    switch page.field().Field {
+    case "created_at":
+        cursor.Key = keys.CreatedAt.Format(time.RFC3339Nano)
+    case "updated_at":
+        cursor.Key = keys.UpdatedAt.Format(time.RFC3339Nano)
+    case "title":
+        cursor.Key = keys.Title
+    case "report_count":
+        cursor.Key = strconv.Itoa(keys.ReportCount)
+    }
+
+    return cursor
+}
+
+// sendPage responds with the items of the page. The cursor of the next page, if there is one, is sent both in the body
+// and in the Link header, which repeats the query of the request.
+func sendPage(context echo.Context, items interface{}, next *pageCursor) error {
+    page := Page{Items: items}
+
+    if next != nil {
+        data, err := json.Marshal(next)
+        if err != nil {
+            return err
+        }
+        cursor := base64.RawURLEncoding.EncodeToString(data)
+        page.NextCursor = &cursor
+
+        query := context.Request().URL.Query()
+        query.Set("cursor", cursor)
+        link := url.URL{Path: context.Request().URL.Path, RawQuery: query.Encode()}
+        context.Response().Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, link.String()))
+    }
+
+    return context.JSON(http.StatusOK, page)
+}
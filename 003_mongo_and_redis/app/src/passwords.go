@@ -0,0 +1,161 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "fmt"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+    "os"
+    "strings"
+)
+
+const (
+    PasswordHashBcrypt   = "bcrypt"
+    PasswordHashArgon2id = "argon2id"
+)
+
+const (
+    argon2SaltLength = 16
+    argon2KeyLength  = 32
+)
+
+type (
+    argon2Hash struct {
+        memory      uint32
+        iterations  uint32
+        parallelism uint8
+        salt        []byte
+        key         []byte
+    }
+)
+
+var (
+    passwordHashAlgorithm string
+    bcryptCost            int
+    argon2Memory          uint32
+    argon2Iterations      uint32
+    argon2Parallelism     uint8
+)
+
+func setupPasswords() {
+    passwordHashAlgorithm = os.Getenv("BP_PASSWORD_HASH_ALGORITHM")
+    if passwordHashAlgorithm == "" {
+        passwordHashAlgorithm = PasswordHashArgon2id
+    }
+    if passwordHashAlgorithm != PasswordHashBcrypt && passwordHashAlgorithm != PasswordHashArgon2id {
+        panic("Unknown password hash algorithm.")
+    }
+
+    bcryptCost = getEnvInt("BP_BCRYPT_COST", 12)
+    if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+        panic("Invalid bcrypt cost.")
+    }
+
+    memory := getEnvInt("BP_ARGON2_MEMORY", 64 * 1024)
+    iterations := getEnvInt("BP_ARGON2_ITERATIONS", 3)
+    parallelism := getEnvInt("BP_ARGON2_PARALLELISM", 2)
+    if memory < 8 * parallelism || iterations < 1 || parallelism < 1 || parallelism > 255 {
+        panic("Invalid argon2 parameters.")
+    }
+    argon2Memory = uint32(memory)
+    argon2Iterations = uint32(iterations)
+    argon2Parallelism = uint8(parallelism)
+}
+
+func hashAndSalt(pwd string) (string, error) {
+    bytePwd := []byte(pwd)
+
+    if passwordHashAlgorithm == PasswordHashArgon2id {
+        salt := make([]byte, argon2SaltLength)
+        if _, err := rand.Read(salt); err != nil {
+            return "", err
+        }
+
+        key := argon2.IDKey(bytePwd, salt, argon2Iterations, argon2Memory, argon2Parallelism, argon2KeyLength)
+
+        // The PHC string format, as used by the reference implementation
+        template := "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s"
+        encoding := base64.RawStdEncoding
+        hash := fmt.Sprintf(template, argon2.Version, argon2Memory, argon2Iterations, argon2Parallelism,
+            encoding.EncodeToString(salt), encoding.EncodeToString(key))
+        return hash, nil
+    }
+
+    hash, err := bcrypt.GenerateFromPassword(bytePwd, bcryptCost)
+    if err != nil {
+        return "", err
+    }
+    return string(hash), nil
+}
+
+func parseArgon2Hash(hashedPwd string) (*argon2Hash, bool) {
+    var version int
+    var err error
+
+    hash := new(argon2Hash)
+
+    parts := strings.Split(hashedPwd, "$")
+    if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+        return nil, false
+    }
+
+    _, err = fmt.Sscanf(parts[2], "v=%d", &version)
+    if err != nil || version != argon2.Version {
+        return nil, false
+    }
+
+    _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.iterations, &hash.parallelism)
+    if err != nil {
+        return nil, false
+    }
+
+    hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return nil, false
+    }
+
+    hash.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil || len(hash.key) == 0 {
+        return nil, false
+    }
+
+    return hash, true
+}
+
+func comparePasswords(hashedPwd string, plainPwd string) bool {
+    bytePlainPwd := []byte(plainPwd)
+
+    if strings.HasPrefix(hashedPwd, "$" + PasswordHashArgon2id + "$") {
+        hash, ok := parseArgon2Hash(hashedPwd)
+        if !ok {
+            return false
+        }
+
+        keyLength := uint32(len(hash.key))
+        key := argon2.IDKey(bytePlainPwd, hash.salt, hash.iterations, hash.memory, hash.parallelism, keyLength)
+        return subtle.ConstantTimeCompare(key, hash.key) == 1
+    }
+
+    byteHashedPwd := []byte(hashedPwd)
+    err := bcrypt.CompareHashAndPassword(byteHashedPwd, bytePlainPwd)
+    return err == nil
+}
+
+// passwordNeedsRehash reports whether the hash has been created with another algorithm or other parameters than the
+// configured ones.
+func passwordNeedsRehash(hashedPwd string) bool {
+    if passwordHashAlgorithm == PasswordHashArgon2id {
+        hash, ok := parseArgon2Hash(hashedPwd)
+        if !ok {
+            return true
+        }
+
+        return hash.memory != argon2Memory || hash.iterations != argon2Iterations ||
+            hash.parallelism != argon2Parallelism || len(hash.key) != argon2KeyLength
+    }
+
+    cost, err := bcrypt.Cost([]byte(hashedPwd))
+    return err != nil || cost != bcryptCost
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "net/http"
+    "os"
+    "strings"
+)
+
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+// setupPolicy gives the admin role to the existing users listed in BP_ADMIN_NAMES. Signing up with one of the names
+// never does, as anybody could take a name that is not registered yet, or that a deleted admin has left behind.
+func setupPolicy() {
+    names := []string{}
+    for _, name := range strings.Split(os.Getenv("BP_ADMIN_NAMES"), ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            names = append(names, name)
+        }
+    }
+    if len(names) == 0 {
+        return
+    }
+
+    filter := bson.M{
+        "name": bson.M{"$in": names},
+        "role": bson.M{"$ne": RoleAdmin},
+    }
+    cursor, err := usersCollection.Find(mongoCtx, filter)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var user User
+
+        err := cursor.Decode(&user)
+        if err != nil {
+            panic(err)
+        }
+
+        user.Role = RoleAdmin
+        update := bson.M{"$set": bson.M{"role": RoleAdmin}}
+        _, err = usersCollection.UpdateOne(mongoCtx, bson.M{"_id": user.ID}, update)
+        if err != nil {
+            panic(err)
+        }
+        updateUserSessions(user)
+    }
+}
+
+func isModerator(user User) bool {
+    return user.Role == RoleModerator || user.Role == RoleAdmin
+}
+
+func isAdmin(user User) bool {
+    return user.Role == RoleAdmin
+}
+
+// currentUser returns the authenticated user, or nil on the endpoints open to everybody.
+func currentUser(context echo.Context) *User {
+    if user, ok := context.Get("User").(User); ok {
+        return &user
+    }
+    return nil
+}
+
+// Published and unlisted posts can be read by anybody, while drafts, scheduled and private posts only by their
+// authors. Unlisted posts are left out of the listings.
+func canViewPost(user *User, post *Post) bool {
+    if post.Status == PostPublished || post.Status == PostUnlisted {
+        return true
+    }
+    return user != nil && post.Author.ID == user.ID
+}
+
+// Authors manage their own content. Moderators can edit and hide anybody's, while deleting it is left to admins.
+func canUpdatePost(user User, post *Post) bool {
+    return post.Author.ID == user.ID || isModerator(user)
+}
+
+func canDeletePost(user User, post *Post) bool {
+    return post.Author.ID == user.ID || isAdmin(user)
+}
+
+func canHidePost(user User, post *Post) bool {
+    return isModerator(user)
+}
+
+func canUpdateComment(user User, comment *Comment) bool {
+    return comment.Author.ID == user.ID || isModerator(user)
+}
+
+func canDeleteComment(user User, comment *Comment) bool {
+    return comment.Author.ID == user.ID || isAdmin(user)
+}
+
+func canHideComment(user User, comment *Comment) bool {
+    return isModerator(user)
+}
+
+// Content is restored from the trash by whoever has deleted it, or by admins.
+func canRestoreTrashItem(user User, item *TrashItem) bool {
+    return item.DeletedByID == user.ID || isAdmin(user)
+}
+
+func canManageUsers(user User) bool {
+    return isAdmin(user)
+}
+
+func canModerate(user User) bool {
+    return isModerator(user)
+}
+
+// requireAdmin is a middleware letting through only the users allowed to manage other users.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if !canManageUsers(context.Get("User").(User)) {
+            return context.NoContent(http.StatusForbidden)
+        }
+
+        return next(context)
+    }
+}
+
+// requireModerator is a middleware letting through only the users allowed to work through the moderation queue.
+func requireModerator(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if !canModerate(context.Get("User").(User)) {
+            return context.NoContent(http.StatusForbidden)
+        }
+
+        return next(context)
+    }
+}
@@ -1,31 +1,120 @@
 package main
 
 import (
+    "fmt"
     "github.com/labstack/echo/v4"
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
+    "hash/fnv"
     "net/http"
     "strings"
     "time"
 )
 
+const (
+    PostDraft     = "draft"
+    PostScheduled = "scheduled"
+    PostPublished = "published"
+    PostUnlisted  = "unlisted"
+    PostPrivate   = "private"
+)
+
 type (
     Post struct {
-        ID        primitive.ObjectID `bson:"_id" json:"_id"`
-        CreatedAt time.Time          `bson:"created_at" json:"created_at"`
-        UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
-        Author    User               `bson:"author" json:"author"`
-        Title     string             `bson:"title" json:"title"`
-        Content   string             `bson:"content" json:"content"`
-        Comments  []Comment          `bson:"comments" json:"comments"`
+        ID              primitive.ObjectID `bson:"_id" json:"_id"`
+        CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+        UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
+        Author          User               `bson:"author" json:"author"`
+        Title           string             `bson:"title" json:"title"`
+        Content         string             `bson:"content" json:"content"`
+        Comments        []Comment          `bson:"comments" json:"comments"`
+        HiddenAt        *time.Time         `bson:"hidden_at" json:"hidden_at,omitempty"`
+        // Whether the post has been hidden by reaching the report threshold rather than by a moderator
+        HiddenByReports bool               `bson:"hidden_by_reports" json:"-"`
+        Status          string             `bson:"status" json:"status"`
+        // Time the post has been or is going to be published at
+        PublishAt       *time.Time         `bson:"publish_at" json:"publish_at"`
+        Tags            []Tag              `bson:"tags" json:"tags"`
+        // Current slug, made of the title
+        Slug            string             `bson:"slug" json:"slug"`
     }
 
     PostIn struct {
-        Title   string `json:"title" validate:"required,min=3"`
-        Content string `json:"content" validate:"required,min=3"`
+        Title     string     `json:"title" validate:"required,min=3"`
+        Content   string     `json:"content" validate:"required,min=3"`
+        Status    string     `json:"status" validate:"omitempty,oneof=draft scheduled published unlisted private"`
+        PublishAt *time.Time `json:"publish_at"`
+        Tags      []string   `json:"tags" validate:"max=10,dive,required,max=64"`
     }
 )
 
+// withoutHiddenComments leaves out the comments hidden by moderators from the post returned to the client.
+func (post *Post) withoutHiddenComments() *Post {
+    comments := []Comment{}
+    for _, comment := range post.Comments {
+        if comment.HiddenAt == nil {
+            comments = append(comments, comment)
+        }
+    }
+
+    visiblePost := *post
+    visiblePost.Comments = comments
+    return &visiblePost
+}
+
+// etag derives the entity tag of the post from the times it and its visible comments have been last updated at, as
+// the comments are returned together with it.
+func (post *Post) etag() string {
+    hash := fnv.New64a()
+    fmt.Fprint(hash, etag(post.UpdatedAt))
+    for _, comment := range post.Comments {
+        if comment.HiddenAt == nil {
+            fmt.Fprint(hash, comment.ID.Hex(), etag(comment.UpdatedAt))
+        }
+    }
+
+    return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// setStatus moves the post to the status, leaving the current one if none is given. It returns a message explaining
+// why the status can not be set, or an empty string.
+func (post *Post) setStatus(status string, publishAt *time.Time) string {
+    now := time.Now()
+
+    if status == "" {
+        status = post.Status
+    }
+
+    switch status {
+    case PostScheduled:
+        if publishAt == nil {
+            publishAt = post.PublishAt
+        }
+        if publishAt == nil || !publishAt.After(now) {
+            return "A scheduled post needs publish_at in the future."
+        }
+        post.PublishAt = publishAt
+    case PostPublished, PostUnlisted:
+        // The time of the first publication is kept
+        if post.PublishAt == nil || post.PublishAt.After(now) {
+            post.PublishAt = &now
+        }
+    default:
+        // A schedule given up on is forgotten
+        if post.PublishAt != nil && post.PublishAt.After(now) {
+            post.PublishAt = nil
+        }
+    }
+
+    post.Status = status
+    return ""
+}
+
+// sortKeys returns the values of the fields the posts can be sorted by.
+func (post *Post) sortKeys() sortKeys {
+    return sortKeys{CreatedAt: post.CreatedAt, UpdatedAt: post.UpdatedAt, Title: post.Title}
+}
+
 func getPostOrError(context echo.Context) (*Post, int) {
     var err error
     var id primitive.ObjectID
@@ -49,23 +138,76 @@ func getPostOrError(context echo.Context) (*Post, int) {
 
 // listPosts godoc
 // @Summary List Posts
+// @Description Lists the published posts, along with all the posts of the current user if there is one.
 // @Tags posts
 // @Produce json
-// @Param author_id query string false "Author ID"
-// @Success 200 {array} Post
+// @Param author_id query string false "Author IDs, comma-separated"
+// @Param title_prefix query string false "Beginning of the title"
+// @Param created_after query string false "Created after, in RFC 3339"
+// @Param created_before query string false "Created before, in RFC 3339"
+// @Param updated_after query string false "Updated after, in RFC 3339"
+// @Param sort query string false "created_at, updated_at or title, prefixed with a minus for the descending order"
+// @Param limit query int false "Number of posts on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]Post}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
 // @Router /posts [get]
 func listPosts(context echo.Context) error {
-    var posts []Post
-    var filter = bson.M{}
+    return listMatchingPosts(context, []bson.M{})
+}
 
-    if authorID := context.QueryParam("author_id"); authorID != "" {
-        id, _ := primitive.ObjectIDFromHex(context.QueryParam("author_id"))
-        filter = bson.M{
-            "author._id": id,
-        }
+// listMatchingPosts lists the visible posts matching the filters, narrowed down and sorted as requested.
+func listMatchingPosts(context echo.Context, filters []bson.M) error {
+    var next *pageCursor
+    var posts = []Post{}
+
+    filters = append(filters, bson.M{
+        "hidden_at": nil,
+    })
+
+    page, err := getPageQuery(context, "created_at", "updated_at", "title")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    authorIDs, err := getIDsParam(context, "author_id")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+    filters, err = filterByTime(context, filters)
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
     }
 
-    cursor, err := postsCollection.Find(mongoCtx, filter)
+    if user := currentUser(context); user != nil {
+        filters = append(filters, bson.M{
+            "$or": []bson.M{
+                {"status": PostPublished},
+                {"author._id": user.ID},
+            },
+        })
+    } else {
+        filters = append(filters, bson.M{
+            "status": PostPublished,
+        })
+    }
+    if len(authorIDs) > 0 {
+        filters = append(filters, bson.M{
+            "author._id": bson.M{"$in": authorIDs},
+        })
+    }
+    if prefix := context.QueryParam("title_prefix"); prefix != "" {
+        filters = append(filters, bson.M{
+            "title": prefixRegex(prefix),
+        })
+    }
+
+    filters, findOptions := page.apply(filters)
+    filter := bson.M{
+        "$and": filters,
+    }
+    cursor, err := postsCollection.Find(mongoCtx, filter, findOptions)
     if err != nil {
         panic(err)
     }
@@ -79,10 +221,15 @@ func listPosts(context echo.Context) error {
             panic(err)
         }
 
-        posts = append(posts, post)
+        posts = append(posts, *post.withoutHiddenComments())
     }
 
-    return context.JSON(http.StatusOK, posts)
+    if len(posts) > page.Limit {
+        posts = posts[:page.Limit]
+        next = page.cursorAt(posts[page.Limit-1].sortKeys(), posts[page.Limit-1].ID)
+    }
+
+    return sendPage(context, posts, next)
 }
 
 // createPost godoc
@@ -116,21 +263,37 @@ func createPost(context echo.Context) error {
     post.Title = postIn.Title
     post.Content = postIn.Content
     post.Comments = []Comment{}
+    post.Status = PostPublished
+    if message := post.setStatus(postIn.Status, postIn.PublishAt); message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    tags, message := newTags(postIn.Tags)
+    if message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    post.Tags = tags
 
     _, err = postsCollection.InsertOne(mongoCtx, post)
     if err != nil {
         panic(err)
     }
+    assignSlug(post)
+    saveRevision(post, post.Author, post.CreatedAt)
 
     return context.JSON(http.StatusCreated, post)
 }
 
 // retrievePost godoc
 // @Summary Retrieve Post
+// @Description Drafts, scheduled and private posts are found only by their authors.
 // @Tags posts
 // @Produce json
 // @Param id path string true "ID"
+// @Param If-None-Match header string false "ETag of the cached version"
+// @Security ApiKeyAuth
 // @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 304
 // @Failure 400
 // @Failure 404
 // @Router /posts/{id} [get]
@@ -139,8 +302,20 @@ func retrievePost(context echo.Context) error {
     if err != 0 {
         return context.NoContent(err)
     }
+    if post.HiddenAt != nil || !canViewPost(currentUser(context), post) {
+        return context.NoContent(http.StatusNotFound)
+    }
 
-    return context.JSON(http.StatusOK, post)
+    return sendPost(context, post)
+}
+
+// sendPost responds with the post, or with no content if the client already has its current version.
+func sendPost(context echo.Context, post *Post) error {
+    if notModified(context, post.etag()) {
+        return context.NoContent(http.StatusNotModified)
+    }
+
+    return context.JSON(http.StatusOK, post.withoutHiddenComments())
 }
 
 // updatePost godoc
@@ -150,44 +325,119 @@ func retrievePost(context echo.Context) error {
 // @Produce json
 // @Param id path string true "ID"
 // @Param post body PostIn true "Post"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /posts/{id} [put]
 func updatePost(context echo.Context) error {
+    return editPost(context, false)
+}
+
+// patchPost godoc
+// @Summary Patch Post
+// @Description Changes only the fields present in the JSON merge patch (RFC 7396).
+// @Tags posts
+// @Accept json
+// @Produce json
+// @Param id path string true "ID"
+// @Param post body PostIn true "Post"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 412
+// @Router /posts/{id} [patch]
+func patchPost(context echo.Context) error {
+    return editPost(context, true)
+}
+
+// editPost replaces the post with the one in the request, or with the merge patch sent with PATCH applied to it.
+func editPost(context echo.Context, patch bool) error {
+    user := context.Get("User").(User)
+
     post, code := getPostOrError(context)
     if code != 0 {
         return context.NoContent(code)
     }
 
-    if post.Author.ID != context.Get("User").(User).ID {
+    if !canUpdatePost(user, post) {
         return context.NoContent(http.StatusForbidden)
     }
+    if !ifMatch(context, post.etag()) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
 
     postIn := new(PostIn)
-    if err := context.Bind(postIn); err != nil {
-        return err
-    }
-    if err := context.Validate(postIn); err != nil {
-        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    if patch {
+        postIn.Title = post.Title
+        postIn.Content = post.Content
+        postIn.Status = post.Status
+        postIn.PublishAt = post.PublishAt
+        postIn.Tags = post.tagNames()
+        if err := bindMergePatch(context, postIn); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
+    } else {
+        if err := context.Bind(postIn); err != nil {
+            return err
+        }
+        if err := context.Validate(postIn); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
     }
 
+    startRevisionHistory(post)
+
+    updatedAt := post.UpdatedAt
+    post.UpdatedAt = time.Now()
     post.Title = postIn.Title
     post.Content = postIn.Content
+    if message := post.setStatus(postIn.Status, postIn.PublishAt); message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    tags, message := newTags(postIn.Tags)
+    if message != "" {
+        return context.JSON(http.StatusBadRequest, message)
+    }
+    post.Tags = tags
 
+    // Only the fields of the post itself are written, leaving its comments alone, and only if nobody has changed it
+    // since it has been read
     filter := bson.M{
         "_id": post.ID,
+        "updated_at": updatedAt,
     }
     update := bson.M{
-        "$set": post,
+        "$set": bson.M{
+            "updated_at": post.UpdatedAt,
+            "title": post.Title,
+            "content": post.Content,
+            "status": post.Status,
+            "publish_at": post.PublishAt,
+            "tags": post.Tags,
+        },
     }
-    _, err := postsCollection.UpdateOne(mongoCtx, filter, update)
+    result, err := postsCollection.UpdateOne(mongoCtx, filter, update)
     if err != nil {
         panic(err)
+    } else if result.MatchedCount != 1 {
+        return context.NoContent(http.StatusPreconditionFailed)
     }
+    assignSlug(post)
+    saveRevision(post, user, post.UpdatedAt)
+
+    post = post.withoutHiddenComments()
+    setETag(context, post.etag())
 
     return context.JSON(http.StatusOK, post)
 }
@@ -196,12 +446,14 @@ func updatePost(context echo.Context) error {
 // @Summary Delete Post
 // @Tags posts
 // @Param id path string true "ID"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 204
 // @Failure 400
 // @Failure 401
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /posts/{id} [delete]
 func deletePost(context echo.Context) error {
     post, code := getPostOrError(context)
@@ -209,17 +461,70 @@ func deletePost(context echo.Context) error {
         return context.NoContent(code)
     }
 
-    if post.Author.ID != context.Get("User").(User).ID {
+    if !canDeletePost(context.Get("User").(User), post) {
         return context.NoContent(http.StatusForbidden)
     }
+    if !ifMatch(context, post.etag()) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
 
-    filter := bson.M{
-        "_id": post.ID,
+    if !trashPost(context.Get("User").(User), post) {
+        return context.NoContent(http.StatusNotFound)
     }
-    _, err := postsCollection.DeleteOne(mongoCtx, filter)
-    if err != nil {
-        panic(err)
+    emitAudit(context, AuditPostDelete, postTarget(post))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// setPostHidden marks the post as hidden at the given time, or as visible again when it is nil.
+func setPostHidden(context echo.Context, hiddenAt *time.Time) error {
+    post, code := getPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    if !canHidePost(context.Get("User").(User), post) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    updatePostHiddenAt(post.ID, nil, hiddenAt, false)
+
+    if hiddenAt != nil {
+        emitAudit(context, AuditPostHide, postTarget(post))
+    } else {
+        emitAudit(context, AuditPostUnhide, postTarget(post))
     }
 
     return context.NoContent(http.StatusNoContent)
 }
+
+// hidePost godoc
+// @Summary Hide Post
+// @Tags posts
+// @Param id path string true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/hide [post]
+func hidePost(context echo.Context) error {
+    hiddenAt := time.Now()
+    return setPostHidden(context, &hiddenAt)
+}
+
+// unhidePost godoc
+// @Summary Unhide Post
+// @Tags posts
+// @Param id path string true "ID"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/unhide [post]
+func unhidePost(context echo.Context) error {
+    return setPostHidden(context, nil)
+}
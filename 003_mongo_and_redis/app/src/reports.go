@@ -0,0 +1,645 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    ReportItemPost    = "post"
+    ReportItemComment = "comment"
+
+    ReportStatusOpen     = "open"
+    ReportStatusResolved = "resolved"
+
+    ModerationDismiss = "dismiss"
+    ModerationHide    = "hide"
+    ModerationDelete  = "delete"
+    ModerationWarn    = "warn"
+)
+
+var (
+    // Number of open reports after which an item is hidden until a moderator looks at it, 0 disables it
+    reportHideThreshold int
+)
+
+type (
+    // Report is a complaint of a user about a post or a comment. Once a moderator acts on the item, the action is
+    // recorded on all of its open reports. The post ID of a reported post is the same as its item ID.
+    Report struct {
+        ID          primitive.ObjectID  `bson:"_id" json:"_id"`
+        CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+        UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"`
+        ReporterID  primitive.ObjectID  `bson:"reporter_id" json:"reporter_id"`
+        ItemType    string              `bson:"item_type" json:"item_type"`
+        ItemID      primitive.ObjectID  `bson:"item_id" json:"item_id"`
+        PostID      primitive.ObjectID  `bson:"post_id" json:"post_id"`
+        Reason      string              `bson:"reason" json:"reason"`
+        Details     string              `bson:"details" json:"details"`
+        Status      string              `bson:"status" json:"status"`
+        Action      string              `bson:"action,omitempty" json:"action,omitempty"`
+        Note        string              `bson:"note,omitempty" json:"note,omitempty"`
+        ModeratorID *primitive.ObjectID `bson:"moderator_id,omitempty" json:"moderator_id,omitempty"`
+        ResolvedAt  *time.Time          `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+    }
+
+    ReportIn struct {
+        Reason  string `json:"reason" validate:"required,oneof=spam abuse hate violence sexual misinformation other"`
+        Details string `json:"details" validate:"max=1000"`
+    }
+
+    // ModerationIn is the action taken on a reported item. The note is sent to the author along with a warning.
+    ModerationIn struct {
+        Action string `json:"action" validate:"required,oneof=dismiss hide delete warn"`
+        Note   string `json:"note" validate:"max=1000"`
+    }
+
+    // ModerationQueueItem sums up the open reports of a single item.
+    ModerationQueueItem struct {
+        ItemType        string             `json:"item_type"`
+        ItemID          primitive.ObjectID `json:"item_id"`
+        PostID          primitive.ObjectID `json:"post_id"`
+        ReportCount     int                `json:"report_count"`
+        Reasons         map[string]int     `json:"reasons"`
+        FirstReportedAt time.Time          `json:"first_reported_at"`
+        LastReportedAt  time.Time          `json:"last_reported_at"`
+        Post            *Post              `json:"post,omitempty"`
+        Comment         *Comment           `json:"comment,omitempty"`
+    }
+)
+
+func setupReports() {
+    reportHideThreshold = getEnvInt("BP_REPORT_HIDE_THRESHOLD", 5)
+}
+
+func countOpenReports(itemType string, itemID primitive.ObjectID) int64 {
+    filter := bson.M{
+        "item_type": itemType,
+        "item_id": itemID,
+        "status": ReportStatusOpen,
+    }
+    count, err := reportsCollection.CountDocuments(mongoCtx, filter)
+    if err != nil {
+        panic(err)
+    }
+
+    return count
+}
+
+// createReport files the report of the current user. It returns nil after having responded with an error.
+func createReport(context echo.Context, itemType string, itemID primitive.ObjectID, postID primitive.ObjectID,
+    authorID primitive.ObjectID) (*Report, error) {
+    user := context.Get("User").(User)
+
+    reportIn := new(ReportIn)
+    if err := context.Bind(reportIn); err != nil {
+        return nil, err
+    }
+    if err := context.Validate(reportIn); err != nil {
+        return nil, context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    if authorID == user.ID {
+        return nil, context.JSON(http.StatusBadRequest, "Own content can not be reported.")
+    }
+
+    report := new(Report)
+    report.ID = primitive.NewObjectID()
+    report.CreatedAt = time.Now()
+    report.UpdatedAt = time.Now()
+    report.ReporterID = user.ID
+    report.ItemType = itemType
+    report.ItemID = itemID
+    report.PostID = postID
+    report.Reason = reportIn.Reason
+    report.Details = reportIn.Details
+    report.Status = ReportStatusOpen
+
+    // Every user gets a single vote per item, so that the threshold can not be reached by one person
+    _, err := reportsCollection.InsertOne(mongoCtx, report)
+    if err != nil {
+        if strings.Contains(err.Error(), "E11000") {
+            return nil, context.JSON(http.StatusConflict, "This item has already been reported.")
+        }
+        panic(err)
+    }
+
+    return report, nil
+}
+
+// reachedReportHideThreshold tells whether the item has collected enough reports to be hidden.
+func reachedReportHideThreshold(itemType string, itemID primitive.ObjectID) bool {
+    return reportHideThreshold > 0 && countOpenReports(itemType, itemID) >= int64(reportHideThreshold)
+}
+
+// updatePostHiddenAt hides the post at the given time, or shows it again when it is nil, provided that it meets the
+// condition. Whether it has been hidden by its reports is recorded, so that only then dismissing them shows it again.
+func updatePostHiddenAt(postID primitive.ObjectID, condition bson.M, hiddenAt *time.Time, byReports bool) {
+    filter := bson.M{
+        "_id": postID,
+    }
+    for key, value := range condition {
+        filter[key] = value
+    }
+    update := bson.M{"$set": bson.M{"hidden_at": hiddenAt, "hidden_by_reports": byReports}}
+    _, err := postsCollection.UpdateOne(mongoCtx, filter, update)
+    if err != nil {
+        panic(err)
+    }
+}
+
+// updateCommentHiddenAt does the same as updatePostHiddenAt with a comment.
+func updateCommentHiddenAt(postID primitive.ObjectID, commentID primitive.ObjectID, condition bson.M,
+    hiddenAt *time.Time, byReports bool) {
+    match := bson.M{
+        "_id": commentID,
+    }
+    for key, value := range condition {
+        match[key] = value
+    }
+    filter := bson.M{
+        "_id": postID,
+        "comments": bson.M{"$elemMatch": match},
+    }
+    update := bson.M{
+        "$set": bson.M{
+            "comments.$.hidden_at": hiddenAt,
+            "comments.$.hidden_by_reports": byReports,
+        },
+    }
+    _, err := postsCollection.UpdateOne(mongoCtx, filter, update)
+    if err != nil {
+        panic(err)
+    }
+}
+
+// bindModerationIn reads the moderation action. It returns nil after having responded with an error.
+func bindModerationIn(context echo.Context) (*ModerationIn, error) {
+    moderationIn := new(ModerationIn)
+    if err := context.Bind(moderationIn); err != nil {
+        return nil, err
+    }
+    if err := context.Validate(moderationIn); err != nil {
+        return nil, context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+    if moderationIn.Action == ModerationWarn && strings.TrimSpace(moderationIn.Note) == "" {
+        return nil, context.JSON(http.StatusBadRequest, "A note is required to warn the author.")
+    }
+
+    return moderationIn, nil
+}
+
+// warnAuthor mails the note to the author. The copy of the author embedded in the content may carry an outdated
+// address, so the user is loaded again.
+func warnAuthor(context echo.Context, authorID primitive.ObjectID, itemType string, note string) {
+    var author User
+
+    err := usersCollection.FindOne(mongoCtx, bson.M{"_id": authorID}).Decode(&author)
+    if err != nil {
+        return
+    }
+
+    body := fmt.Sprintf(
+        "Hello %v,\n\nYour %v has been reported by other users and reviewed by a moderator, who has left the "+
+            "following note:\n\n%v\n\nPlease make sure that your content follows the rules of the platform.",
+        author.Name, itemType, note,
+    )
+    if err := mailer.Send(author.Email, "Warning from the moderators", body); err != nil {
+        context.Logger().Error(err)
+    }
+}
+
+// resolveReports records the action on all the open reports of the item.
+func resolveReports(context echo.Context, itemType string, itemID primitive.ObjectID, moderationIn *ModerationIn) {
+    moderator := context.Get("User").(User)
+
+    filter := bson.M{
+        "item_type": itemType,
+        "item_id": itemID,
+        "status": ReportStatusOpen,
+    }
+    update := bson.M{
+        "$set": bson.M{
+            "updated_at": time.Now(),
+            "status": ReportStatusResolved,
+            "action": moderationIn.Action,
+            "note": moderationIn.Note,
+            "moderator_id": moderator.ID,
+            "resolved_at": time.Now(),
+        },
+    }
+    _, err := reportsCollection.UpdateMany(mongoCtx, filter, update)
+    if err != nil {
+        panic(err)
+    }
+}
+
+// reportPost godoc
+// @Summary Report Post
+// @Tags reports
+// @Accept json
+// @Produce json
+// @Param id path string true "ID"
+// @Param report body ReportIn true "Report"
+// @Security ApiKeyAuth
+// @Success 201 {object} Report
+// @Failure 400
+// @Failure 401
+// @Failure 404
+// @Failure 409
+// @Router /posts/{id}/reports [post]
+func reportPost(context echo.Context) error {
+    post, code := getPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+    if post.HiddenAt != nil || !canViewPost(currentUser(context), post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    report, err := createReport(context, ReportItemPost, post.ID, post.ID, post.Author.ID)
+    if report == nil {
+        return err
+    }
+
+    if reachedReportHideThreshold(ReportItemPost, post.ID) {
+        hiddenAt := time.Now()
+        updatePostHiddenAt(post.ID, bson.M{"hidden_at": nil}, &hiddenAt, true)
+    }
+
+    return context.JSON(http.StatusCreated, report)
+}
+
+// reportComment godoc
+// @Summary Report Comment
+// @Tags reports
+// @Accept json
+// @Produce json
+// @Param post_id path string true "Post ID"
+// @Param comment_id path string true "Comment ID"
+// @Param report body ReportIn true "Report"
+// @Security ApiKeyAuth
+// @Success 201 {object} Report
+// @Failure 400
+// @Failure 401
+// @Failure 404
+// @Failure 409
+// @Router /posts/{post_id}/comments/{comment_id}/reports [post]
+func reportComment(context echo.Context) error {
+    comment, code := getCommentOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+    if comment.HiddenAt != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    postID, _ := primitive.ObjectIDFromHex(context.Param("post_id"))
+
+    // Only the comments of the posts visible to the user can be reported
+    var post Post
+    findOptions := options.FindOne().SetProjection(bson.M{"author": 1, "status": 1, "hidden_at": 1})
+    err := postsCollection.FindOne(mongoCtx, bson.M{"_id": postID}, findOptions).Decode(&post)
+    if err != nil || post.HiddenAt != nil || !canViewPost(currentUser(context), &post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    report, err := createReport(context, ReportItemComment, comment.ID, postID, comment.Author.ID)
+    if report == nil {
+        return err
+    }
+
+    if reachedReportHideThreshold(ReportItemComment, comment.ID) {
+        hiddenAt := time.Now()
+        updateCommentHiddenAt(postID, comment.ID, bson.M{"hidden_at": nil}, &hiddenAt, true)
+    }
+
+    return context.JSON(http.StatusCreated, report)
+}
+
+// listModerationQueue godoc
+// @Summary List Reported Items Awaiting Moderation
+// @Description Items are ordered by the number of open reports, the most reported first.
+// @Tags moderation
+// @Produce json
+// @Param limit query int false "Number of items on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]ModerationQueueItem}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /moderation/queue [get]
+func listModerationQueue(context echo.Context) error {
+    var rows []struct {
+        ItemID      primitive.ObjectID `bson:"_id"`
+        ItemType    string             `bson:"item_type"`
+        PostID      primitive.ObjectID `bson:"post_id"`
+        ReportCount int                `bson:"report_count"`
+        Reasons     []struct {
+            Reason string `bson:"reason"`
+            Count  int    `bson:"count"`
+        } `bson:"reasons"`
+        FirstReportedAt time.Time `bson:"first_reported_at"`
+        LastReportedAt  time.Time `bson:"last_reported_at"`
+    }
+    var next *pageCursor
+    var filter bson.M
+
+    page, err := getPageQuery(context, "-report_count")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
+    filters, findOptions := page.apply(nil)
+    if len(filters) > 0 {
+        filter = bson.M{
+            "$and": filters,
+        }
+    } else {
+        filter = bson.M{}
+    }
+
+    // The open reports are counted per reason and then summed up per item. Object IDs are unique across collections,
+    // so they identify the items on their own and break the ties.
+    pipeline := []bson.M{
+        {"$match": bson.M{"status": ReportStatusOpen}},
+        {"$group": bson.M{
+            "_id": bson.M{
+                "item_type": "$item_type",
+                "item_id": "$item_id",
+                "post_id": "$post_id",
+                "reason": "$reason",
+            },
+            "count": bson.M{"$sum": 1},
+            "first_reported_at": bson.M{"$min": "$created_at"},
+            "last_reported_at": bson.M{"$max": "$created_at"},
+        }},
+        {"$group": bson.M{
+            "_id": "$_id.item_id",
+            "item_type": bson.M{"$first": "$_id.item_type"},
+            "post_id": bson.M{"$first": "$_id.post_id"},
+            "report_count": bson.M{"$sum": "$count"},
+            "reasons": bson.M{"$push": bson.M{"reason": "$_id.reason", "count": "$count"}},
+            "first_reported_at": bson.M{"$min": "$first_reported_at"},
+            "last_reported_at": bson.M{"$max": "$last_reported_at"},
+        }},
+        {"$match": filter},
+        {"$sort": findOptions.Sort},
+        {"$limit": *findOptions.Limit},
+    }
+    cursor, err := reportsCollection.Aggregate(mongoCtx, pipeline)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    err = cursor.All(mongoCtx, &rows)
+    if err != nil {
+        panic(err)
+    }
+
+    if len(rows) > page.Limit {
+        rows = rows[:page.Limit]
+        next = page.cursorAt(sortKeys{ReportCount: rows[page.Limit-1].ReportCount}, rows[page.Limit-1].ItemID)
+    }
+
+    // The posts of the page, which embed the reported comments, are loaded at once
+    postIDs := []primitive.ObjectID{}
+    for _, row := range rows {
+        postIDs = append(postIDs, row.PostID)
+    }
+    postsCursor, err := postsCollection.Find(mongoCtx, bson.M{"_id": bson.M{"$in": postIDs}})
+    if err != nil {
+        panic(err)
+    }
+    defer postsCursor.Close(mongoCtx)
+
+    posts := map[primitive.ObjectID]Post{}
+    for postsCursor.Next(mongoCtx) {
+        var post Post
+
+        err := postsCursor.Decode(&post)
+        if err != nil {
+            panic(err)
+        }
+
+        posts[post.ID] = post
+    }
+
+    queue := []ModerationQueueItem{}
+    for _, row := range rows {
+        item := ModerationQueueItem{
+            ItemType:        row.ItemType,
+            ItemID:          row.ItemID,
+            PostID:          row.PostID,
+            ReportCount:     row.ReportCount,
+            Reasons:         map[string]int{},
+            FirstReportedAt: row.FirstReportedAt,
+            LastReportedAt:  row.LastReportedAt,
+        }
+        for _, reason := range row.Reasons {
+            item.Reasons[reason.Reason] = reason.Count
+        }
+
+        post, ok := posts[row.PostID]
+        switch row.ItemType {
+        case ReportItemPost:
+            if ok {
+                post.Comments = nil
+                item.Post = &post
+            }
+        case ReportItemComment:
+            for i := range post.Comments {
+                if post.Comments[i].ID == row.ItemID {
+                    item.Comment = &post.Comments[i]
+                }
+            }
+        }
+
+        // Items deleted in the meantime by their authors are left out
+        if item.Post == nil && item.Comment == nil {
+            continue
+        }
+
+        queue = append(queue, item)
+    }
+
+    return sendPage(context, queue, next)
+}
+
+// listReports godoc
+// @Summary List Reports
+// @Tags moderation
+// @Produce json
+// @Param status query string false "Status"
+// @Param item_type query string false "Item type"
+// @Param item_id query string false "Item ID"
+// @Security ApiKeyAuth
+// @Success 200 {array} Report
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Router /moderation/reports [get]
+func listReports(context echo.Context) error {
+    reports := []Report{}
+    filter := bson.M{}
+
+    if status := context.QueryParam("status"); status != "" {
+        filter["status"] = status
+    }
+    if itemType := context.QueryParam("item_type"); itemType != "" {
+        filter["item_type"] = itemType
+    }
+    if itemID := context.QueryParam("item_id"); itemID != "" {
+        id, err := primitive.ObjectIDFromHex(itemID)
+        if err != nil {
+            return context.NoContent(http.StatusBadRequest)
+        }
+        filter["item_id"] = id
+    }
+
+    findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+    cursor, err := reportsCollection.Find(mongoCtx, filter, findOptions)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var report Report
+
+        err := cursor.Decode(&report)
+        if err != nil {
+            panic(err)
+        }
+
+        reports = append(reports, report)
+    }
+
+    return context.JSON(http.StatusOK, reports)
+}
+
+// moderatePost godoc
+// @Summary Act on Reported Post
+// @Description Dismissing the reports makes the post visible again, in case it has been hidden by them.
+// @Tags moderation
+// @Accept json
+// @Param id path string true "ID"
+// @Param action body ModerationIn true "Action"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /moderation/posts/{id} [post]
+func moderatePost(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    post, code := getPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    moderationIn, err := bindModerationIn(context)
+    if moderationIn == nil {
+        return err
+    }
+
+    if countOpenReports(ReportItemPost, post.ID) == 0 {
+        return context.JSON(http.StatusNotFound, "There are no open reports of this post.")
+    }
+
+    switch moderationIn.Action {
+    case ModerationDismiss:
+        updatePostHiddenAt(post.ID, bson.M{"hidden_by_reports": true}, nil, false)
+    case ModerationHide:
+        if !canHidePost(user, post) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        if post.HiddenAt == nil || post.HiddenByReports {
+            hiddenAt := time.Now()
+            updatePostHiddenAt(post.ID, nil, &hiddenAt, false)
+        }
+    case ModerationDelete:
+        if !canDeletePost(user, post) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        trashPost(user, post)
+    case ModerationWarn:
+        warnAuthor(context, post.Author.ID, ReportItemPost, moderationIn.Note)
+    }
+
+    resolveReports(context, ReportItemPost, post.ID, moderationIn)
+    emitAudit(context, AuditModeration+moderationIn.Action, postTarget(post))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// moderateComment godoc
+// @Summary Act on Reported Comment
+// @Description Dismissing the reports makes the comment visible again, in case it has been hidden by them.
+// @Tags moderation
+// @Accept json
+// @Param post_id path string true "Post ID"
+// @Param comment_id path string true "Comment ID"
+// @Param action body ModerationIn true "Action"
+// @Security ApiKeyAuth
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /moderation/posts/{post_id}/comments/{comment_id} [post]
+func moderateComment(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    comment, code := getCommentOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    moderationIn, err := bindModerationIn(context)
+    if moderationIn == nil {
+        return err
+    }
+
+    if countOpenReports(ReportItemComment, comment.ID) == 0 {
+        return context.JSON(http.StatusNotFound, "There are no open reports of this comment.")
+    }
+
+    postID, _ := primitive.ObjectIDFromHex(context.Param("post_id"))
+
+    switch moderationIn.Action {
+    case ModerationDismiss:
+        updateCommentHiddenAt(postID, comment.ID, bson.M{"hidden_by_reports": true}, nil, false)
+    case ModerationHide:
+        if !canHideComment(user, comment) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        if comment.HiddenAt == nil || comment.HiddenByReports {
+            hiddenAt := time.Now()
+            updateCommentHiddenAt(postID, comment.ID, nil, &hiddenAt, false)
+        }
+    case ModerationDelete:
+        if !canDeleteComment(user, comment) {
+            return context.NoContent(http.StatusForbidden)
+        }
+        trashComment(user, postID, comment)
+    case ModerationWarn:
+        warnAuthor(context, comment.Author.ID, ReportItemComment, moderationIn.Note)
+    }
+
+    resolveReports(context, ReportItemComment, comment.ID, moderationIn)
+    emitAudit(context, AuditModeration+moderationIn.Action, commentTarget(comment))
+
+    return context.NoContent(http.StatusNoContent)
+}
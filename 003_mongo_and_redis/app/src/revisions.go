@@ -0,0 +1,291 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type (
+    // PostRevision is the title and the content of the post as saved by one of its edits. Revisions are numbered from
+    // 1 within the post.
+    PostRevision struct {
+        ID        primitive.ObjectID `bson:"_id" json:"_id"`
+        CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+        PostID    primitive.ObjectID `bson:"post_id" json:"post_id"`
+        Number    int                `bson:"number" json:"number"`
+        Editor    User               `bson:"editor" json:"editor"`
+        Title     string             `bson:"title" json:"title"`
+        Content   string             `bson:"content" json:"content"`
+    }
+)
+
+// text renders the revision as compared by the diffs, the title being the first line.
+func (revision *PostRevision) text() string {
+    return revision.Title + "\n\n" + revision.Content
+}
+
+// saveRevision records the current title and content of the post as its next revision. The number is unique within
+// the post, so an edit racing with another one takes the next number.
+func saveRevision(post *Post, editor User, createdAt time.Time) {
+    revision := new(PostRevision)
+    revision.CreatedAt = createdAt
+    revision.PostID = post.ID
+    revision.Editor = editor.withoutSecrets()
+    revision.Title = post.Title
+    revision.Content = post.Content
+
+    for {
+        var last PostRevision
+
+        findOptions := options.FindOne().SetSort(bson.D{{Key: "number", Value: -1}})
+        err := postRevisionsCollection.FindOne(mongoCtx, bson.M{"post_id": post.ID}, findOptions).Decode(&last)
+        if err != nil && err != mongo.ErrNoDocuments {
+            panic(err)
+        }
+
+        revision.ID = primitive.NewObjectID()
+        revision.Number = last.Number + 1
+        _, err = postRevisionsCollection.InsertOne(mongoCtx, revision)
+        if err == nil {
+            return
+        }
+        if !strings.Contains(err.Error(), "E11000") {
+            panic(err)
+        }
+    }
+}
+
+// startRevisionHistory records the post as its first revision, in case it was written before the revisions were
+// kept, so that its original text is not lost with the edit.
+func startRevisionHistory(post *Post) {
+    count, err := postRevisionsCollection.CountDocuments(mongoCtx, bson.M{"post_id": post.ID})
+    if err != nil {
+        panic(err)
+    }
+    if count == 0 {
+        saveRevision(post, post.Author, post.UpdatedAt)
+    }
+}
+
+func getPostRevisionOrError(post *Post, number string) (*PostRevision, int) {
+    var revision PostRevision
+
+    rev, err := strconv.Atoi(number)
+    if err != nil {
+        return nil, http.StatusBadRequest
+    }
+
+    filter := bson.M{
+        "post_id": post.ID,
+        "number": rev,
+    }
+    err = postRevisionsCollection.FindOne(mongoCtx, filter).Decode(&revision)
+    if err != nil {
+        return nil, http.StatusNotFound
+    }
+
+    return &revision, 0
+}
+
+// getRevisedPostOrError fetches the post whose revisions are requested. They are available to the users allowed to
+// edit the post, as they may hold text removed from it on purpose.
+func getRevisedPostOrError(context echo.Context) (*Post, int) {
+    post, code := getPostOrError(context)
+    if code != 0 {
+        return nil, code
+    }
+
+    if !canUpdatePost(context.Get("User").(User), post) {
+        return nil, http.StatusForbidden
+    }
+
+    return post, 0
+}
+
+// listPostRevisions godoc
+// @Summary List Post Revisions
+// @Tags revisions
+// @Produce json
+// @Param id path string true "ID"
+// @Security ApiKeyAuth
+// @Success 200 {array} PostRevision
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/revisions [get]
+func listPostRevisions(context echo.Context) error {
+    post, code := getRevisedPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    revisions := []PostRevision{}
+
+    findOptions := options.Find().SetSort(bson.D{{Key: "number", Value: -1}})
+    cursor, err := postRevisionsCollection.Find(mongoCtx, bson.M{"post_id": post.ID}, findOptions)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var revision PostRevision
+
+        err := cursor.Decode(&revision)
+        if err != nil {
+            panic(err)
+        }
+
+        revisions = append(revisions, revision)
+    }
+
+    return context.JSON(http.StatusOK, revisions)
+}
+
+// retrievePostRevision godoc
+// @Summary Retrieve Post Revision
+// @Tags revisions
+// @Produce json
+// @Param id path string true "ID"
+// @Param rev path int true "Revision number"
+// @Security ApiKeyAuth
+// @Success 200 {object} PostRevision
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/revisions/{rev} [get]
+func retrievePostRevision(context echo.Context) error {
+    post, code := getRevisedPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    revision, code := getPostRevisionOrError(post, context.Param("rev"))
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    return context.JSON(http.StatusOK, revision)
+}
+
+// diffPostRevision godoc
+// @Summary Diff Post Revisions
+// @Description Shows the changes made by the revision, or since the revision given in from, as a unified diff. The
+// @Description title is the first line of the compared text.
+// @Tags revisions
+// @Produce plain
+// @Param id path string true "ID"
+// @Param rev path int true "Revision number"
+// @Param from query int false "Revision number to compare with, the previous one by default"
+// @Security ApiKeyAuth
+// @Success 200 {string} string
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/revisions/{rev}/diff [get]
+func diffPostRevision(context echo.Context) error {
+    post, code := getRevisedPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    revision, code := getPostRevisionOrError(post, context.Param("rev"))
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    // The first revision is compared with an empty text
+    fromName, fromText := "/dev/null", ""
+    number := context.QueryParam("from")
+    if number == "" && revision.Number > 1 {
+        number = strconv.Itoa(revision.Number - 1)
+    }
+    if number != "" {
+        from, code := getPostRevisionOrError(post, number)
+        if code != 0 {
+            return context.NoContent(code)
+        }
+        fromName, fromText = fmt.Sprintf("revision %v", from.Number), from.text()
+    }
+    diff := unifiedDiff(fromName, fmt.Sprintf("revision %v", revision.Number), fromText, revision.text())
+
+    return context.String(http.StatusOK, diff)
+}
+
+// restorePostRevision godoc
+// @Summary Restore Post Revision
+// @Description Sets the title and the content of the post back to the revision, which is recorded as a new revision.
+// @Tags revisions
+// @Produce json
+// @Param id path string true "ID"
+// @Param rev path int true "Revision number"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 409
+// @Failure 412
+// @Router /posts/{id}/revisions/{rev}/restore [post]
+func restorePostRevision(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    post, code := getRevisedPostOrError(context)
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    revision, code := getPostRevisionOrError(post, context.Param("rev"))
+    if code != 0 {
+        return context.NoContent(code)
+    }
+    if !ifMatch(context, post.etag()) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
+    updatedAt := post.UpdatedAt
+    post.UpdatedAt = time.Now()
+    post.Title = revision.Title
+    post.Content = revision.Content
+
+    // The post is written only if nobody has changed it since it has been read
+    filter := bson.M{
+        "_id": post.ID,
+        "updated_at": updatedAt,
+    }
+    update := bson.M{
+        "$set": bson.M{
+            "updated_at": post.UpdatedAt,
+            "title": post.Title,
+            "content": post.Content,
+        },
+    }
+    result, err := postsCollection.UpdateOne(mongoCtx, filter, update)
+    if err != nil {
+        panic(err)
+    } else if result.MatchedCount != 1 {
+        return context.JSON(http.StatusConflict, "The post has been changed in the meantime.")
+    }
+    assignSlug(post)
+    saveRevision(post, user, post.UpdatedAt)
+    emitAudit(context, AuditPostRevert, postTarget(post))
+
+    post = post.withoutHiddenComments()
+    setETag(context, post.etag())
+
+    return context.JSON(http.StatusOK, post)
+}
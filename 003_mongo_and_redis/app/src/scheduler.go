@@ -0,0 +1,77 @@
+package main
+
+import (
+    "github.com/go-redis/redis/v8"
+    "github.com/labstack/gommon/log"
+    "github.com/labstack/gommon/random"
+    "go.mongodb.org/mongo-driver/bson"
+    "time"
+)
+
+var (
+    // How often the scheduled posts are checked for being due
+    schedulerInterval time.Duration
+)
+
+// releaseLockScript deletes the lock only if it is still held by the same owner, as it may have expired in the
+// meantime and been taken by somebody else.
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+    return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+func setupScheduler() {
+    schedulerInterval = getEnvDuration("BP_SCHEDULER_INTERVAL", time.Minute)
+
+    go runScheduler()
+}
+
+func runScheduler() {
+    for {
+        withRedisLock("lock:scheduler", schedulerInterval, publishScheduledPosts)
+        time.Sleep(schedulerInterval)
+    }
+}
+
+// withRedisLock runs the function unless another replica holds the lock at the moment. The lock expires after the TTL
+// in case its holder dies. It returns whether the function has been run. It runs in the background, so a failure to
+// take the lock is only logged.
+func withRedisLock(key string, ttl time.Duration, function func()) bool {
+    token := random.String(16, random.Alphanumeric)
+
+    acquired, err := redisClient.SetNX(redisCtx, key, token, ttl).Result()
+    if err != nil {
+        log.Error(err)
+        return false
+    }
+    if !acquired {
+        return false
+    }
+    defer releaseLockScript.Run(redisCtx, redisClient, []string{key}, token)
+
+    function()
+    return true
+}
+
+// publishScheduledPosts publishes the scheduled posts which are due. They count as updated, so that their entity tags
+// change. A failure is logged and the posts are tried again next time.
+func publishScheduledPosts() {
+    now := time.Now()
+
+    filter := bson.M{
+        "status": PostScheduled,
+        "publish_at": bson.M{"$lte": now},
+    }
+    update := bson.M{
+        "$set": bson.M{
+            "status": PostPublished,
+            "updated_at": now,
+        },
+    }
+    _, err := postsCollection.UpdateMany(mongoCtx, filter, update)
+    if err != nil {
+        log.Error(err)
+    }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "html"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // Number of bytes of the text shown in a snippet
+    snippetLength = 160
+)
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+type (
+    SearchResult struct {
+        // Either post or comment
+        Type    string             `json:"type"`
+        ID      primitive.ObjectID `json:"id"`
+        PostID  primitive.ObjectID `json:"post_id"`
+        Title   string             `json:"title,omitempty"`
+        // Part of the content around the first match, as HTML with the matching words in <mark>
+        Snippet string             `json:"snippet"`
+        Score   float64            `json:"score"`
+    }
+
+    // Searcher finds the published posts and their comments matching the query, ranked from the most relevant.
+    Searcher interface {
+        Search(query string, limit int) ([]SearchResult, error)
+    }
+
+    // mongoSearcher searches the posts with the text index on their titles, contents and the contents of their
+    // comments. A post is split into the post itself and its comments found by the words of the query, all ranked with
+    // the score of the post.
+    mongoSearcher struct{}
+)
+
+var searcher Searcher = mongoSearcher{}
+
+func (searcher mongoSearcher) Search(query string, limit int) ([]SearchResult, error) {
+    var results = []SearchResult{}
+
+    filter := bson.M{
+        "$text": bson.M{"$search": query},
+        "hidden_at": nil,
+        "status": PostPublished,
+    }
+    score := bson.M{"$meta": "textScore"}
+    findOptions := options.Find().
+        SetProjection(bson.M{"score": score}).
+        SetSort(bson.M{"score": score}).
+        SetLimit(int64(limit))
+    cursor, err := postsCollection.Find(mongoCtx, filter, findOptions)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var match struct {
+            Post  `bson:",inline"`
+            Score float64 `bson:"score"`
+        }
+
+        err := cursor.Decode(&match)
+        if err != nil {
+            return nil, err
+        }
+
+        found := false
+        for _, comment := range match.Comments {
+            if comment.HiddenAt == nil && containsSearch(comment.Content, query) {
+                results = append(results, SearchResult{
+                    Type:    "comment",
+                    ID:      comment.ID,
+                    PostID:  match.ID,
+                    Snippet: highlight(comment.Content, query),
+                    Score:   match.Score,
+                })
+                found = true
+            }
+        }
+        // The post is found by itself also when its words only differ in their form from the ones of the query
+        if !found || containsSearch(match.Title+" "+match.Content, query) {
+            results = append(results, SearchResult{
+                Type:    "post",
+                ID:      match.ID,
+                PostID:  match.ID,
+                Title:   match.Title,
+                Snippet: highlight(match.Content, query),
+                Score:   match.Score,
+            })
+        }
+    }
+
+    sort.SliceStable(results, func(i int, j int) bool {
+        return results[i].Score > results[j].Score
+    })
+    if len(results) > limit {
+        results = results[:limit]
+    }
+
+    return results, nil
+}
+
+// containsSearch tells whether any word of the text matches the query.
+func containsSearch(text string, query string) bool {
+    for _, word := range wordPattern.FindAllString(text, -1) {
+        if matchesSearch(word, query) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// matchesSearch tells whether the word starts with one of the words of the query, so that the inflected forms found
+// by the search are matched too.
+func matchesSearch(word string, query string) bool {
+    word = strings.ToLower(word)
+    for _, term := range wordPattern.FindAllString(strings.ToLower(query), -1) {
+        if strings.HasPrefix(word, term) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// highlight returns the part of the text around the first word matching the query, as HTML with the matching words
+// in <mark>.
+func highlight(text string, query string) string {
+    var snippet strings.Builder
+
+    words := wordPattern.FindAllStringIndex(text, -1)
+
+    start := 0
+    for _, word := range words {
+        if matchesSearch(text[word[0]:word[1]], query) {
+            start = word[0] - snippetLength/4
+            break
+        }
+    }
+    if start < 0 {
+        start = 0
+    }
+    end := start + snippetLength
+    if end > len(text) {
+        end = len(text)
+    }
+
+    // The text is cut between the characters
+    for start > 0 && !utf8.RuneStart(text[start]) {
+        start--
+    }
+    for end < len(text) && !utf8.RuneStart(text[end]) {
+        end++
+    }
+
+    if start > 0 {
+        snippet.WriteString("…")
+    }
+    position := start
+    for _, word := range words {
+        if word[0] < start || word[1] > end || !matchesSearch(text[word[0]:word[1]], query) {
+            continue
+        }
+        snippet.WriteString(html.EscapeString(text[position:word[0]]))
+        snippet.WriteString("<mark>" + html.EscapeString(text[word[0]:word[1]]) + "</mark>")
+        position = word[1]
+    }
+    snippet.WriteString(html.EscapeString(text[position:end]))
+    if end < len(text) {
+        snippet.WriteString("…")
+    }
+
+    return snippet.String()
+}
+
+// searchContent godoc
+// @Summary Search
+// @Description Finds the published posts and their comments matching the query, ranked from the most relevant.
+// @Tags search
+// @Produce json
+// @Param q query string true "Query"
+// @Param limit query int false "Number of results, 20 by default and 100 at most"
+// @Success 200 {array} SearchResult
+// @Failure 400
+// @Router /search [get]
+func searchContent(context echo.Context) error {
+    query := strings.TrimSpace(context.QueryParam("q"))
+    if query == "" {
+        return context.JSON(http.StatusBadRequest, "Provided query is empty.")
+    }
+
+    limit := defaultPageLimit
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > maxPageLimit {
+            return context.JSON(http.StatusBadRequest, "Provided limit is invalid.")
+        }
+        limit = number
+    }
+
+    results, err := searcher.Search(query, limit)
+    if err != nil {
+        return err
+    }
+
+    return context.JSON(http.StatusOK, results)
+}
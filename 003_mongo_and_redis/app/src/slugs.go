@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+const (
+    // Number of bytes of the title kept in a slug
+    maxSlugLength = 64
+)
+
+type (
+    // PostSlug is a slug the post can be found by. Besides the current one, the slugs of its former titles are kept,
+    // so that the old links lead to it.
+    PostSlug struct {
+        Slug      string             `bson:"_id"`
+        CreatedAt time.Time          `bson:"created_at"`
+        PostID    primitive.ObjectID `bson:"post_id"`
+    }
+)
+
+// slugBase returns the slug made of the title, before a number is added to it to make it unique.
+func slugBase(title string) string {
+    slug := slugify(title)
+    if len(slug) > maxSlugLength {
+        end := maxSlugLength
+        for !utf8.RuneStart(slug[end]) {
+            end--
+        }
+        slug = strings.TrimRight(slug[:end], "-")
+    }
+    if slug == "" {
+        slug = "post"
+    }
+
+    return slug
+}
+
+// hasSlugBase tells whether the slug has been made of the base, with or without a number.
+func hasSlugBase(slug string, base string) bool {
+    if slug == base {
+        return true
+    }
+
+    number := strings.TrimPrefix(slug, base+"-")
+    return number != slug && number != "" && strings.Trim(number, "0123456789") == ""
+}
+
+// assignSlug gives the post a unique slug made of its title, unless the current one has been made of the same words.
+// The previous slug stays behind, pointing at the post.
+func assignSlug(post *Post) {
+    base := slugBase(post.Title)
+    if hasSlugBase(post.Slug, base) {
+        return
+    }
+
+    for number := 1; ; number++ {
+        slug := base
+        if number > 1 {
+            slug = fmt.Sprintf("%v-%v", base, number)
+        }
+
+        postSlug := PostSlug{Slug: slug, CreatedAt: time.Now(), PostID: post.ID}
+        _, err := postSlugsCollection.InsertOne(mongoCtx, postSlug)
+        if err != nil {
+            if !strings.Contains(err.Error(), "E11000") {
+                panic(err)
+            }
+
+            // A former slug of the post is taken back, but nobody else's
+            err = postSlugsCollection.FindOne(mongoCtx, bson.M{"_id": slug}).Decode(&postSlug)
+            if err != nil {
+                panic(err)
+            }
+            if postSlug.PostID != post.ID {
+                continue
+            }
+        }
+
+        post.Slug = slug
+        update := bson.M{"$set": bson.M{"slug": slug}}
+        _, err = postsCollection.UpdateOne(mongoCtx, bson.M{"_id": post.ID}, update)
+        if err != nil {
+            panic(err)
+        }
+        return
+    }
+}
+
+// assignMissingSlugs gives slugs to the posts created before the slugs have been introduced.
+func assignMissingSlugs() {
+    cursor, err := postsCollection.Find(mongoCtx, bson.M{"slug": bson.M{"$in": []interface{}{nil, ""}}})
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var post Post
+
+        err := cursor.Decode(&post)
+        if err != nil {
+            panic(err)
+        }
+
+        assignSlug(&post)
+    }
+}
+
+// retrievePostBySlug godoc
+// @Summary Retrieve Post by Slug
+// @Description A former slug of the post redirects to the current one.
+// @Tags posts
+// @Produce json
+// @Param slug path string true "Slug"
+// @Param If-None-Match header string false "ETag of the cached version"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 301
+// @Header 301 {string} Location "Current slug of the post"
+// @Success 304
+// @Failure 404
+// @Router /posts/by-slug/{slug} [get]
+func retrievePostBySlug(context echo.Context) error {
+    var postSlug PostSlug
+    var post Post
+
+    err := postSlugsCollection.FindOne(mongoCtx, bson.M{"_id": context.Param("slug")}).Decode(&postSlug)
+    if err != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+    err = postsCollection.FindOne(mongoCtx, bson.M{"_id": postSlug.PostID}).Decode(&post)
+    if err != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    // The post is checked first, so that the redirect does not reveal the slugs of the posts which can not be seen
+    if post.HiddenAt != nil || !canViewPost(currentUser(context), &post) {
+        return context.NoContent(http.StatusNotFound)
+    }
+    if post.Slug != postSlug.Slug {
+        return context.Redirect(http.StatusMovedPermanently, "/posts/by-slug/"+url.PathEscape(post.Slug))
+    }
+
+    return sendPost(context, &post)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "go.mongodb.org/mongo-driver/bson"
+    "net/http"
+    "regexp"
+    "strings"
+)
+
+var slugSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+type (
+    Tag struct {
+        Name string `bson:"name" json:"name"`
+        // Normalized name identifying the tag
+        Slug string `bson:"slug" json:"slug"`
+    }
+
+    TagUsage struct {
+        Tag `bson:",inline"`
+        // Number of the published posts with the tag
+        PostCount int64 `bson:"post_count" json:"post_count"`
+    }
+)
+
+// slugify normalizes the name of a tag to lowercase letters and digits separated by single hyphens.
+func slugify(name string) string {
+    return strings.Trim(slugSeparators.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// newTags returns the tags of the given names, merging the ones normalized to the same slug. It returns a message
+// explaining why a name can not be a tag, or an empty string.
+func newTags(names []string) ([]Tag, string) {
+    tags := []Tag{}
+    slugs := map[string]bool{}
+
+    for _, name := range names {
+        tag := Tag{Name: strings.TrimSpace(name), Slug: slugify(name)}
+        if tag.Slug == "" {
+            return nil, "Provided tag is invalid."
+        }
+        if !slugs[tag.Slug] {
+            slugs[tag.Slug] = true
+            tags = append(tags, tag)
+        }
+    }
+
+    return tags, ""
+}
+
+// tagNames returns the names of the tags of the post.
+func (post *Post) tagNames() []string {
+    names := []string{}
+    for _, tag := range post.Tags {
+        names = append(names, tag.Name)
+    }
+
+    return names
+}
+
+// listTags godoc
+// @Summary List Tags
+// @Description Lists the tags of the published posts along with the number of the posts, from the most used. A tag is
+// @Description named the way it has been named on the oldest of them.
+// @Tags tags
+// @Produce json
+// @Success 200 {array} TagUsage
+// @Router /tags [get]
+func listTags(context echo.Context) error {
+    var tags = []TagUsage{}
+
+    pipeline := []bson.M{
+        {"$match": bson.M{"hidden_at": nil, "status": PostPublished}},
+        {"$sort": bson.M{"created_at": 1}},
+        {"$unwind": "$tags"},
+        {"$group": bson.M{
+            "_id": "$tags.slug",
+            "name": bson.M{"$first": "$tags.name"},
+            "post_count": bson.M{"$sum": 1},
+        }},
+        {"$project": bson.M{"_id": 0, "slug": "$_id", "name": 1, "post_count": 1}},
+        {"$sort": bson.D{{Key: "post_count", Value: -1}, {Key: "slug", Value: 1}}},
+    }
+    cursor, err := postsCollection.Aggregate(mongoCtx, pipeline)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    for cursor.Next(mongoCtx) {
+        var tag TagUsage
+
+        err := cursor.Decode(&tag)
+        if err != nil {
+            panic(err)
+        }
+
+        tags = append(tags, tag)
+    }
+
+    return context.JSON(http.StatusOK, tags)
+}
+
+// listTagPosts godoc
+// @Summary List Tag Posts
+// @Description Lists the posts with the tag, the same way as all the posts are listed.
+// @Tags tags
+// @Produce json
+// @Param slug path string true "Slug"
+// @Param author_id query string false "Author IDs, comma-separated"
+// @Param title_prefix query string false "Beginning of the title"
+// @Param created_after query string false "Created after, in RFC 3339"
+// @Param created_before query string false "Created before, in RFC 3339"
+// @Param updated_after query string false "Updated after, in RFC 3339"
+// @Param sort query string false "created_at, updated_at or title, prefixed with a minus for the descending order"
+// @Param limit query int false "Number of posts on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Security ApiKeyAuth
+// @Success 200 {object} Page{items=[]Post}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
+// @Failure 404
+// @Router /tags/{slug}/posts [get]
+func listTagPosts(context echo.Context) error {
+    filter := bson.M{
+        "tags.slug": slugify(context.Param("slug")),
+    }
+    count, err := postsCollection.CountDocuments(mongoCtx, filter)
+    if err != nil {
+        panic(err)
+    }
+    if count == 0 {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    return listMatchingPosts(context, []bson.M{filter})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/random"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type (
+    TotpCode struct {
+        Code string `json:"code" validate:"required"`
+    }
+
+    TotpEnrollmentOut struct {
+        Secret          string `json:"secret"`
+        ProvisioningURI string `json:"provisioning_uri"`
+    }
+
+    RecoveryCodesOut struct {
+        RecoveryCodes []string `json:"recovery_codes"`
+    }
+
+    MfaChallengeOut struct {
+        MfaRequired bool      `json:"mfa_required"`
+        MfaToken    string    `json:"mfa_token"`
+        ExpiresAt   time.Time `json:"expires_at"`
+    }
+)
+
+// RFC 6238 defaults, which are the only parameters supported by most authenticator apps
+const (
+    totpPeriod     = 30
+    totpDigits     = 6
+    totpSkew       = 1
+    totpSecretSize = 20
+
+    recoveryCodesCount = 10
+)
+
+var (
+    totpIssuer        string
+    totpEnrollmentTTL time.Duration
+    mfaChallengeTTL   time.Duration
+)
+
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func setupTotp() {
+    totpIssuer = os.Getenv("BP_TOTP_ISSUER")
+    if totpIssuer == "" {
+        totpIssuer = "Blogging Platform"
+    }
+
+    totpEnrollmentTTL = getEnvDuration("BP_TOTP_ENROLLMENT_TTL", 10 * time.Minute)
+    mfaChallengeTTL = getEnvDuration("BP_MFA_CHALLENGE_TTL", 5 * time.Minute)
+}
+
+func totpEnrollmentKey(userID primitive.ObjectID) string {
+    return fmt.Sprintf("totp_enrollment:%v", userID.Hex())
+}
+
+func totpUsedKey(userID primitive.ObjectID, step int64) string {
+    return fmt.Sprintf("totp_used:%v:%v", userID.Hex(), step)
+}
+
+func mfaChallengeKey(token string) string {
+    return "mfa_challenge:" + hashToken(token)
+}
+
+func generateTotpCode(secret []byte, step int64) string {
+    message := make([]byte, 8)
+    binary.BigEndian.PutUint64(message, uint64(step))
+
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(message)
+    sum := mac.Sum(nil)
+
+    // Dynamic truncation as described in RFC 4226
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+    return fmt.Sprintf("%0*d", totpDigits, value % 1000000)
+}
+
+// checkTotpCode accepts the code of the current time step or of one of the adjacent ones, to make up for clock drift.
+// Every code is accepted only once.
+func checkTotpCode(userID primitive.ObjectID, encodedSecret string, code string) bool {
+    secret, err := totpSecretEncoding.DecodeString(encodedSecret)
+    if err != nil {
+        return false
+    }
+
+    current := time.Now().Unix() / totpPeriod
+    for step := current - totpSkew; step <= current + totpSkew; step++ {
+        if subtle.ConstantTimeCompare([]byte(generateTotpCode(secret, step)), []byte(code)) != 1 {
+            continue
+        }
+
+        // The key outlives the window in which the code is accepted
+        ttl := (2 * totpSkew + 1) * totpPeriod * time.Second
+        fresh, err := redisClient.SetNX(redisCtx, totpUsedKey(userID, step), 1, ttl).Result()
+        if err != nil {
+            panic(err)
+        }
+        return fresh
+    }
+
+    return false
+}
+
+func normalizeRecoveryCode(code string) string {
+    return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// useRecoveryCode deletes the matching recovery code of the user and reports whether there has been one.
+func useRecoveryCode(user User, code string) bool {
+    codeHash := hashToken(normalizeRecoveryCode(code))
+
+    filter := bson.M{
+        "_id":            user.ID,
+        "recovery_codes": codeHash,
+    }
+    update := bson.M{
+        "$pull": bson.M{"recovery_codes": codeHash},
+    }
+    result, err := usersCollection.UpdateOne(mongoCtx, filter, update)
+    if err != nil {
+        panic(err)
+    }
+
+    return result.ModifiedCount == 1
+}
+
+// checkSecondFactor accepts either a TOTP code or one of the recovery codes of the user.
+func checkSecondFactor(user User, code string) bool {
+    code = strings.TrimSpace(code)
+    if len(code) == totpDigits {
+        return checkTotpCode(user.ID, user.TotpSecret, code)
+    }
+    return useRecoveryCode(user, code)
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user with new ones and returns them in plain text.
+func generateRecoveryCodes(user User) []string {
+    codes := make([]string, recoveryCodesCount)
+    codeHashes := make([]string, recoveryCodesCount)
+
+    for i := range codes {
+        code := random.String(10, random.Lowercase, random.Numeric)
+        codes[i] = code[:5] + "-" + code[5:]
+        codeHashes[i] = hashToken(code)
+    }
+
+    update := bson.M{
+        "$set": bson.M{"recovery_codes": codeHashes},
+    }
+    _, err := usersCollection.UpdateOne(mongoCtx, bson.M{"_id": user.ID}, update)
+    if err != nil {
+        panic(err)
+    }
+
+    return codes
+}
+
+// respondWithMfaChallenge answers a login with a correct password to an account with two-factor authentication enabled.
+// The challenge token has to be exchanged for a session together with a code.
+func respondWithMfaChallenge(context echo.Context, user User) error {
+    token := random.String(32, random.Alphanumeric)
+
+    err := redisClient.Set(redisCtx, mfaChallengeKey(token), user.ID.Hex(), mfaChallengeTTL).Err()
+    if err != nil {
+        panic(err)
+    }
+
+    return context.JSON(http.StatusAccepted, MfaChallengeOut{
+        MfaRequired: true,
+        MfaToken:    token,
+        ExpiresAt:   time.Now().Add(mfaChallengeTTL),
+    })
+}
+
+// enrollTotp godoc
+// @Summary Start TOTP Enrollment of Current User
+// @Tags totp
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 201 {object} TotpEnrollmentOut
+// @Failure 400
+// @Failure 401
+// @Router /totp/enroll [post]
+func enrollTotp(context echo.Context) error {
+    user := context.Get("User").(User)
+    if user.TotpEnabled {
+        return context.JSON(http.StatusBadRequest, "Two-factor authentication is already enabled.")
+    }
+
+    secret := make([]byte, totpSecretSize)
+    if _, err := rand.Read(secret); err != nil {
+        return err
+    }
+    encodedSecret := totpSecretEncoding.EncodeToString(secret)
+
+    // The secret is kept aside until the user proves with a code that their authenticator has picked it up
+    err := redisClient.Set(redisCtx, totpEnrollmentKey(user.ID), encodedSecret, totpEnrollmentTTL).Err()
+    if err != nil {
+        panic(err)
+    }
+
+    label := url.PathEscape(totpIssuer + ":" + user.Name)
+    query := url.Values{}
+    query.Set("secret", encodedSecret)
+    query.Set("issuer", totpIssuer)
+    query.Set("algorithm", "SHA1")
+    query.Set("digits", strconv.Itoa(totpDigits))
+    query.Set("period", strconv.Itoa(totpPeriod))
+
+    return context.JSON(http.StatusCreated, TotpEnrollmentOut{
+        Secret:          encodedSecret,
+        ProvisioningURI: "otpauth://totp/" + label + "?" + query.Encode(),
+    })
+}
+
+// confirmTotp godoc
+// @Summary Confirm TOTP Enrollment of Current User
+// @Tags totp
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param code body TotpCode true "Code"
+// @Success 200 {object} RecoveryCodesOut
+// @Failure 400
+// @Failure 401
+// @Router /totp/confirm [post]
+func confirmTotp(context echo.Context) error {
+    user := context.Get("User").(User)
+
+    totpCode := new(TotpCode)
+    if err := context.Bind(totpCode); err != nil {
+        return err
+    }
+    if err := context.Validate(totpCode); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    encodedSecret, err := redisClient.Get(redisCtx, totpEnrollmentKey(user.ID)).Result()
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, "There is no pending enrollment.")
+    }
+
+    if !checkTotpCode(user.ID, encodedSecret, strings.TrimSpace(totpCode.Code)) {
+        return context.JSON(http.StatusBadRequest, "Provided code is invalid.")
+    }
+
+    redisClient.Del(redisCtx, totpEnrollmentKey(user.ID))
+
+    user.TotpSecret = encodedSecret
+    user.TotpEnabled = true
+    update := bson.M{
+        "$set": bson.M{"totp_secret": user.TotpSecret, "totp_enabled": true},
+    }
+    _, err = usersCollection.UpdateOne(mongoCtx, bson.M{"_id": user.ID}, update)
+    if err != nil {
+        panic(err)
+    }
+
+    recoveryCodes := generateRecoveryCodes(user)
+    updateUserSessions(user)
+    emitAudit(context, AuditTotpEnable, userTarget(user))
+
+    return context.JSON(http.StatusOK, RecoveryCodesOut{RecoveryCodes: recoveryCodes})
+}
+
+// disableTotp godoc
+// @Summary Disable TOTP of Current User
+// @Tags totp
+// @Accept json
+// @Security ApiKeyAuth
+// @Param code body TotpCode true "TOTP or recovery code"
+// @Success 204
+// @Failure 400
+// @Failure 401
+// @Router /totp [delete]
+func disableTotp(context echo.Context) error {
+    var user User
+
+    totpCode := new(TotpCode)
+    if err := context.Bind(totpCode); err != nil {
+        return err
+    }
+    if err := context.Validate(totpCode); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    // The secret is not part of the cached copy of the user
+    err := usersCollection.FindOne(mongoCtx, bson.M{"_id": context.Get("User").(User).ID}).Decode(&user)
+    if err != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+    if !user.TotpEnabled {
+        return context.JSON(http.StatusBadRequest, "Two-factor authentication is not enabled.")
+    }
+
+    if !checkSecondFactor(user, totpCode.Code) {
+        return context.JSON(http.StatusBadRequest, "Provided code is invalid.")
+    }
+
+    user.TotpSecret = ""
+    user.TotpEnabled = false
+    update := bson.M{
+        "$set":   bson.M{"totp_secret": "", "totp_enabled": false},
+        "$unset": bson.M{"recovery_codes": ""},
+    }
+    _, err = usersCollection.UpdateOne(mongoCtx, bson.M{"_id": user.ID}, update)
+    if err != nil {
+        panic(err)
+    }
+    updateUserSessions(user)
+    emitAudit(context, AuditTotpDisable, userTarget(user))
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+// issueMfaAuthToken godoc
+// @Summary Issue Auth Token / Complete Login with Second Factor
+// @Tags auth
+// @Accept mpfd
+// @Produce json
+// @Param mfa_token formData string true "MFA challenge token"
+// @Param code formData string true "TOTP or recovery code"
+// @Success 201 {object} TokenOut
+// @Failure 401
+// @Failure 403 {object} SuspensionOut
+// @Failure 429
+// @Router /token/mfa [post]
+func issueMfaAuthToken(context echo.Context) error {
+    var user User
+
+    key := mfaChallengeKey(context.FormValue("mfa_token"))
+    userID, err := redisClient.Get(redisCtx, key).Result()
+    if err != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    id, _ := primitive.ObjectIDFromHex(userID)
+    err = usersCollection.FindOne(mongoCtx, bson.M{"_id": id}).Decode(&user)
+    if err != nil || !user.TotpEnabled {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    // Wrong codes count as failed logins, so the challenge cannot be used to guess them
+    if retryAfter, locked := checkLoginLockout(context, user.Name); locked {
+        return respondWithLockout(context, retryAfter)
+    }
+
+    if !checkSecondFactor(user, context.FormValue("code")) {
+        registerLoginFailure(context, user.Name)
+        emitAuditAs(context, nil, AuditLoginFailed, userTarget(user))
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    // Only one of concurrent requests with the same challenge gets a session
+    deleted, err := redisClient.Del(redisCtx, key).Result()
+    if err != nil {
+        panic(err)
+    }
+    if deleted == 0 {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+
+    clearLoginFailures(user.Name)
+
+    if user.suspended() {
+        return respondWithSuspension(context, user)
+    }
+
+    token, session := createSession(context, user)
+    emitAuditAs(context, &user, AuditLogin, userTarget(user))
+
+    return respondWithTokens(context, token, session)
+}
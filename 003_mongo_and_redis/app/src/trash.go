@@ -0,0 +1,347 @@
+package main
+
+import (
+    "github.com/labstack/echo/v4"
+    "github.com/labstack/gommon/log"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    TrashItemPost    = "post"
+    TrashItemComment = "comment"
+)
+
+var (
+    // How long deleted posts and comments stay in the trash before being purged, 0 keeps them for good
+    trashRetention time.Duration
+    // How often the trash is checked for items to purge
+    trashPurgeInterval time.Duration
+)
+
+type (
+    // TrashItem keeps a deleted post, along with its comments, or a deleted comment until it is restored or purged.
+    // It shares the ID with the item, so that the item is restored under the same ID.
+    TrashItem struct {
+        ID          primitive.ObjectID `bson:"_id"`
+        ItemType    string             `bson:"item_type"`
+        PostID      primitive.ObjectID `bson:"post_id"`
+        Post        *Post              `bson:"post,omitempty"`
+        Comment     *Comment           `bson:"comment,omitempty"`
+        DeletedAt   time.Time          `bson:"deleted_at"`
+        DeletedByID primitive.ObjectID `bson:"deleted_by_id"`
+    }
+
+    TrashedPost struct {
+        Post
+        DeletedAt time.Time  `json:"deleted_at"`
+        PurgeAt   *time.Time `json:"purge_at,omitempty"`
+    }
+
+    TrashedComment struct {
+        Comment
+        PostID    primitive.ObjectID `json:"post_id"`
+        DeletedAt time.Time          `json:"deleted_at"`
+        PurgeAt   *time.Time         `json:"purge_at,omitempty"`
+    }
+
+    TrashOut struct {
+        Posts    []TrashedPost    `json:"posts"`
+        Comments []TrashedComment `json:"comments"`
+    }
+)
+
+func setupTrash() {
+    trashRetention = getEnvDuration("BP_TRASH_RETENTION", 30*24*time.Hour)
+    trashPurgeInterval = getEnvDuration("BP_TRASH_PURGE_INTERVAL", time.Hour)
+
+    if trashRetention > 0 {
+        go purgeTrashPeriodically()
+    }
+}
+
+func purgeTrashPeriodically() {
+    for {
+        // The purge runs in the background, so a failed one is only logged and tried again next time
+        if err := purgeTrash(); err != nil {
+            log.Error(err)
+        }
+        time.Sleep(trashPurgeInterval)
+    }
+}
+
+// purgeTrash removes for good the items deleted longer than the retention ago, together with the revisions and the
+// slugs of the purged posts.
+func purgeTrash() error {
+    cutoff := time.Now().Add(-trashRetention)
+
+    postFilter := bson.M{
+        "item_type": TrashItemPost,
+        "deleted_at": bson.M{"$lt": cutoff},
+    }
+    postIDs, err := trashCollection.Distinct(mongoCtx, "_id", postFilter)
+    if err != nil {
+        return err
+    }
+    if len(postIDs) > 0 {
+        _, err = postRevisionsCollection.DeleteMany(mongoCtx, bson.M{"post_id": bson.M{"$in": postIDs}})
+        if err != nil {
+            return err
+        }
+        _, err = postSlugsCollection.DeleteMany(mongoCtx, bson.M{"post_id": bson.M{"$in": postIDs}})
+        if err != nil {
+            return err
+        }
+    }
+
+    filter := bson.M{
+        "deleted_at": bson.M{"$lt": cutoff},
+    }
+    _, err = trashCollection.DeleteMany(mongoCtx, filter)
+    return err
+}
+
+func purgeTime(deletedAt time.Time) *time.Time {
+    if trashRetention <= 0 {
+        return nil
+    }
+
+    purgeAt := deletedAt.Add(trashRetention)
+    return &purgeAt
+}
+
+// trashPost moves the post to the trash, remembering who did it, as only they and admins can restore it. The copy is
+// stored first, so that the post is not lost in between. It returns false if the post is already gone.
+func trashPost(user User, post *Post) bool {
+    item := TrashItem{
+        ID:          post.ID,
+        ItemType:    TrashItemPost,
+        PostID:      post.ID,
+        Post:        post,
+        DeletedAt:   time.Now(),
+        DeletedByID: user.ID,
+    }
+    _, err := trashCollection.InsertOne(mongoCtx, item)
+    if err != nil {
+        if strings.Contains(err.Error(), "E11000") {
+            return false
+        }
+        panic(err)
+    }
+
+    result, err := postsCollection.DeleteOne(mongoCtx, bson.M{"_id": post.ID})
+    if err != nil {
+        panic(err)
+    }
+    if result.DeletedCount != 1 {
+        removeFromTrash(post.ID)
+        return false
+    }
+
+    return true
+}
+
+// trashComment moves the comment to the trash the same way as trashPost does with posts.
+func trashComment(user User, postID primitive.ObjectID, comment *Comment) bool {
+    item := TrashItem{
+        ID:          comment.ID,
+        ItemType:    TrashItemComment,
+        PostID:      postID,
+        Comment:     comment,
+        DeletedAt:   time.Now(),
+        DeletedByID: user.ID,
+    }
+    _, err := trashCollection.InsertOne(mongoCtx, item)
+    if err != nil {
+        if strings.Contains(err.Error(), "E11000") {
+            return false
+        }
+        panic(err)
+    }
+
+    update := bson.M{
+        "$pull": bson.M{
+            "comments": bson.M{"_id": comment.ID},
+        },
+    }
+    result, err := postsCollection.UpdateOne(mongoCtx, bson.M{"_id": postID}, update)
+    if err != nil {
+        panic(err)
+    }
+    if result.ModifiedCount != 1 {
+        removeFromTrash(comment.ID)
+        return false
+    }
+
+    return true
+}
+
+// removeFromTrash drops the copy of an item which is back in place. A failure is only logged, as the item itself is
+// fine and the leftover copy gets purged in time.
+func removeFromTrash(id primitive.ObjectID) {
+    _, err := trashCollection.DeleteOne(mongoCtx, bson.M{"_id": id})
+    if err != nil {
+        log.Error(err)
+    }
+}
+
+func getTrashItemOrError(filter bson.M) (*TrashItem, int) {
+    var item TrashItem
+
+    err := trashCollection.FindOne(mongoCtx, filter).Decode(&item)
+    if err != nil {
+        return nil, http.StatusNotFound
+    }
+
+    return &item, 0
+}
+
+// listTrash godoc
+// @Summary List Trash
+// @Description Lists the posts and comments deleted by the current user, which can still be restored.
+// @Tags trash
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} TrashOut
+// @Failure 401
+// @Router /trash [get]
+func listTrash(context echo.Context) error {
+    filter := bson.M{
+        "deleted_by_id": context.Get("User").(User).ID,
+    }
+    findOptions := options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}})
+    cursor, err := trashCollection.Find(mongoCtx, filter, findOptions)
+    if err != nil {
+        panic(err)
+    }
+    defer cursor.Close(mongoCtx)
+
+    trashOut := TrashOut{Posts: []TrashedPost{}, Comments: []TrashedComment{}}
+    for cursor.Next(mongoCtx) {
+        var item TrashItem
+
+        err := cursor.Decode(&item)
+        if err != nil {
+            panic(err)
+        }
+
+        switch item.ItemType {
+        case TrashItemPost:
+            trashOut.Posts = append(trashOut.Posts, TrashedPost{
+                Post:      *item.Post,
+                DeletedAt: item.DeletedAt,
+                PurgeAt:   purgeTime(item.DeletedAt),
+            })
+        case TrashItemComment:
+            trashOut.Comments = append(trashOut.Comments, TrashedComment{
+                Comment:   *item.Comment,
+                PostID:    item.PostID,
+                DeletedAt: item.DeletedAt,
+                PurgeAt:   purgeTime(item.DeletedAt),
+            })
+        }
+    }
+
+    return context.JSON(http.StatusOK, trashOut)
+}
+
+// restorePost godoc
+// @Summary Restore Post from Trash
+// @Description The post comes back together with the comments it had when deleted.
+// @Tags trash
+// @Produce json
+// @Param id path string true "ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} Post
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Router /posts/{id}/restore [post]
+func restorePost(context echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(context.Param("id"))
+    if err != nil {
+        return context.NoContent(http.StatusBadRequest)
+    }
+
+    item, code := getTrashItemOrError(bson.M{"_id": id, "item_type": TrashItemPost})
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    if !canRestoreTrashItem(context.Get("User").(User), item) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    _, err = postsCollection.InsertOne(mongoCtx, item.Post)
+    if err != nil {
+        panic(err)
+    }
+    // A post trashed before the slugs have been introduced gets one now
+    assignSlug(item.Post)
+    removeFromTrash(item.ID)
+    emitAudit(context, AuditPostRestore, postTarget(item.Post))
+
+    return context.JSON(http.StatusOK, item.Post.withoutHiddenComments())
+}
+
+// restoreComment godoc
+// @Summary Restore Comment from Trash
+// @Description The post of the comment has to be restored first if it has been deleted as well.
+// @Tags trash
+// @Produce json
+// @Param post_id path string true "Post ID"
+// @Param comment_id path string true "Comment ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} Comment
+// @Failure 400
+// @Failure 401
+// @Failure 403
+// @Failure 404
+// @Failure 409
+// @Router /posts/{post_id}/comments/{comment_id}/restore [post]
+func restoreComment(context echo.Context) error {
+    postID, err := primitive.ObjectIDFromHex(context.Param("post_id"))
+    if err != nil {
+        return context.NoContent(http.StatusBadRequest)
+    }
+
+    commentID, err := primitive.ObjectIDFromHex(context.Param("comment_id"))
+    if err != nil {
+        return context.NoContent(http.StatusBadRequest)
+    }
+
+    item, code := getTrashItemOrError(bson.M{"_id": commentID, "item_type": TrashItemComment, "post_id": postID})
+    if code != 0 {
+        return context.NoContent(code)
+    }
+
+    if !canRestoreTrashItem(context.Get("User").(User), item) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    // The comment is put back in its place among the others
+    update := bson.M{
+        "$push": bson.M{
+            "comments": bson.M{
+                "$each": []*Comment{item.Comment},
+                "$sort": bson.M{"created_at": 1},
+            },
+        },
+    }
+    result, err := postsCollection.UpdateOne(mongoCtx, bson.M{"_id": postID}, update)
+    if err != nil {
+        panic(err)
+    }
+    if result.MatchedCount != 1 {
+        return context.JSON(http.StatusConflict, "The post of this comment has been deleted.")
+    }
+    removeFromTrash(item.ID)
+    emitAudit(context, AuditCommentRestore, commentTarget(item.Comment))
+
+    return context.JSON(http.StatusOK, item.Comment)
+}
@@ -11,12 +11,21 @@ import (
 
 type (
     User struct {
-        ID           primitive.ObjectID `bson:"_id" json:"_id"`
-        CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
-        UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
-        Name         string             `bson:"name" json:"name"`
-        PasswordHash string             `bson:"password_hash" json:"-"`
-        Email        string             `bson:"email" json:"email"`
+        ID               primitive.ObjectID `bson:"_id" json:"_id"`
+        CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+        UpdatedAt        time.Time          `bson:"updated_at" json:"updated_at"`
+        Name             string             `bson:"name" json:"name"`
+        PasswordHash     string             `bson:"password_hash" json:"-"`
+        Email            string             `bson:"email" json:"email"`
+        EmailVerifiedAt  *time.Time         `bson:"email_verified_at" json:"email_verified_at"`
+        PendingEmail     string             `bson:"pending_email" json:"pending_email,omitempty"`
+        TotpSecret       string             `bson:"totp_secret" json:"-"`
+        TotpEnabled      bool               `bson:"totp_enabled" json:"totp_enabled"`
+        RecoveryCodes    []string           `bson:"recovery_codes,omitempty" json:"-"`
+        Role             string             `bson:"role" json:"role"`
+        SuspendedAt      *time.Time         `bson:"suspended_at,omitempty" json:"-"`
+        SuspendedUntil   *time.Time         `bson:"suspended_until,omitempty" json:"-"`
+        SuspensionReason string             `bson:"suspension_reason,omitempty" json:"-"`
     }
 
     UserNew struct {
@@ -31,6 +40,15 @@ type (
     }
 )
 
+// withoutSecrets returns a copy of the user which can be cached in the context and embedded in posts and comments, the
+// same way as a copy taken from a session.
+func (user User) withoutSecrets() User {
+    user.PasswordHash = ""
+    user.TotpSecret = ""
+    user.RecoveryCodes = nil
+    return user
+}
+
 func getUserOrError(context echo.Context) (*User, int) {
     var err error
     var id primitive.ObjectID
@@ -58,13 +76,23 @@ func getUserOrError(context echo.Context) (*User, int) {
 // @Produce json
 // @Param name query string false "Name"
 // @Param email query string false "Email"
-// @Success 200 {array} User
+// @Param limit query int false "Number of users on the page, 20 by default and 100 at most"
+// @Param cursor query string false "Cursor of the page, as returned in next_cursor"
+// @Success 200 {object} Page{items=[]User}
+// @Header 200 {string} Link "Link to the next page"
+// @Failure 400
 // @Router /users [get]
 func listUserAccounts(context echo.Context) error {
-    var users []User
+    var next *pageCursor
+    var users = []User{}
     var filters []bson.M
     var filter bson.M
 
+    page, err := getPageQuery(context, "created_at")
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
     if name := context.QueryParam("name"); name != "" {
         filters = append(filters, bson.M{
             "name": name,
@@ -75,6 +103,7 @@ func listUserAccounts(context echo.Context) error {
             "email": email,
         })
     }
+    filters, findOptions := page.apply(filters)
     if len(filters) > 0 {
         filter = bson.M{
             "$and": filters,
@@ -83,7 +112,7 @@ func listUserAccounts(context echo.Context) error {
         filter = bson.M{}
     }
 
-    cursor, err := usersCollection.Find(mongoCtx, filter)
+    cursor, err := usersCollection.Find(mongoCtx, filter, findOptions)
     if err != nil {
         panic(err)
     }
@@ -100,7 +129,12 @@ func listUserAccounts(context echo.Context) error {
         users = append(users, user)
     }
 
-    return context.JSON(http.StatusOK, users)
+    if len(users) > page.Limit {
+        users = users[:page.Limit]
+        next = page.cursorAt(sortKeys{CreatedAt: users[page.Limit-1].CreatedAt}, users[page.Limit-1].ID)
+    }
+
+    return sendPage(context, users, next)
 }
 
 // createUserAccount godoc
@@ -137,6 +171,7 @@ func createUserAccount(context echo.Context) error {
     user.Name = userNew.Name
     user.PasswordHash = hashedPassword
     user.Email = userNew.Email
+    user.Role = RoleUser
 
     _, err = usersCollection.InsertOne(mongoCtx, user)
     if err != nil {
@@ -146,6 +181,8 @@ func createUserAccount(context echo.Context) error {
         panic(err)
     }
 
+    sendEmailVerification(context, *user, user.Email)
+
     return context.JSON(http.StatusCreated, user)
 }
 
@@ -154,7 +191,10 @@ func createUserAccount(context echo.Context) error {
 // @Tags users
 // @Produce json
 // @Param id path string true "ID"
+// @Param If-None-Match header string false "ETag of the cached version"
 // @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the resource"
+// @Success 304
 // @Failure 400
 // @Failure 404
 // @Router /users/{id} [get]
@@ -163,10 +203,26 @@ func retrieveUserAccount(context echo.Context) error {
     if err != 0 {
         return context.NoContent(err)
     }
+    if notModified(context, etag(user.UpdatedAt)) {
+        return context.NoContent(http.StatusNotModified)
+    }
 
     return context.JSON(http.StatusOK, user)
 }
 
+// retrieveCurrentUserAccount godoc
+// @Summary Retrieve Current User Account
+// @Tags users
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} User
+// @Failure 401
+// @Failure 403
+// @Router /users/me [get]
+func retrieveCurrentUserAccount(context echo.Context) error {
+    return context.JSON(http.StatusOK, context.Get("User").(User))
+}
+
 // updateUserAccount godoc
 // @Summary Update Current User Account
 // @Tags users
@@ -174,39 +230,122 @@ func retrieveUserAccount(context echo.Context) error {
 // @Produce json
 // @Security ApiKeyAuth
 // @Param user body UserUpdate true "User"
+// @Param If-Match header string false "ETag of the version being changed"
 // @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the resource"
 // @Failure 400
 // @Failure 403
 // @Failure 404
+// @Failure 412
 // @Router /users [put]
 func updateUserAccount(context echo.Context) error {
-    userUpdate := new(UserUpdate)
-    if err := context.Bind(userUpdate); err != nil {
-        return err
+    return editUserAccount(context, false)
+}
+
+// patchUserAccount godoc
+// @Summary Patch Current User Account
+// @Description Changes only the fields present in the JSON merge patch (RFC 7396), so that the password does not have
+// @Description to be sent to change the email.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param user body UserUpdate true "User"
+// @Param If-Match header string false "ETag of the version being changed"
+// @Success 200 {object} User
+// @Header 200 {string} ETag "Version of the resource"
+// @Failure 400
+// @Failure 403
+// @Failure 404
+// @Failure 412
+// @Router /users [patch]
+func patchUserAccount(context echo.Context) error {
+    return editUserAccount(context, true)
+}
+
+// editUserAccount replaces the password and the email of the current user with the ones in the request, or with the
+// merge patch sent with PATCH applied to them.
+func editUserAccount(context echo.Context, patch bool) error {
+    var user User
+
+    // The cached copy of the user may be outdated, so it is not written back as it is
+    filter := bson.M{
+        "_id": context.Get("User").(User).ID,
     }
-    if err := context.Validate(userUpdate); err != nil {
-        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    err := usersCollection.FindOne(mongoCtx, filter).Decode(&user)
+    if err != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+    if !ifMatch(context, etag(user.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
     }
 
-    hashedPassword, err := hashAndSalt(userUpdate.Password)
-    if err != nil {
-        return err
+    userUpdate := new(UserUpdate)
+    if patch {
+        // The password is changed only if it is present in the patch, and an email waiting for verification stays
+        userUpdate.Email = user.Email
+        if user.PendingEmail != "" {
+            userUpdate.Email = user.PendingEmail
+        }
+        if err := bindMergePatch(context, userUpdate); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
+    } else {
+        if err := context.Bind(userUpdate); err != nil {
+            return err
+        }
+        if err := context.Validate(userUpdate); err != nil {
+            return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+        }
     }
 
-    user := context.Get("User").(User)
-    user.PasswordHash = hashedPassword
-    user.Email = userUpdate.Email
+    // A new email address replaces the current one only once it is verified
+    emailChanged := userUpdate.Email != user.Email && userUpdate.Email != user.PendingEmail
+    if userUpdate.Email != user.Email {
+        count, err := usersCollection.CountDocuments(mongoCtx, bson.M{"email": userUpdate.Email})
+        if err != nil {
+            panic(err)
+        }
+        if count > 0 {
+            return context.JSON(http.StatusBadRequest, "User with provided email already exists.")
+        }
+        user.PendingEmail = userUpdate.Email
+    } else {
+        user.PendingEmail = ""
+    }
 
-    filter := bson.M{
-        "_id": user.ID,
+    // The account is written only if nobody has changed it since it has been read
+    filter["updated_at"] = user.UpdatedAt
+    user.UpdatedAt = time.Now()
+    if userUpdate.Password != "" {
+        hashedPassword, err := hashAndSalt(userUpdate.Password)
+        if err != nil {
+            return err
+        }
+        user.PasswordHash = hashedPassword
     }
+
     update := bson.M{
         "$set": user,
     }
-    _, err = usersCollection.UpdateOne(mongoCtx, filter, update)
+    result, err := usersCollection.UpdateOne(mongoCtx, filter, update)
     if err != nil {
         panic(err)
+    } else if result.MatchedCount != 1 {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+    emitAudit(context, AuditUserUpdate, userTarget(user))
+
+    if emailChanged {
+        sendEmailVerification(context, user, user.PendingEmail)
+    }
+
+    // If the password has been replaced, all the other sessions are terminated, and the current one is refreshed
+    if userUpdate.Password != "" {
+        revokeUserSessions(user, context.Get("Session").(Session).ID)
     }
+    updateUserSessions(user)
+    setETag(context, etag(user.UpdatedAt))
 
     return context.JSON(http.StatusOK, user)
 }
@@ -214,22 +353,41 @@ func updateUserAccount(context echo.Context) error {
 // deleteUserAccount godoc
 // @Summary Delete Current User Account
 // @Tags users
+// @Param If-Match header string false "ETag of the version being changed"
 // @Security ApiKeyAuth
 // @Success 204
 // @Success 401
+// @Failure 412
 // @Router /users [delete]
 func deleteUserAccount(context echo.Context) error {
+    var current User
+
     user := context.Get("User").(User)
 
+    // The cached copy of the user may be outdated, so the version is checked against the stored one
     filter := bson.M{
         "_id": user.ID,
     }
-    _, err := usersCollection.DeleteOne(mongoCtx, filter)
+    err := usersCollection.FindOne(mongoCtx, filter).Decode(&current)
+    if err != nil {
+        return context.NoContent(http.StatusUnauthorized)
+    }
+    if !ifMatch(context, etag(current.UpdatedAt)) {
+        return context.NoContent(http.StatusPreconditionFailed)
+    }
+
+    _, err = usersCollection.DeleteOne(mongoCtx, filter)
+    if err != nil {
+        panic(err)
+    }
+
+    _, err = apiKeysCollection.DeleteMany(mongoCtx, bson.M{"user_id": user.ID})
     if err != nil {
         panic(err)
     }
 
-    // TODO: Delete user sessions here
+    revokeUserSessions(user, "")
+    emitAudit(context, AuditUserDelete, userTarget(user))
 
     return context.NoContent(http.StatusNoContent)
 }
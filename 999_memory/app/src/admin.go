@@ -0,0 +1,42 @@
+package main
+
+import (
+    "github.com/labstack/echo"
+    "net/http"
+    "strings"
+)
+
+type (
+    userRole struct {
+        Role string `json:"role" validate:"required,oneof=user moderator admin"`
+    }
+)
+
+func updateUserRole(context echo.Context) error {
+    currentUser := context.Get("user").(*user)
+
+    user, err := getUserOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    userRole := new(userRole)
+
+    if err := context.Bind(userRole); err != nil {
+        return err
+    }
+
+    if err := context.Validate(userRole); err != nil {
+        return context.JSON(http.StatusBadRequest, strings.Split(err.Error(), "\n"))
+    }
+
+    // Otherwise the last admin could lock everybody out of the administration
+    if user.Name == currentUser.Name {
+        return context.JSON(http.StatusBadRequest, "Own role can not be changed.")
+    }
+
+    user.Role = userRole.Role
+    users[user.Name] = user
+
+    return context.JSON(http.StatusOK, user)
+}
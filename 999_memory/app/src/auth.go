@@ -3,7 +3,6 @@ package main
 import (
     "github.com/labstack/echo"
     "github.com/labstack/gommon/random"
-    "golang.org/x/crypto/bcrypt"
     "net/http"
 )
 
@@ -11,22 +10,6 @@ var (
     tokens = map[string]*user{}
 )
 
-func hashAndSalt(pwd string) (string, error) {
-    bytePwd := []byte(pwd)
-    hash, err := bcrypt.GenerateFromPassword(bytePwd, bcrypt.MinCost)
-    if err != nil {
-        return "", err
-    }
-    return string(hash), nil
-}
-
-func comparePasswords(hashedPwd string, plainPwd string) bool {
-    byteHashedPwd := []byte(hashedPwd)
-    bytePlainPwd := []byte(plainPwd)
-    err := bcrypt.CompareHashAndPassword(byteHashedPwd, bytePlainPwd)
-    return err == nil
-}
-
 func checkAuthToken(token string, context echo.Context) (bool, error) {
     // Check whether provided token exists
     if _, ok := tokens[token]; !ok {
@@ -50,10 +33,18 @@ func issueToken(context echo.Context) error {
         return context.NoContent(http.StatusUnauthorized)
     }
 
-    if !comparePasswords(user.PasswordHash, context.FormValue("password")) {
+    password := context.FormValue("password")
+    if !comparePasswords(user.PasswordHash, password) {
         return context.NoContent(http.StatusUnauthorized)
     }
 
+    // Hashes created with an outdated algorithm or cost are replaced while the plain password is at hand
+    if passwordNeedsRehash(user.PasswordHash) {
+        if hashedPassword, err := hashAndSalt(password); err == nil {
+            user.PasswordHash = hashedPassword
+        }
+    }
+
     token := random.String(32, random.Alphanumeric)
     tokens[token] = user
 
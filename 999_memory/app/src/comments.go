@@ -3,6 +3,7 @@ package main
 import (
     "github.com/labstack/echo"
     "net/http"
+    "sort"
     "strconv"
     "strings"
     "time"
@@ -10,12 +11,13 @@ import (
 
 type (
     comment struct {
-        ID         int       `json:"id"`
-        AuthorName string    `json:"author_name"`
-        PostID     int       `json:"post_id"`
-        Content    string    `json:"content"`
-        CreateDate time.Time `json:"create_date"`
-        ModifyDate time.Time `json:"modify_date"`
+        ID         int        `json:"id"`
+        AuthorName string     `json:"author_name"`
+        PostID     int        `json:"post_id"`
+        Content    string     `json:"content"`
+        CreateDate time.Time  `json:"create_date"`
+        ModifyDate time.Time  `json:"modify_date"`
+        HiddenAt   *time.Time `json:"hidden_at,omitempty"`
     }
 
     commentCreate struct {
@@ -47,27 +49,46 @@ func getCommentOrError(context echo.Context) (*comment, int) {
     return comment, 0
 }
 
+func (comment *comment) pageCursor() pageCursor {
+    return pageCursor{CreateDate: comment.CreateDate, ID: strconv.Itoa(comment.ID)}
+}
+
+func (comment *comment) searchDocument() searchDocument {
+    return searchDocument{Type: "comment", ID: comment.ID}
+}
+
 func listComments(context echo.Context) error {
+    page, err := getPageQuery(context)
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
     authorName := context.QueryParam("author_name")
     postID := context.QueryParam("post_id")
 
-    if authorName != "" || postID != "" {
-        numericPostID, err := strconv.Atoi(postID)
-        if err != nil {
-            numericPostID = -1
-        }
+    numericPostID, err := strconv.Atoi(postID)
+    if err != nil {
+        numericPostID = -1
+    }
 
-        filteredComments := map[int]*comment{}
-        for id, comment := range comments {
-            if comment.AuthorName == authorName || comment.PostID == numericPostID {
-                filteredComments[id] = comment
-            }
+    visibleComments := []*comment{}
+    for _, comment := range comments {
+        matches := (authorName == "" && postID == "") ||
+            comment.AuthorName == authorName || comment.PostID == numericPostID
+        if matches && comment.HiddenAt == nil {
+            visibleComments = append(visibleComments, comment)
         }
+    }
 
-        return context.JSON(http.StatusOK, filteredComments)
+    cursorAt := func(i int) pageCursor {
+        return visibleComments[i].pageCursor()
     }
+    sort.Slice(visibleComments, func(i int, j int) bool {
+        return cursorAt(i).before(cursorAt(j))
+    })
+    start, end, next := page.bounds(len(visibleComments), cursorAt)
 
-    return context.JSON(http.StatusOK, comments)
+    return sendPage(context, visibleComments[start:end], next)
 }
 
 func createComment(context echo.Context) error {
@@ -91,6 +112,7 @@ func createComment(context echo.Context) error {
     comment.CreateDate = time.Now()
     comment.ModifyDate = time.Now()
     comments[comment.ID] = comment
+    contentIndex.add(comment.searchDocument(), comment.Content)
     commentsSeq++
 
     return context.JSON(http.StatusCreated, comment)
@@ -102,6 +124,10 @@ func retrieveComment(context echo.Context) error {
         return context.NoContent(err)
     }
 
+    if comment.HiddenAt != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+
     return context.JSON(http.StatusOK, comment)
 }
 
@@ -113,7 +139,7 @@ func updateComment(context echo.Context) error {
         return context.NoContent(err)
     }
 
-    if comment.AuthorName != user.Name {
+    if !canUpdateComment(user, comment) {
         return context.NoContent(http.StatusForbidden)
     }
 
@@ -130,6 +156,7 @@ func updateComment(context echo.Context) error {
     comment.Content = commentUpdate.Content
     comment.ModifyDate = time.Now()
     comments[comment.ID] = comment
+    contentIndex.add(comment.searchDocument(), comment.Content)
 
     return context.JSON(http.StatusOK, comment)
 }
@@ -142,11 +169,43 @@ func deleteComment(context echo.Context) error {
         return context.NoContent(err)
     }
 
-    if comment.AuthorName != user.Name {
+    if !canDeleteComment(user, comment) {
         return context.NoContent(http.StatusForbidden)
     }
 
     delete(comments, comment.ID)
+    contentIndex.remove(comment.searchDocument())
 
     return context.NoContent(http.StatusNoContent)
 }
+
+func setCommentHidden(context echo.Context, hidden bool) error {
+    user := context.Get("user").(*user)
+
+    comment, err := getCommentOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canHideComment(user, comment) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    if !hidden {
+        comment.HiddenAt = nil
+    } else if comment.HiddenAt == nil {
+        hiddenAt := time.Now()
+        comment.HiddenAt = &hiddenAt
+    }
+    comments[comment.ID] = comment
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+func hideComment(context echo.Context) error {
+    return setCommentHidden(context, true)
+}
+
+func unhideComment(context echo.Context) error {
+    return setCommentHidden(context, false)
+}
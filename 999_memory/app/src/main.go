@@ -1,9 +1,12 @@
 package main
 
 import (
+    "fmt"
     "github.com/go-playground/validator"
     "github.com/labstack/echo"
     "github.com/labstack/echo/middleware"
+    "os"
+    "strconv"
 )
 
 type (
@@ -16,7 +19,24 @@ func (cv *CustomValidator) Validate(i interface{}) error {
     return cv.validator.Struct(i)
 }
 
+func getEnvInt(key string, fallback int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+
+    number, err := strconv.Atoi(value)
+    if err != nil {
+        panic(fmt.Sprintf("Invalid number in %v.", key))
+    }
+
+    return number
+}
+
 func main() {
+    setupPasswords()
+    setupPolicy()
+
     e := echo.New()
 
     // Validator
@@ -33,15 +53,24 @@ func main() {
 
     e.GET("/posts", listPosts)
     e.POST("/posts", createPost, middleware.KeyAuth(checkAuthToken))
+    e.GET("/posts/by-slug/:slug", retrievePostBySlug)
     e.GET("/posts/:id", retrievePost)
     e.PUT("/posts/:id", updatePost, middleware.KeyAuth(checkAuthToken))
     e.DELETE("/posts/:id", deletePost, middleware.KeyAuth(checkAuthToken))
+    e.POST("/posts/:id/hide", hidePost, middleware.KeyAuth(checkAuthToken))
+    e.POST("/posts/:id/unhide", unhidePost, middleware.KeyAuth(checkAuthToken))
 
     e.GET("/comments", listComments)
     e.POST("/comments", createComment, middleware.KeyAuth(checkAuthToken))
     e.GET("/comments/:id", retrieveComment)
     e.PUT("/comments/:id", updateComment, middleware.KeyAuth(checkAuthToken))
     e.DELETE("/comments/:id", deleteComment, middleware.KeyAuth(checkAuthToken))
+    e.POST("/comments/:id/hide", hideComment, middleware.KeyAuth(checkAuthToken))
+    e.POST("/comments/:id/unhide", unhideComment, middleware.KeyAuth(checkAuthToken))
+
+    e.GET("/search", searchContent)
+
+    e.PUT("/admin/users/:name/role", updateUserRole, middleware.KeyAuth(checkAuthToken), requireAdmin)
 
     e.Logger.Fatal(e.Start(":1323"))
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/labstack/echo"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "time"
+)
+
+const (
+    // Number of items on a page when no limit is given
+    defaultPageLimit = 20
+    maxPageLimit     = 100
+)
+
+type (
+    // page is a part of a listing ordered by the creation time. The next part is listed by passing next_cursor as the
+    // cursor, which is null on the last page.
+    page struct {
+        Items      interface{} `json:"items"`
+        NextCursor *string     `json:"next_cursor"`
+    }
+
+    // pageCursor points at the last item of the previous page. The ID is the number of a post or a comment, or the
+    // name of a user.
+    pageCursor struct {
+        CreateDate time.Time `json:"create_date"`
+        ID         string    `json:"id"`
+    }
+
+    pageQuery struct {
+        Limit int
+        After *pageCursor
+    }
+)
+
+// getPageQuery reads the limit and the cursor of the requested page.
+func getPageQuery(context echo.Context) (*pageQuery, error) {
+    page := &pageQuery{Limit: defaultPageLimit}
+
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > maxPageLimit {
+            return nil, errors.New("Provided limit is invalid.")
+        }
+        page.Limit = number
+    }
+
+    if value := context.QueryParam("cursor"); value != "" {
+        page.After = new(pageCursor)
+        data, err := base64.RawURLEncoding.DecodeString(value)
+        if err != nil || json.Unmarshal(data, page.After) != nil {
+            return nil, errors.New("Provided cursor is invalid.")
+        }
+    }
+
+    return page, nil
+}
+
+// before tells whether the item at the cursor is listed before the other one. The IDs are compared by their length
+// first, so that the numbers are ordered as such.
+func (cursor pageCursor) before(other pageCursor) bool {
+    if !cursor.CreateDate.Equal(other.CreateDate) {
+        return cursor.CreateDate.Before(other.CreateDate)
+    }
+    if len(cursor.ID) != len(other.ID) {
+        return len(cursor.ID) < len(other.ID)
+    }
+    return cursor.ID < other.ID
+}
+
+// bounds finds the items on the page among the ones sorted by their cursors. It returns the index of the first item
+// and the one past the last item, together with the cursor of the next page if there is one.
+func (page *pageQuery) bounds(count int, cursorAt func(i int) pageCursor) (int, int, *pageCursor) {
+    start := 0
+    if page.After != nil {
+        start = sort.Search(count, func(i int) bool {
+            return page.After.before(cursorAt(i))
+        })
+    }
+
+    end := start + page.Limit
+    if end >= count {
+        return start, count, nil
+    }
+
+    next := cursorAt(end - 1)
+    return start, end, &next
+}
+
+// sendPage responds with the items of the page. The cursor of the next page, if there is one, is sent both in the body
+// and in the Link header, which repeats the query of the request.
+func sendPage(context echo.Context, items interface{}, next *pageCursor) error {
+    page := page{Items: items}
+
+    if next != nil {
+        data, err := json.Marshal(next)
+        if err != nil {
+            return err
+        }
+        cursor := base64.RawURLEncoding.EncodeToString(data)
+        page.NextCursor = &cursor
+
+        query := context.Request().URL.Query()
+        query.Set("cursor", cursor)
+        link := url.URL{Path: context.Request().URL.Path, RawQuery: query.Encode()}
+        context.Response().Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, link.String()))
+    }
+
+    return context.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "github.com/labstack/echo"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+// setupPolicy creates the admin accounts listed in ADMIN_NAMES, sharing the password in ADMIN_PASSWORD. No account
+// outlives a restart here, and signing up with one of the names never gives the role, as anybody could take a name
+// that is not registered yet.
+func setupPolicy() {
+    password := os.Getenv("ADMIN_PASSWORD")
+
+    for _, name := range strings.Split(os.Getenv("ADMIN_NAMES"), ",") {
+        if name = strings.TrimSpace(name); name == "" {
+            continue
+        }
+        if len(password) < 6 {
+            panic("Admin password has to be at least 6 characters long.")
+        }
+
+        hashedPassword, err := hashAndSalt(password)
+        if err != nil {
+            panic(err)
+        }
+        users[name] = &user{Name: name, PasswordHash: hashedPassword, Role: RoleAdmin, CreateDate: time.Now()}
+    }
+}
+
+func isModerator(user *user) bool {
+    return user.Role == RoleModerator || user.Role == RoleAdmin
+}
+
+func isAdmin(user *user) bool {
+    return user.Role == RoleAdmin
+}
+
+// Authors manage their own content. Moderators can edit and hide anybody's, while deleting it is left to admins.
+func canUpdatePost(user *user, post *post) bool {
+    return post.AuthorName == user.Name || isModerator(user)
+}
+
+func canDeletePost(user *user, post *post) bool {
+    return post.AuthorName == user.Name || isAdmin(user)
+}
+
+func canHidePost(user *user, post *post) bool {
+    return isModerator(user)
+}
+
+func canUpdateComment(user *user, comment *comment) bool {
+    return comment.AuthorName == user.Name || isModerator(user)
+}
+
+func canDeleteComment(user *user, comment *comment) bool {
+    return comment.AuthorName == user.Name || isAdmin(user)
+}
+
+func canHideComment(user *user, comment *comment) bool {
+    return isModerator(user)
+}
+
+func canManageUsers(user *user) bool {
+    return isAdmin(user)
+}
+
+// requireAdmin is a middleware letting through only the users allowed to manage other users.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(context echo.Context) error {
+        if !canManageUsers(context.Get("user").(*user)) {
+            return context.NoContent(http.StatusForbidden)
+        }
+
+        return next(context)
+    }
+}
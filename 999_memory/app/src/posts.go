@@ -3,6 +3,7 @@ package main
 import (
     "github.com/labstack/echo"
     "net/http"
+    "sort"
     "strconv"
     "strings"
     "time"
@@ -10,12 +11,14 @@ import (
 
 type (
     post struct {
-        ID         int       `json:"id"`
-        AuthorName string    `json:"author_name"`
-        Title      string    `json:"title"`
-        Content    string    `json:"content"`
-        CreateDate time.Time `json:"create_date"`
-        ModifyDate time.Time `json:"modify_date"`
+        ID         int        `json:"id"`
+        AuthorName string     `json:"author_name"`
+        Title      string     `json:"title"`
+        Slug       string     `json:"slug"`
+        Content    string     `json:"content"`
+        CreateDate time.Time  `json:"create_date"`
+        ModifyDate time.Time  `json:"modify_date"`
+        HiddenAt   *time.Time `json:"hidden_at,omitempty"`
     }
 
     postIn struct {
@@ -43,19 +46,37 @@ func getPostOrError(context echo.Context) (*post, int) {
     return post, 0
 }
 
+func (post *post) pageCursor() pageCursor {
+    return pageCursor{CreateDate: post.CreateDate, ID: strconv.Itoa(post.ID)}
+}
+
+func (post *post) searchDocument() searchDocument {
+    return searchDocument{Type: "post", ID: post.ID}
+}
+
 func listPosts(context echo.Context) error {
-    if authorName := context.QueryParam("author_name"); authorName != "" {
-        filteredPosts := map[int]*post{}
-        for id, post := range posts {
-            if post.AuthorName == authorName {
-                filteredPosts[id] = post
-            }
+    page, err := getPageQuery(context)
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
+    authorName := context.QueryParam("author_name")
+    visiblePosts := []*post{}
+    for _, post := range posts {
+        if (authorName == "" || post.AuthorName == authorName) && post.HiddenAt == nil {
+            visiblePosts = append(visiblePosts, post)
         }
+    }
 
-        return context.JSON(http.StatusOK, filteredPosts)
+    cursorAt := func(i int) pageCursor {
+        return visiblePosts[i].pageCursor()
     }
+    sort.Slice(visiblePosts, func(i int, j int) bool {
+        return cursorAt(i).before(cursorAt(j))
+    })
+    start, end, next := page.bounds(len(visiblePosts), cursorAt)
 
-    return context.JSON(http.StatusOK, posts)
+    return sendPage(context, visiblePosts[start:end], next)
 }
 
 func createPost(context echo.Context) error {
@@ -78,7 +99,9 @@ func createPost(context echo.Context) error {
     post.Content = postIn.Content
     post.CreateDate = time.Now()
     post.ModifyDate = time.Now()
+    assignSlug(post)
     posts[post.ID] = post
+    contentIndex.add(post.searchDocument(), post.Title+" "+post.Content)
     postsSeq++
 
     return context.JSON(http.StatusCreated, post)
@@ -90,6 +113,10 @@ func retrievePost(context echo.Context) error {
         return context.NoContent(err)
     }
 
+    if post.HiddenAt != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+
     return context.JSON(http.StatusOK, post)
 }
 
@@ -101,7 +128,7 @@ func updatePost(context echo.Context) error {
         return context.NoContent(err)
     }
 
-    if post.AuthorName != user.Name {
+    if !canUpdatePost(user, post) {
         return context.NoContent(http.StatusForbidden)
     }
 
@@ -118,7 +145,9 @@ func updatePost(context echo.Context) error {
     post.Title = postIn.Title
     post.Content = postIn.Content
     post.ModifyDate = time.Now()
+    assignSlug(post)
     posts[post.ID] = post
+    contentIndex.add(post.searchDocument(), post.Title+" "+post.Content)
 
     return context.JSON(http.StatusOK, post)
 }
@@ -131,11 +160,44 @@ func deletePost(context echo.Context) error {
         return context.NoContent(err)
     }
 
-    if post.AuthorName != user.Name {
+    if !canDeletePost(user, post) {
         return context.NoContent(http.StatusForbidden)
     }
 
     delete(posts, post.ID)
+    removeSlugs(post)
+    contentIndex.remove(post.searchDocument())
+
+    return context.NoContent(http.StatusNoContent)
+}
+
+func setPostHidden(context echo.Context, hidden bool) error {
+    user := context.Get("user").(*user)
+
+    post, err := getPostOrError(context)
+    if err != 0 {
+        return context.NoContent(err)
+    }
+
+    if !canHidePost(user, post) {
+        return context.NoContent(http.StatusForbidden)
+    }
+
+    if !hidden {
+        post.HiddenAt = nil
+    } else if post.HiddenAt == nil {
+        hiddenAt := time.Now()
+        post.HiddenAt = &hiddenAt
+    }
+    posts[post.ID] = post
 
     return context.NoContent(http.StatusNoContent)
 }
+
+func hidePost(context echo.Context) error {
+    return setPostHidden(context, true)
+}
+
+func unhidePost(context echo.Context) error {
+    return setPostHidden(context, false)
+}
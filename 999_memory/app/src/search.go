@@ -0,0 +1,219 @@
+package main
+
+import (
+    "github.com/labstack/echo"
+    "html"
+    "math"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // Number of bytes of the text shown in a snippet
+    snippetLength = 160
+)
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+type (
+    searchResult struct {
+        // Either post or comment
+        Type    string  `json:"type"`
+        ID      int     `json:"id"`
+        PostID  int     `json:"post_id"`
+        Title   string  `json:"title,omitempty"`
+        // Part of the content around the first match, as HTML with the matching words in <mark>
+        Snippet string  `json:"snippet"`
+        Score   float64 `json:"score"`
+    }
+
+    // searcher finds the visible posts and comments matching the query, ranked from the most relevant.
+    searcher interface {
+        search(query string, limit int) []searchResult
+    }
+
+    searchDocument struct {
+        Type string
+        ID   int
+    }
+
+    // invertedIndex maps the words to the posts and comments they occur in, along with the number of their
+    // occurrences. The documents are ranked by TF-IDF.
+    invertedIndex struct {
+        postings  map[string]map[searchDocument]int
+        documents map[searchDocument][]string
+    }
+)
+
+var (
+    contentIndex = &invertedIndex{
+        postings:  map[string]map[searchDocument]int{},
+        documents: map[searchDocument][]string{},
+    }
+    contentSearcher searcher = contentIndex
+)
+
+// add indexes the text of the document, replacing the one indexed before.
+func (index *invertedIndex) add(document searchDocument, text string) {
+    index.remove(document)
+
+    words := wordPattern.FindAllString(strings.ToLower(text), -1)
+    for _, word := range words {
+        if index.postings[word] == nil {
+            index.postings[word] = map[searchDocument]int{}
+        }
+        index.postings[word][document]++
+    }
+    index.documents[document] = words
+}
+
+func (index *invertedIndex) remove(document searchDocument) {
+    for _, word := range index.documents[document] {
+        delete(index.postings[word], document)
+        if len(index.postings[word]) == 0 {
+            delete(index.postings, word)
+        }
+    }
+    delete(index.documents, document)
+}
+
+func (index *invertedIndex) search(query string, limit int) []searchResult {
+    scores := map[searchDocument]float64{}
+    for _, term := range wordPattern.FindAllString(strings.ToLower(query), -1) {
+        idf := math.Log(1 + float64(len(index.documents))/float64(len(index.postings[term])))
+        for document, count := range index.postings[term] {
+            scores[document] += float64(count) * idf
+        }
+    }
+
+    results := []searchResult{}
+    for document, score := range scores {
+        switch document.Type {
+        case "post":
+            post, ok := posts[document.ID]
+            if ok && post.HiddenAt == nil {
+                results = append(results, searchResult{
+                    Type:    "post",
+                    ID:      post.ID,
+                    PostID:  post.ID,
+                    Title:   post.Title,
+                    Snippet: highlight(post.Content, query),
+                    Score:   score,
+                })
+            }
+        case "comment":
+            comment, ok := comments[document.ID]
+            if ok && comment.HiddenAt == nil {
+                post, ok := posts[comment.PostID]
+                if ok && post.HiddenAt == nil {
+                    results = append(results, searchResult{
+                        Type:    "comment",
+                        ID:      comment.ID,
+                        PostID:  comment.PostID,
+                        Snippet: highlight(comment.Content, query),
+                        Score:   score,
+                    })
+                }
+            }
+        }
+    }
+
+    sort.Slice(results, func(i int, j int) bool {
+        if results[i].Score != results[j].Score {
+            return results[i].Score > results[j].Score
+        }
+        if results[i].Type != results[j].Type {
+            return results[i].Type > results[j].Type
+        }
+        return results[i].ID < results[j].ID
+    })
+    if len(results) > limit {
+        results = results[:limit]
+    }
+
+    return results
+}
+
+// matchesSearch tells whether the word starts with one of the words of the query.
+func matchesSearch(word string, query string) bool {
+    word = strings.ToLower(word)
+    for _, term := range wordPattern.FindAllString(strings.ToLower(query), -1) {
+        if strings.HasPrefix(word, term) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// highlight returns the part of the text around the first word matching the query, as HTML with the matching words
+// in <mark>.
+func highlight(text string, query string) string {
+    var snippet strings.Builder
+
+    words := wordPattern.FindAllStringIndex(text, -1)
+
+    start := 0
+    for _, word := range words {
+        if matchesSearch(text[word[0]:word[1]], query) {
+            start = word[0] - snippetLength/4
+            break
+        }
+    }
+    if start < 0 {
+        start = 0
+    }
+    end := start + snippetLength
+    if end > len(text) {
+        end = len(text)
+    }
+
+    // The text is cut between the characters
+    for start > 0 && !utf8.RuneStart(text[start]) {
+        start--
+    }
+    for end < len(text) && !utf8.RuneStart(text[end]) {
+        end++
+    }
+
+    if start > 0 {
+        snippet.WriteString("…")
+    }
+    position := start
+    for _, word := range words {
+        if word[0] < start || word[1] > end || !matchesSearch(text[word[0]:word[1]], query) {
+            continue
+        }
+        snippet.WriteString(html.EscapeString(text[position:word[0]]))
+        snippet.WriteString("<mark>" + html.EscapeString(text[word[0]:word[1]]) + "</mark>")
+        position = word[1]
+    }
+    snippet.WriteString(html.EscapeString(text[position:end]))
+    if end < len(text) {
+        snippet.WriteString("…")
+    }
+
+    return snippet.String()
+}
+
+func searchContent(context echo.Context) error {
+    query := strings.TrimSpace(context.QueryParam("q"))
+    if query == "" {
+        return context.JSON(http.StatusBadRequest, "Provided query is empty.")
+    }
+
+    limit := defaultPageLimit
+    if value := context.QueryParam("limit"); value != "" {
+        number, err := strconv.Atoi(value)
+        if err != nil || number < 1 || number > maxPageLimit {
+            return context.JSON(http.StatusBadRequest, "Provided limit is invalid.")
+        }
+        limit = number
+    }
+
+    return context.JSON(http.StatusOK, contentSearcher.search(query, limit))
+}
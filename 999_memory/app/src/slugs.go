@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "github.com/labstack/echo"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    // Number of bytes of the title kept in a slug
+    maxSlugLength = 64
+)
+
+var (
+    slugSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+    // Slugs of the posts, along with the ones of their former titles leading to them
+    postSlugs = map[string]int{}
+)
+
+// slugBase returns the slug made of the title, in lowercase letters and digits separated by single hyphens, before a
+// number is added to it to make it unique.
+func slugBase(title string) string {
+    slug := strings.Trim(slugSeparators.ReplaceAllString(strings.ToLower(title), "-"), "-")
+    if len(slug) > maxSlugLength {
+        end := maxSlugLength
+        for !utf8.RuneStart(slug[end]) {
+            end--
+        }
+        slug = strings.TrimRight(slug[:end], "-")
+    }
+    if slug == "" {
+        slug = "post"
+    }
+
+    return slug
+}
+
+// hasSlugBase tells whether the slug has been made of the base, with or without a number.
+func hasSlugBase(slug string, base string) bool {
+    if slug == base {
+        return true
+    }
+
+    number := strings.TrimPrefix(slug, base+"-")
+    return number != slug && number != "" && strings.Trim(number, "0123456789") == ""
+}
+
+// assignSlug gives the post a unique slug made of its title, unless the current one has been made of the same words.
+// The previous slug stays behind, pointing at the post.
+func assignSlug(post *post) {
+    base := slugBase(post.Title)
+    if hasSlugBase(post.Slug, base) {
+        return
+    }
+
+    for number := 1; ; number++ {
+        slug := base
+        if number > 1 {
+            slug = fmt.Sprintf("%v-%v", base, number)
+        }
+
+        // A former slug of the post is taken back, but nobody else's
+        if id, ok := postSlugs[slug]; !ok || id == post.ID {
+            postSlugs[slug] = post.ID
+            post.Slug = slug
+            return
+        }
+    }
+}
+
+// removeSlugs frees the slugs of the deleted post.
+func removeSlugs(post *post) {
+    for slug, id := range postSlugs {
+        if id == post.ID {
+            delete(postSlugs, slug)
+        }
+    }
+}
+
+func retrievePostBySlug(context echo.Context) error {
+    id, ok := postSlugs[context.Param("slug")]
+    if !ok {
+        return context.NoContent(http.StatusNotFound)
+    }
+
+    post, ok := posts[id]
+    if !ok || post.HiddenAt != nil {
+        return context.NoContent(http.StatusNotFound)
+    }
+    if post.Slug != context.Param("slug") {
+        return context.Redirect(http.StatusMovedPermanently, "/posts/by-slug/"+url.PathEscape(post.Slug))
+    }
+
+    return context.JSON(http.StatusOK, post)
+}
@@ -3,14 +3,18 @@ package main
 import (
     "github.com/labstack/echo"
     "net/http"
+    "sort"
     "strings"
+    "time"
 )
 
 type (
     user struct {
-        Name         string `json:"name"`
-        PasswordHash string `json:"-"`
-        Email        string `json:"email"`
+        Name         string    `json:"name"`
+        PasswordHash string    `json:"-"`
+        Email        string    `json:"email"`
+        Role         string    `json:"role"`
+        CreateDate   time.Time `json:"create_date"`
     }
 
     userNew struct {
@@ -40,8 +44,30 @@ func getUserOrError(context echo.Context) (*user, int) {
     return user, 0
 }
 
+func (user *user) pageCursor() pageCursor {
+    return pageCursor{CreateDate: user.CreateDate, ID: user.Name}
+}
+
 func listUserAccounts(context echo.Context) error {
-    return context.JSON(http.StatusOK, users)
+    page, err := getPageQuery(context)
+    if err != nil {
+        return context.JSON(http.StatusBadRequest, err.Error())
+    }
+
+    listedUsers := []*user{}
+    for _, user := range users {
+        listedUsers = append(listedUsers, user)
+    }
+
+    cursorAt := func(i int) pageCursor {
+        return listedUsers[i].pageCursor()
+    }
+    sort.Slice(listedUsers, func(i int, j int) bool {
+        return cursorAt(i).before(cursorAt(j))
+    })
+    start, end, next := page.bounds(len(listedUsers), cursorAt)
+
+    return sendPage(context, listedUsers[start:end], next)
 }
 
 func createUserAccount(context echo.Context) error {
@@ -68,6 +94,8 @@ func createUserAccount(context echo.Context) error {
     user.Name = userNew.Name
     user.PasswordHash = hashedPassword
     user.Email = userNew.Email
+    user.Role = RoleUser
+    user.CreateDate = time.Now()
     users[user.Name] = user
 
     return context.JSON(http.StatusCreated, user)